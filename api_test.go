@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 // Valid no user and no password.
@@ -686,7 +690,7 @@ func TestFreightZunkaAPI(t *testing.T) {
 		Width:      40,   // cm.
 		Price:      2512.22,
 	}
-	if !p.ValidateCorreios() {
+	if err := p.ValidateCorreios(); err != nil {
 		t.Errorf("Not a valid pack to estimate correios shipping. Pack: %+v", p)
 	}
 
@@ -1110,7 +1114,7 @@ func TestUpdateMotoboyFreightAPI(t *testing.T) {
 func TestDeleteMotoboyFreightAPI(t *testing.T) {
 	// Get city id to delete.
 	city := "Nova Lima"
-	freight, ok := getMotoboyFreightByLocation("mg", city)
+	freight, ok := getMotoboyFreightByLocation(context.Background(), "mg", city)
 	if !ok {
 		t.Errorf("No city %s to test delete.", city)
 	}
@@ -1134,3 +1138,1186 @@ func TestDeleteMotoboyFreightAPI(t *testing.T) {
 		t.Errorf("res.Body:  %s\n", res.Body.String())
 	}
 }
+
+/******************************************************************************
+*	ERRORS
+*******************************************************************************/
+// Not found region freight.
+func TestRegionFreightNotFoundAPI(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/region-freight/0", nil)
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	want := 404
+	if res.Code != want {
+		t.Errorf("got:  %v, want  %v\n", res.Code, want)
+	}
+	aErr := apiError{}
+	err = json.Unmarshal(res.Body.Bytes(), &aErr)
+	if err != nil {
+		t.Errorf("Err: %s, body: %s", err, res.Body.String())
+		return
+	}
+	if aErr.Code != ERR_NOT_FOUND {
+		t.Errorf("got:  %v, want  %v\n", aErr.Code, ERR_NOT_FOUND)
+	}
+}
+
+// Invalid id.
+func TestRegionFreightInvalidIdAPI(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodDelete, "/freightsrv/region-freight/abc", nil)
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	want := 400
+	if res.Code != want {
+		t.Errorf("got:  %v, want  %v\n", res.Code, want)
+	}
+	aErr := apiError{}
+	json.Unmarshal(res.Body.Bytes(), &aErr)
+	if aErr.Code != ERR_INVALID_ID {
+		t.Errorf("got:  %v, want  %v\n", aErr.Code, ERR_INVALID_ID)
+	}
+}
+
+// Zunka freight with invalid CEP.
+func TestFreightZunkaAPIV2InvalidCEP(t *testing.T) {
+	productsIn := zunkaProducts{
+		CepDestiny: "3117021",
+		Products: []zunkaProduct{
+			{
+				ID:       "1234",
+				Dealer:   "Dell",
+				Length:   20,
+				Width:    90,
+				Height:   39,
+				Weight:   1250,
+				Quantity: 1,
+				Price:    2512.22,
+			},
+		},
+	}
+	reqBody, err := json.Marshal(productsIn)
+	if err != nil {
+		t.Error(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/freights/zunka", bytes.NewBuffer(reqBody))
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	want := 422
+	if res.Code != want {
+		t.Errorf("got:  %v, want  %v\n", res.Code, want)
+	}
+	aErr := apiError{}
+	json.Unmarshal(res.Body.Bytes(), &aErr)
+	if aErr.Code != ERR_INVALID_CEP || aErr.Field != "cepDestiny" {
+		t.Errorf("got:  %+v, want code %v and field cepDestiny\n", aErr, ERR_INVALID_CEP)
+	}
+}
+
+// Zunka freight with product without weight.
+func TestFreightZunkaAPIV2ZeroWeight(t *testing.T) {
+	productsIn := zunkaProducts{
+		CepDestiny: "31170210",
+		Products: []zunkaProduct{
+			{
+				ID:       "1234",
+				Dealer:   "Dell",
+				Length:   20,
+				Width:    90,
+				Height:   39,
+				Weight:   0,
+				Quantity: 1,
+				Price:    2512.22,
+			},
+		},
+	}
+	reqBody, err := json.Marshal(productsIn)
+	if err != nil {
+		t.Error(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/freights/zunka", bytes.NewBuffer(reqBody))
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	want := 422
+	if res.Code != want {
+		t.Errorf("got:  %v, want  %v\n", res.Code, want)
+	}
+	aErr := apiError{}
+	json.Unmarshal(res.Body.Bytes(), &aErr)
+	if aErr.Code != ERR_INVALID_WEIGHT || aErr.Field != "products[0].weight" {
+		t.Errorf("got:  %+v, want code %v and field products[0].weight\n", aErr, ERR_INVALID_WEIGHT)
+	}
+}
+
+// Correios not answering until request gives up.
+type blockingTransport struct{}
+
+func (blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+// Providers not answered in quote budget dropped, freights from others.
+func TestFreightZunkaAPIV2QuoteBudget(t *testing.T) {
+	defer func(c Cache) {
+		cache = c
+		upstreamClients = map[string]*http.Client{}
+	}(cache)
+	cache = newMemoryCache(100)
+	upstreamClients = map[string]*http.Client{UPSTREAM_CORREIOS: {Transport: blockingTransport{}}}
+	// Breakers opened by previous calls.
+	breakers = map[string]*circuitBreaker{}
+	// Address and region from cache, not depend on ViaCEP.
+	cep := "31170210"
+	address := `{"cep": "31170-210", "logradouro": "Rua Deputado Cláudio Pinheiro de Lima", "bairro": "Cidade Nova", "localidade": "Belo Horizonte", "uf": "MG"}`
+	setViaCEPAddressCache(&cep, &address)
+	setCEPRegion(cep, "southeast")
+
+	productsIn := zunkaProducts{
+		CepDestiny: "31170210",
+		Products: []zunkaProduct{
+			{ID: "1234", Dealer: "Dell", Length: 20, Width: 90, Height: 39, Weight: 1250, Quantity: 1, Price: 2512.22},
+		},
+	}
+	reqBody, _ := json.Marshal(productsIn)
+	quote := func(budget string, query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, "/freightsrv/freights/zunka"+query, bytes.NewBuffer(reqBody))
+		req.SetBasicAuth("bypass", "123456")
+		req.Header.Set(QUOTE_BUDGET_HEADER, budget)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	start := time.Now()
+	res := quote("100", "")
+	if time.Since(start) > time.Second {
+		t.Errorf("took %v, want about the 100ms budget", time.Since(start))
+	}
+	if got := res.Header().Get(QUOTE_TIMED_OUT_HEADER); got != "correios" {
+		t.Errorf("got timed out %q, want correios", got)
+	}
+	frs := []freight{}
+	json.Unmarshal(res.Body.Bytes(), &frs)
+	if res.Code != 200 || len(frs) == 0 {
+		t.Errorf("got code %d and %s, want 200 and freights without Correios", res.Code, res.Body.String())
+	}
+	for _, fr := range frs {
+		if fr.Carrier == "Correios" {
+			t.Errorf("got %+v, want no Correios freight", fr)
+		}
+	}
+
+	// Listed in body with detail.
+	detail := zunkaFreightsDetail{}
+	res = quote("100", "?detail=true")
+	json.Unmarshal(res.Body.Bytes(), &detail)
+	if res.Code != 200 || len(detail.Freights) == 0 || len(detail.TimedOut) != 1 || detail.TimedOut[0] != "correios" {
+		t.Errorf("got code %d and %s, want 200, freights and timed out correios", res.Code, res.Body.String())
+	}
+
+	// Stored with quote.
+	q, err := getQuoteByID(res.Header().Get("X-Quote-ID"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := quoteTrace{}
+	json.Unmarshal(q.Providers, &trace.Providers)
+	if got := trace.timedOut(); len(got) != 1 || got[0] != "correios" || trace.fallback() != FALLBACK_CORREIOS_TIMEOUT {
+		t.Errorf("got timed out %v and fallback %q, want correios and %s", got, trace.fallback(), FALLBACK_CORREIOS_TIMEOUT)
+	}
+
+	// Above max budget.
+	res = quote(strconv.Itoa(int(cfg.Quote.MaxBudget.Milliseconds())+1), "")
+	aErr := apiError{}
+	json.Unmarshal(res.Body.Bytes(), &aErr)
+	if res.Code != 400 || aErr.Code != ERR_INVALID_HEADER {
+		t.Errorf("got code %d and %+v, want 400 and %s", res.Code, aErr, ERR_INVALID_HEADER)
+	}
+}
+
+// Invalid region freight fields.
+func TestCreateRegionFreightInvalidFieldsAPI(t *testing.T) {
+	frJSON, _ := json.Marshal(regionFreight{
+		Region:   "east",
+		Weight:   50,
+		Deadline: 0,
+		Price:    100,
+	})
+	req, _ := http.NewRequest(http.MethodPost, "/freightsrv/region-freight", bytes.NewReader(frJSON))
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	want := 422
+	if res.Code != want {
+		t.Errorf("got:  %v, want  %v\n", res.Code, want)
+	}
+	aErr := apiError{}
+	json.Unmarshal(res.Body.Bytes(), &aErr)
+	fields := map[string]bool{}
+	for _, fe := range aErr.Errors {
+		fields[fe.Field] = true
+	}
+	for _, field := range []string{"region", "weight", "deadline"} {
+		if !fields[field] {
+			t.Errorf("No error for field %s, body: %s", field, res.Body.String())
+		}
+	}
+}
+
+// Duplicated region freight.
+func TestCreateRegionFreightDuplicatedAPI(t *testing.T) {
+	frs, err := getAllFreightRegion()
+	if err != nil || len(frs) == 0 {
+		t.Errorf("No region freight to duplicate. %v", err)
+		return
+	}
+	frJSON, _ := json.Marshal(frs[0])
+	req, _ := http.NewRequest(http.MethodPost, "/freightsrv/region-freight", bytes.NewReader(frJSON))
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	want := 409
+	if res.Code != want {
+		t.Errorf("got:  %v, want  %v\n", res.Code, want)
+		t.Errorf("res.Body:  %s\n", res.Body.String())
+	}
+}
+
+/******************************************************************************
+*	LIST
+*******************************************************************************/
+// Filter, sort and paginate region freights.
+func TestListRegionFreightsAPI(t *testing.T) {
+	url := "/freightsrv/region-freights?region=south,north&weightMin=1000&sort=-price&limit=2&offset=0"
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != 200 {
+		t.Errorf("Returned code: %d, body: %s", res.Code, res.Body.String())
+		return
+	}
+
+	freights := []regionFreight{}
+	err = json.Unmarshal(res.Body.Bytes(), &freights)
+	if err != nil {
+		t.Errorf("Err: %s", err)
+		return
+	}
+	if len(freights) > 2 {
+		t.Errorf("got %d freights, want at most 2", len(freights))
+	}
+	for i, fr := range freights {
+		if fr.Region != "south" && fr.Region != "north" {
+			t.Errorf("got region %s, want south or north", fr.Region)
+		}
+		if i > 0 && fr.Price > freights[i-1].Price {
+			t.Errorf("Not sorted by price desc: %+v", freights)
+		}
+	}
+	total, err := strconv.Atoi(res.Header().Get("X-Total-Count"))
+	if err != nil || total < len(freights) {
+		t.Errorf("X-Total-Count: %q, freights: %d", res.Header().Get("X-Total-Count"), len(freights))
+	}
+}
+
+// Motoboy freights by city substring.
+func TestListMotoboyFreightsByCityAPI(t *testing.T) {
+	url := "/freightsrv/motoboy-freights?city=Sabar%C3%A1"
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != 200 {
+		t.Errorf("Returned code: %d, body: %s", res.Code, res.Body.String())
+		return
+	}
+	freights := []motoboyFreight{}
+	json.Unmarshal(res.Body.Bytes(), &freights)
+	for _, fr := range freights {
+		if !strings.Contains(normalizeCity(fr.City), "sabara") {
+			t.Errorf("got city %s, want contains sabara", fr.City)
+		}
+	}
+}
+
+// Invalid sort column.
+func TestListDealerFreightsInvalidSortAPI(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/dealer-freights?sort=password", nil)
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != 400 {
+		t.Errorf("got:  %v, want  %v\n", res.Code, 400)
+	}
+}
+
+/******************************************************************************
+*	CSV
+*******************************************************************************/
+// Export region freights csv.
+func TestExportRegionFreightCSVAPI(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/region-freights/csv?region=south", nil)
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != 200 {
+		t.Errorf("Returned code: %d, body: %s", res.Code, res.Body.String())
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	if lines[0] != "region,weight,deadline,price" {
+		t.Errorf("got header %q", lines[0])
+	}
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, "south,") {
+			t.Errorf("got line %q, want only south", line)
+		}
+	}
+}
+
+// Import dealer freights csv.
+func TestImportDealerFreightCSVAPI(t *testing.T) {
+	importCSV := func(body string) (int, csvImportReport) {
+		req, _ := http.NewRequest(http.MethodPost, "/freightsrv/dealer-freights/csv?mode=merge", strings.NewReader(body))
+		req.SetBasicAuth("bypass", "123456")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		report := csvImportReport{}
+		json.Unmarshal(res.Body.Bytes(), &report)
+		return res.Code, report
+	}
+
+	// Insert.
+	code, report := importCSV("dealer;weight;deadline;price\nAldo;7000;9;15000\n")
+	if code != 200 || report.Inserted != 1 {
+		t.Errorf("got code %d, report %+v, want 200 and one inserted", code, report)
+	}
+	// Same row again.
+	code, report = importCSV("dealer,weight,deadline,price\naldo,7000,9,15000\n")
+	if code != 200 || report.Unchanged != 1 {
+		t.Errorf("got code %d, report %+v, want 200 and one unchanged", code, report)
+	}
+	// Rejected, nothing applied.
+	code, report = importCSV("dealer,weight,deadline,price\naldo,7000,9,16000\nunknown,7000,9,15000\n")
+	if code != 422 || report.Applied || len(report.Rejected) != 1 || report.Rejected[0].Line != 3 {
+		t.Errorf("got code %d, report %+v, want 422 and line 3 rejected", code, report)
+	}
+	frs, err := getDealerFreightByDealerAndWeight(context.Background(), "aldo", 7000)
+	if !err || len(frs) == 0 {
+		t.Error("Imported dealer freight not found")
+		return
+	}
+	for _, fr := range frs {
+		if fr.Weight == 7000 && fr.Deadline == 9 {
+			if fr.Price != 15000 {
+				t.Errorf("got price %d, want 15000", fr.Price)
+			}
+			deleteDealerFreight(fr.ID, nil)
+		}
+	}
+}
+
+/******************************************************************************
+*	AUDIT
+*******************************************************************************/
+// Create, update and delete are audited with user.
+func TestAuditRegionFreightAPI(t *testing.T) {
+	send := func(method, url string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, url, bytes.NewReader(b))
+		req.SetBasicAuth("bypass", "123456")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	fr := regionFreight{Region: "north", Weight: 77000, Deadline: 21, Price: 9900}
+	if res := send(http.MethodPost, "/freightsrv/region-freight", fr); res.Code != 200 {
+		t.Fatalf("Creating, returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+	frs, err := getFreightRegionByRegionAndWeight(context.Background(), "north", 77000)
+	if !err || len(frs) != 1 {
+		t.Fatalf("Created region freight not found")
+	}
+	fr.ID = frs[0].ID
+	fr.Price = 10900
+	if res := send(http.MethodPut, "/freightsrv/region-freight", fr); res.Code != 200 {
+		t.Fatalf("Updating, returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+	if res := send(http.MethodDelete, "/freightsrv/region-freight/"+strconv.Itoa(fr.ID), nil); res.Code != 200 {
+		t.Fatalf("Deleting, returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+
+	res := send(http.MethodGet, fmt.Sprintf("/freightsrv/audit?entity=freight_region&entityId=%d&user=bypass&from=2020-01-01&sort=id", fr.ID), nil)
+	if res.Code != 200 {
+		t.Fatalf("Returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+	entries := []struct {
+		Action string                 `json:"action"`
+		User   string                 `json:"user"`
+		Before map[string]interface{} `json:"before"`
+		After  map[string]interface{} `json:"after"`
+	}{}
+	json.Unmarshal(res.Body.Bytes(), &entries)
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3, body: %s", len(entries), res.Body.String())
+	}
+	for i, action := range []string{AUDIT_CREATE, AUDIT_UPDATE, AUDIT_DELETE} {
+		if entries[i].Action != action || entries[i].User != "bypass" {
+			t.Errorf("entry %d: got %s by %s, want %s by bypass", i, entries[i].Action, entries[i].User, action)
+		}
+	}
+	if entries[0].Before != nil || entries[0].After["price"] != float64(9900) {
+		t.Errorf("create: got before %v, after %v", entries[0].Before, entries[0].After)
+	}
+	if entries[1].Before["price"] != float64(9900) || entries[1].After["price"] != float64(10900) {
+		t.Errorf("update: got before %v, after %v", entries[1].Before, entries[1].After)
+	}
+	if entries[2].Before["price"] != float64(10900) || entries[2].After != nil {
+		t.Errorf("delete: got before %v, after %v", entries[2].Before, entries[2].After)
+	}
+
+	// Not changed if not audited.
+	sql3DB.MustExec("CREATE TRIGGER test_audit_log_fail BEFORE INSERT ON audit_log BEGIN SELECT RAISE(ABORT, 'audit failed'); END")
+	fr = regionFreight{Region: "north", Weight: 78000, Deadline: 21, Price: 9900}
+	res = send(http.MethodPost, "/freightsrv/region-freight", fr)
+	sql3DB.MustExec("DROP TRIGGER test_audit_log_fail")
+	if res.Code != 500 {
+		t.Errorf("Creating not audited, returned code: %d, want 500", res.Code)
+	}
+	var created int
+	sql3DB.Get(&created, "SELECT COUNT(*) FROM freight_region WHERE region='north' AND weight=78000")
+	if created != 0 {
+		t.Errorf("Region freight created without audit")
+	}
+
+	// Append only.
+	if _, err := sql3DB.Exec("DELETE FROM audit_log"); err == nil {
+		t.Errorf("audit_log entries deleted, want append only")
+	}
+}
+
+// Invalid date range.
+func TestAuditInvalidDateAPI(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/audit?from=yesterday", nil)
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != 400 || !strings.Contains(res.Body.String(), ERR_INVALID_QUERY) {
+		t.Errorf("got %d %s, want 400 %s", res.Code, res.Body.String(), ERR_INVALID_QUERY)
+	}
+}
+
+/******************************************************************************
+*	RATE VERSION
+*******************************************************************************/
+// Draft, change, diff, schedule and delete region rate version.
+func TestRateVersionAPI(t *testing.T) {
+	send := func(method, url string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, url, bytes.NewReader(b))
+		req.SetBasicAuth("bypass", "123456")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+	active, err := activeRateVersion(sql3DB, "freight_region", time.Now())
+	if err != nil || active == 0 {
+		t.Fatalf("No active region rate version, err: %v", err)
+	}
+
+	// Draft copy of active version.
+	res := send(http.MethodPost, "/freightsrv/rate-version", map[string]interface{}{"entity": "freight_region", "note": "Test"})
+	draft := rateVersion{}
+	json.Unmarshal(res.Body.Bytes(), &draft)
+	if res.Code != 200 || draft.Status != RATE_DRAFT {
+		t.Fatalf("Creating, returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+	defer deleteRateVersion(draft.ID, nil)
+
+	// Change draft price.
+	res = send(http.MethodGet, fmt.Sprintf("/freightsrv/region-freights?version=%d&region=south&weightMax=4000&sort=deadline", draft.ID), nil)
+	frs := []regionFreight{}
+	json.Unmarshal(res.Body.Bytes(), &frs)
+	if len(frs) == 0 || frs[0].VersionID != draft.ID {
+		t.Fatalf("Draft rows not found, body: %s", res.Body.String())
+	}
+	activePrice := frs[0].Price
+	frs[0].Price += 1000
+	if res = send(http.MethodPut, "/freightsrv/region-freight", frs[0]); res.Code != 200 {
+		t.Fatalf("Updating draft row, returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+
+	// Diff.
+	res = send(http.MethodGet, fmt.Sprintf("/freightsrv/rate-versions/diff?from=%d&to=%d", active, draft.ID), nil)
+	diff := rateDiff{}
+	json.Unmarshal(res.Body.Bytes(), &diff)
+	if res.Code != 200 || diff.Changed != 1 || diff.Added != 0 || diff.Removed != 0 {
+		t.Errorf("Diff, got code %d, body: %s, want one changed", res.Code, res.Body.String())
+	}
+
+	// Schedule.
+	res = send(http.MethodPut, fmt.Sprintf("/freightsrv/rate-version/%d", draft.ID), map[string]string{"status": "scheduled", "effectiveFrom": time.Now().AddDate(0, 0, 1).Format("2006-01-02")})
+	if res.Code != 200 || !strings.Contains(res.Body.String(), RATE_SCHEDULED) {
+		t.Fatalf("Scheduling, returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+	if id, _ := activeRateVersion(sql3DB, "freight_region", time.Now()); id != active {
+		t.Errorf("Active version now, got %d, want %d", id, active)
+	}
+	if id, _ := activeRateVersion(sql3DB, "freight_region", time.Now().AddDate(0, 0, 2)); id != draft.ID {
+		t.Errorf("Active version after effective from, got %d, want %d", id, draft.ID)
+	}
+	lookup, ok := getFreightRegionByRegionAndWeight(context.Background(), "south", 4000)
+	if !ok || lookup[0].Price != activePrice {
+		t.Errorf("Lookup before effective from, got %+v, want price %d", lookup, activePrice)
+	}
+
+	// Only in future.
+	res = send(http.MethodPut, fmt.Sprintf("/freightsrv/rate-version/%d", draft.ID), map[string]string{"status": "scheduled", "effectiveFrom": "2020-01-01"})
+	if res.Code != 422 {
+		t.Errorf("Scheduling in the past, got code %d, want 422", res.Code)
+	}
+
+	// Scheduled already effective, before the scheduler runs.
+	past := time.Now().Add(-time.Minute).UTC().Format(SQLITE_TIME_FORMAT)
+	future := time.Now().AddDate(0, 0, 1).UTC().Format(SQLITE_TIME_FORMAT)
+	sql3DB.MustExec("UPDATE rate_version SET effective_from=? WHERE id=?", past, draft.ID)
+	if res = send(http.MethodPut, fmt.Sprintf("/freightsrv/rate-version/%d", draft.ID), map[string]string{"status": "draft"}); res.Code != 409 {
+		t.Errorf("Back to draft after effective from, got code %d, want 409", res.Code)
+	}
+	if res = send(http.MethodDelete, fmt.Sprintf("/freightsrv/rate-version/%d", draft.ID), nil); res.Code != 409 {
+		t.Errorf("Deleting after effective from, got code %d, want 409", res.Code)
+	}
+	res = send(http.MethodPost, "/freightsrv/region-freight", regionFreight{VersionID: active, Region: "north", Weight: 77000, Deadline: 5, Price: 9000})
+	if res.Code != 409 {
+		t.Errorf("Changing rows of version replaced after effective from, got code %d, want 409", res.Code)
+	}
+	sql3DB.MustExec("UPDATE rate_version SET status=?, effective_from=? WHERE id=?", RATE_SCHEDULED, future, draft.ID)
+	sql3DB.MustExec("UPDATE rate_version SET status=? WHERE id=?", RATE_ACTIVE, active)
+
+	// Delete.
+	if res = send(http.MethodDelete, fmt.Sprintf("/freightsrv/rate-version/%d", draft.ID), nil); res.Code != 200 {
+		t.Errorf("Deleting, returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+	if res = send(http.MethodDelete, fmt.Sprintf("/freightsrv/rate-version/%d", active), nil); res.Code != 409 {
+		t.Errorf("Deleting active version, got code %d, want 409", res.Code)
+	}
+}
+
+/******************************************************************************
+*	QUOTE
+*******************************************************************************/
+// Quote is saved and can be fetched by id from response header.
+func TestFreightZunkaAPIV2QuoteAPI(t *testing.T) {
+	// Address and region from cache, not depend on ViaCEP.
+	cep := "31170210"
+	address := `{"cep": "31170-210", "logradouro": "Rua Deputado Cláudio Pinheiro de Lima", "bairro": "Cidade Nova", "localidade": "Belo Horizonte", "uf": "MG"}`
+	setViaCEPAddressCache(&cep, &address)
+	setCEPRegion(cep, "southeast")
+
+	body := `{"cepDestiny": "31170210", "products": [{"id": "1", "dealer": "Zunka", "length": 20, "width": 10, "height": 5, "weight": 1500, "quantity": 1, "price": 100}]}`
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/freights/zunka", strings.NewReader(body))
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	id := res.Header().Get("X-Quote-ID")
+	if res.Code != 200 || id == "" {
+		t.Fatalf("Returned code: %d, quote id: %q, body: %s", res.Code, id, res.Body.String())
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "/freightsrv/quotes/"+id, nil)
+	req.SetBasicAuth("bypass", "123456")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	q := struct {
+		ID        string          `json:"id"`
+		Client    string          `json:"client"`
+		Packs     []pack          `json:"packs"`
+		Providers []quoteProvider `json:"providers"`
+		Freights  []freight       `json:"freights"`
+	}{}
+	json.Unmarshal(res.Body.Bytes(), &q)
+	if res.Code != 200 || q.ID != id || q.Client != QUOTE_ZUNKA {
+		t.Fatalf("Returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+	if len(q.Packs) != 1 || q.Packs[0].Weight != 1500 || len(q.Providers) != 3 || len(q.Freights) == 0 {
+		t.Errorf("got %d packs, %d providers and %d freights, want 1 pack of 1500 g, 3 providers and some freight", len(q.Packs), len(q.Providers), len(q.Freights))
+	}
+
+	// Not found.
+	req, _ = http.NewRequest(http.MethodGet, "/freightsrv/quotes/none", nil)
+	req.SetBasicAuth("bypass", "123456")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != 404 {
+		t.Errorf("got code %d, want 404", res.Code)
+	}
+}
+
+// Only old quotes are purged.
+func TestPurgeQuotes(t *testing.T) {
+	_, err := sql3DB.Exec("INSERT INTO quote(id, client, created_at) VALUES(?, ?, ?), (?, ?, CURRENT_TIMESTAMP)", "old-quote", QUOTE_ZUNKA, "2000-01-01 00:00:00", "new-quote", QUOTE_ZUNKA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = purgeQuotes(QUOTE_RETENTION); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getQuoteByID("old-quote"); err == nil {
+		t.Errorf("old quote not purged")
+	}
+	if _, err = getQuoteByID("new-quote"); err != nil {
+		t.Errorf("new quote purged, %v", err)
+	}
+}
+
+// Reserved price is confirmed, after reservation expire quote again.
+func TestConfirmQuoteAPI(t *testing.T) {
+	cep := "31170210"
+	address := `{"cep": "31170-210", "logradouro": "Rua Deputado Cláudio Pinheiro de Lima", "bairro": "Cidade Nova", "localidade": "Belo Horizonte", "uf": "MG"}`
+	setViaCEPAddressCache(&cep, &address)
+	setCEPRegion(cep, "southeast")
+
+	body := `{"cepDestiny": "31170210", "products": [{"id": "1", "dealer": "Zunka", "length": 20, "width": 10, "height": 5, "weight": 1500, "quantity": 1, "price": 100}]}`
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/freights/zunka?reserve=true", strings.NewReader(body))
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	id := res.Header().Get("X-Reservation-ID")
+	frs := []freight{}
+	json.Unmarshal(res.Body.Bytes(), &frs)
+	if res.Code != 200 || id == "" || res.Header().Get("X-Reservation-Expires") == "" || len(frs) == 0 {
+		t.Fatalf("Returned code: %d, reservation id: %q, body: %s", res.Code, id, res.Body.String())
+	}
+	chosen := fmt.Sprintf(`{"carrier": %q, "serviceCode": %q}`, frs[0].Carrier, frs[0].ServiceCode)
+
+	confirm := func(id, choice string) (int, quoteConfirmation) {
+		req, _ := http.NewRequest(http.MethodPost, "/freightsrv/quotes/"+id+"/confirm", strings.NewReader(choice))
+		req.SetBasicAuth("bypass", "123456")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		conf := quoteConfirmation{}
+		json.Unmarshal(res.Body.Bytes(), &conf)
+		return res.Code, conf
+	}
+
+	// Reserved.
+	code, conf := confirm(id, chosen)
+	if code != 200 || conf.QuoteID != id || conf.Freight == nil || conf.Freight.Price != frs[0].Price {
+		t.Fatalf("got code %d and %+v, want 200 and reserved price %.2f", code, conf, frs[0].Price)
+	}
+
+	// Service not quoted.
+	if code, _ = confirm(id, `{"carrier": "None", "serviceCode": "none"}`); code != 422 {
+		t.Errorf("got code %d, want 422", code)
+	}
+
+	// Reservation expired, same price with new quote.
+	redisDel(makeQuoteReservationKey(id))
+	code, conf = confirm(id, chosen)
+	if code != 200 || conf.QuoteID == id || conf.Freight == nil || conf.Freight.Price != frs[0].Price {
+		t.Errorf("got code %d and %+v, want 200 and new quote with price %.2f", code, conf, frs[0].Price)
+	}
+
+	// Already expired not saved, it would never expire.
+	if err := setQuoteReservation(id, &quoteReservation{Freights: []*freight{&frs[0]}, ExpiresAt: time.Now().Add(-time.Second)}); err == nil {
+		t.Errorf("Saving expired reservation, want error")
+	}
+	if _, ok := getQuoteReservation(id); ok {
+		t.Errorf("Expired reservation saved")
+	}
+
+	// Invalid reserve.
+	req, _ = http.NewRequest(http.MethodGet, "/freightsrv/freights/zunka?reserve=1000", strings.NewReader(body))
+	req.SetBasicAuth("bypass", "123456")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != 400 {
+		t.Errorf("got code %d, want 400", res.Code)
+	}
+}
+
+// Quote stats grouped by fallback and carrier, as json and csv.
+func TestQuoteStatsAPI(t *testing.T) {
+	trace := quoteTrace{Providers: []quoteProvider{
+		{Provider: "correios", Error: "upstream_error: Correios did not respond correctly"},
+		{Provider: "region", Region: "southeast", Ok: true},
+	}}
+	frs := []*freight{{Carrier: "Transportadora", ServiceCode: "1", Price: 30}, {Carrier: "Transportadora", ServiceCode: "1", Price: 40}}
+	recordQuoteStats(context.Background(), QUOTE_ZOOM, &trace, frs)
+	recordQuoteConfirmStat(context.Background(), QUOTE_ZOOM, &trace, frs[0])
+	quoteStatsWG.Wait()
+
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/quote-stats?client=zoom&region=southeast&groupBy=fallback,carrier,priceBand&sort=event", nil)
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	stats := []quoteStat{}
+	json.Unmarshal(res.Body.Bytes(), &stats)
+	if res.Code != 200 || len(stats) != 3 {
+		t.Fatalf("Returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+	want := []quoteStat{
+		{Event: QUOTE_STAT_CONFIRM, Carrier: "Transportadora", Fallback: FALLBACK_CORREIOS_ERROR, PriceBand: "25-50", Count: 1, PriceAvg: 30, PriceMin: 30, PriceMax: 30},
+		{Event: QUOTE_STAT_OFFER, Carrier: "Transportadora", Fallback: FALLBACK_CORREIOS_ERROR, PriceBand: "25-50", Count: 2, PriceAvg: 35, PriceMin: 30, PriceMax: 40},
+		{Event: QUOTE_STAT_QUOTE, Fallback: FALLBACK_CORREIOS_ERROR, Count: 1},
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Errorf("stats[%d] = %+v, want %+v", i, stats[i], want[i])
+		}
+	}
+
+	// Csv.
+	req, _ = http.NewRequest(http.MethodGet, "/freightsrv/quote-stats/csv?client=zoom&event=offer&groupBy=region", nil)
+	req.SetBasicAuth("bypass", "123456")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	if res.Code != 200 || len(lines) != 2 || lines[1] != ",,,southeast,offer,,,,,2,35.00,30.00,40.00" {
+		t.Errorf("Returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+
+	// Invalid group.
+	req, _ = http.NewRequest(http.MethodGet, "/freightsrv/quote-stats?groupBy=price", nil)
+	req.SetBasicAuth("bypass", "123456")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != 400 {
+		t.Errorf("got code %d, want 400", res.Code)
+	}
+}
+
+/******************************************************************************
+*	METRICS
+*******************************************************************************/
+// Requests by route template, cache and sqlite metrics.
+func TestMetricsAPI(t *testing.T) {
+	handler := newLogger(router)
+	for _, path := range []string{"/freightsrv/hello", "/freightsrv/quotes/none", "/freightsrv/region-freights"} {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		req.SetBasicAuth("bypass", "123456")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	getCEPRegion("31170210")
+
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/metrics", nil)
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != 200 {
+		t.Fatalf("Returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+	for _, want := range []string{
+		`freightsrv_http_requests_total{route="/freightsrv/hello",method="GET",status="200"} `,
+		`freightsrv_http_requests_total{route="/freightsrv/quotes/:id",method="GET",status="404"} `,
+		`freightsrv_http_request_duration_seconds_bucket{route="/freightsrv/hello",method="GET",le="+Inf"} `,
+		`freightsrv_cache_hits_total{family="cep-region"} `,
+		`freightsrv_sqlite_query_duration_seconds_count{op="query"} `,
+	} {
+		if !strings.Contains(res.Body.String(), want) {
+			t.Errorf("metrics without %s", want)
+		}
+	}
+
+	// Unauthorised.
+	req, _ = http.NewRequest(http.MethodGet, "/freightsrv/metrics", nil)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != 401 {
+		t.Errorf("got code %d, want 401", res.Code)
+	}
+}
+
+/******************************************************************************
+*	LOG
+*******************************************************************************/
+// Request logged once as json with request id from client.
+func TestLogRequestIDAPI(t *testing.T) {
+	buf := bytes.Buffer{}
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/quotes/none", nil)
+	req.SetBasicAuth("bypass", "123456")
+	req.Header.Set("X-Request-ID", "test-request-id")
+	res := httptest.NewRecorder()
+	newLogger(router).ServeHTTP(res, req)
+	if res.Header().Get("X-Request-ID") != "test-request-id" {
+		t.Errorf("got request id %q, want test-request-id", res.Header().Get("X-Request-ID"))
+	}
+
+	requests := 0
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		entry := logEntry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line not json: %s", line)
+		}
+		if entry.RequestID != "test-request-id" {
+			t.Errorf("log line without request id: %s", line)
+		}
+		if entry.Msg == "request" {
+			requests++
+			if entry.Status != 404 || entry.Method != http.MethodGet {
+				t.Errorf("got request log %s, want GET with status 404", line)
+			}
+		}
+	}
+	if requests != 1 {
+		t.Errorf("request logged %d times, want 1", requests)
+	}
+}
+
+// Log level changed at runtime, debug lines skipped.
+func TestLogLevelAPI(t *testing.T) {
+	defer setLogLevel(getLogLevel())
+
+	setLevel := func(body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPut, "/freightsrv/admin/log-level", strings.NewReader(body))
+		req.SetBasicAuth("bypass", "123456")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		out := struct {
+			Level string `json:"level"`
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &out)
+		return res.Code, out.Level
+	}
+	if code, level := setLevel(`{"level": "WARNING"}`); code != 200 || level != "warning" {
+		t.Fatalf("got code %d and level %q, want 200 and warning", code, level)
+	}
+	buf := bytes.Buffer{}
+	out := log.Writer()
+	log.SetOutput(&buf)
+	logDebug(context.Background(), "not logged")
+	logWarning(context.Background(), "logged")
+	log.SetOutput(out)
+	if strings.Contains(buf.String(), "not logged") || !strings.Contains(buf.String(), `"level":"warning"`) {
+		t.Errorf("got log %s, want only warning", buf.String())
+	}
+
+	if code, _ := setLevel(`{"level": "verbose"}`); code != 422 {
+		t.Errorf("got code %d, want 422", code)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/admin/log-level", nil)
+	req.SetBasicAuth("bypass", "123456")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != 200 || !strings.Contains(res.Body.String(), `"warning"`) {
+		t.Errorf("Returned code: %d, body: %s", res.Code, res.Body.String())
+	}
+}
+
+/******************************************************************************
+*	HEALTH
+*******************************************************************************/
+// Health without authentication, readiness degraded when upstream failing.
+func TestHealthAPI(t *testing.T) {
+	// Breakers opened by previous calls.
+	breakers = map[string]*circuitBreaker{}
+
+	for _, url := range []string{"/healthz", "/freightsrv/healthz", "/readyz"} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		if res.Code != 200 {
+			t.Errorf("%s got code %d, want 200", url, res.Code)
+		}
+	}
+
+	ready := func() (int, readiness) {
+		req, _ := http.NewRequest(http.MethodGet, "/freightsrv/readyz", nil)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		r := readiness{}
+		json.Unmarshal(res.Body.Bytes(), &r)
+		return res.Code, r
+	}
+	recordUpstreamCall("viacep", fmt.Errorf("timeout"))
+	code, r := ready()
+	if code != 200 || r.Status != HEALTH_DEGRADED || r.Checks["viacep"].Status != HEALTH_DEGRADED || r.Checks["viacep"].Error != "timeout" {
+		t.Errorf("got code %d and %+v, want 200 and viacep degraded", code, r)
+	}
+	if r.Checks["cache"].Status != HEALTH_OK || r.Checks["sqlite"].Status != HEALTH_OK {
+		t.Errorf("got %+v, want cache and sqlite ok", r.Checks)
+	}
+
+	// Recovered.
+	recordUpstreamCall("viacep", nil)
+	if _, r = ready(); r.Checks["viacep"].Status != HEALTH_OK || r.Checks["viacep"].LastSuccess == nil {
+		t.Errorf("got %+v, want viacep ok", r.Checks["viacep"])
+	}
+}
+
+/******************************************************************************
+*	CACHE ADMIN
+******************************************************************************/
+func TestCacheAdminAPI(t *testing.T) {
+	defer func(c Cache) { cache = c }(cache)
+	cache = newMemoryCache(100)
+
+	do := func(method string, url string) (int, string) {
+		req, _ := http.NewRequest(method, url, nil)
+		req.SetBasicAuth("bypass", "123456")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res.Code, res.Body.String()
+	}
+
+	p := pack{CEPOrigin: "31170210", CEPDestiny: "01001000", Length: 20, Width: 15, Height: 10, Weight: 1000, Price: 100}
+	setCorreiosCache(&p, []*freight{{Carrier: "Correios", ServiceCode: "04014", Price: 30, Deadline: 3}})
+	p.CEPDestiny = "01310100"
+	setCorreiosCache(&p, []*freight{{Carrier: "Correios", ServiceCode: "04014", Price: 31, Deadline: 3}})
+	setCEPRegion("01001000", "southeast")
+	setCEPRegion("30140071", "southeast")
+
+	// Families.
+	code, body := do(http.MethodGet, "/freightsrv/admin/cache")
+	stats := cacheStats{}
+	json.Unmarshal([]byte(body), &stats)
+	if code != 200 || stats.Backend != CACHE_MEMORY || len(stats.Families) != len(cacheFamilies) || stats.Families[0].Keys != 2 || stats.Families[0].Bytes == 0 || stats.Families[1].Keys != 2 {
+		t.Errorf("Returned code: %d, body: %s", code, body)
+	}
+
+	// Correios lookup.
+	code, body = do(http.MethodGet, "/freightsrv/admin/cache/correios?cepOrigin=31170210&cepDestiny=01310-100&length=20&width=15&height=10&weight=1000&price=100")
+	lookup := correiosCacheLookup{}
+	json.Unmarshal([]byte(body), &lookup)
+	if code != 200 || len(lookup.Freights) != 1 || lookup.Freights[0].Price != 31 || lookup.Stale {
+		t.Errorf("Returned code: %d, body: %s", code, body)
+	}
+	if code, body = do(http.MethodGet, "/freightsrv/admin/cache/correios?cepOrigin=31170210&cepDestiny=70040010&length=20&width=15&height=10&weight=1000&price=100"); code != 404 {
+		t.Errorf("Returned code: %d, body: %s", code, body)
+	}
+	if code, body = do(http.MethodGet, "/freightsrv/admin/cache/correios?cepDestiny=01310100&length=a"); code != 400 {
+		t.Errorf("Returned code: %d, body: %s", code, body)
+	}
+
+	// Purge by CEP prefix, all families by CEP.
+	if code, body = do(http.MethodDelete, "/freightsrv/admin/cache?cep=01001"); code != 200 || body != `{"deleted":2}` {
+		t.Errorf("Returned code: %d, body: %s", code, body)
+	}
+	// Purge family.
+	if code, body = do(http.MethodDelete, "/freightsrv/admin/cache?family=correios"); code != 200 || body != `{"deleted":1}` {
+		t.Errorf("Returned code: %d, body: %s", code, body)
+	}
+	if getCEPRegion("30140071") != "southeast" {
+		t.Errorf("CEP region of other CEP purged")
+	}
+	for _, url := range []string{"/freightsrv/admin/cache", "/freightsrv/admin/cache?family=unknown", "/freightsrv/admin/cache?cep=abc", "/freightsrv/admin/cache?family=ibge-cities&cep=3"} {
+		if code, body = do(http.MethodDelete, url); code != 400 {
+			t.Errorf("%s returned code: %d, body: %s", url, code, body)
+		}
+	}
+}
+
+/******************************************************************************
+*	RATE LIMIT
+******************************************************************************/
+func TestRateLimitAPI(t *testing.T) {
+	defer func(c Cache, conf config) { cache, cfg = c, conf }(cache, cfg)
+	cache = newMemoryCache(100)
+	cfg.RateLimit = rateLimitConfig{
+		Enabled: true,
+		Default: rateLimit{Rate: 1, Burst: 1},
+		Routes:  map[string]rateLimit{"/freightsrv/freights/zoom": {Rate: 0.5, Burst: 2}},
+		Auth:    rateLimit{Rate: 1, Burst: 3},
+	}
+	do := func(method, url, remoteAddr string, auth bool) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader("{}"))
+		req.RemoteAddr = remoteAddr
+		if auth {
+			req.SetBasicAuth("bypass", "123456")
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	// Not authenticated, by source IP.
+	for i := 0; i < 2; i++ {
+		if res := do(http.MethodPost, "/freightsrv/freights/zoom", "10.0.0.1:1234", false); res.Code == 429 {
+			t.Fatalf("request %d returned code 429, want burst of 2", i)
+		}
+	}
+	res := do(http.MethodPost, "/freightsrv/freights/zoom", "10.0.0.1:5678", false)
+	aErr := apiError{}
+	json.Unmarshal(res.Body.Bytes(), &aErr)
+	if res.Code != 429 || aErr.Code != ERR_RATE_LIMITED || res.Header().Get("Retry-After") != "2" {
+		t.Errorf("got code %d, Retry-After %q and %+v, want 429 and retry after 2s", res.Code, res.Header().Get("Retry-After"), aErr)
+	}
+	if res = do(http.MethodPost, "/freightsrv/freights/zoom", "10.0.0.2:1234", false); res.Code == 429 {
+		t.Errorf("other IP returned code 429")
+	}
+
+	// Authenticated, by user and route default.
+	if res = do(http.MethodGet, "/freightsrv/hello", "10.0.0.1:1234", true); res.Code != 200 {
+		t.Errorf("got code %d, want 200", res.Code)
+	}
+	if res = do(http.MethodGet, "/freightsrv/hello", "10.0.0.3:1234", true); res.Code != 429 || res.Header().Get("Retry-After") != "1" {
+		t.Errorf("got code %d, Retry-After %q, want 429 for same user from other IP", res.Code, res.Header().Get("Retry-After"))
+	}
+
+	// Bad passwords, by source IP before checking them.
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "/freightsrv/hello", nil)
+		req.RemoteAddr = "10.0.0.4:1234"
+		req.SetBasicAuth("zunkasite", "wrong-"+strconv.Itoa(i))
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		if i == 0 && res.Code != 401 {
+			t.Errorf("bad password, got code %d, want 401", res.Code)
+		}
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/freightsrv/hello", nil)
+	req.RemoteAddr = "10.0.0.4:1234"
+	req.SetBasicAuth("zunkasite", "wrong")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != 429 || res.Header().Get("Retry-After") != "1" {
+		t.Errorf("repeated bad passwords, got code %d, Retry-After %q, want 429", res.Code, res.Header().Get("Retry-After"))
+	}
+}
+
+/******************************************************************************
+* Users.
+*******************************************************************************/
+func TestUserAPI(t *testing.T) {
+	adminPass, err := bootstrapAdmin("test-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		sql3DB.MustExec("DELETE FROM api_credential WHERE user_id IN (SELECT id FROM api_user WHERE username IN ('test-admin', 'zunkasite'))")
+		sql3DB.MustExec("DELETE FROM api_user_role WHERE user_id IN (SELECT id FROM api_user WHERE username IN ('test-admin', 'zunkasite'))")
+		sql3DB.MustExec("DELETE FROM api_user WHERE username IN ('test-admin', 'zunkasite')")
+		clearAuthCache()
+	}()
+
+	// Bootstrap without credential not leaves the user.
+	sql3DB.MustExec("CREATE TRIGGER test_api_credential_fail BEFORE INSERT ON api_credential BEGIN SELECT RAISE(ABORT, 'credential failed'); END")
+	_, err = bootstrapAdmin("test-admin-2")
+	sql3DB.MustExec("DROP TRIGGER test_api_credential_fail")
+	if err == nil {
+		t.Errorf("Bootstrap with credential failing, want error")
+	}
+	if _, err = getUserByName("test-admin-2"); err == nil {
+		t.Errorf("Bootstrap with credential failing, want no user")
+	}
+	do := func(method, url, body, user, pass string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.SetBasicAuth(user, pass)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	// Create user and credential.
+	res := do(http.MethodPost, "/freightsrv/admin/user", `{"username": "zunkasite", "roles": ["quoter"]}`, "test-admin", adminPass)
+	if res.Code != 200 {
+		t.Fatalf("creating user, got code %d, body %s", res.Code, res.Body.String())
+	}
+	res = do(http.MethodPost, "/freightsrv/admin/user/zunkasite/credential", `{"description": "Site"}`, "test-admin", adminPass)
+	c := apiCredential{}
+	json.Unmarshal(res.Body.Bytes(), &c)
+	if res.Code != 200 || len(c.Password) < CREDENTIAL_PASSWORD_MIN_LENGTH || strings.Contains(res.Body.String(), "$2a$") {
+		t.Fatalf("creating credential, got code %d, body %s", res.Code, res.Body.String())
+	}
+
+	// Authenticate with created credential, only as quoter.
+	if res = do(http.MethodGet, "/freightsrv/hello", "", "zunkasite", c.Password); res.Code != 200 {
+		t.Errorf("got code %d, want 200 with created credential", res.Code)
+	}
+	if res = do(http.MethodGet, "/freightsrv/hello", "", "zunkasite", c.Password+"x"); res.Code != 401 {
+		t.Errorf("got code %d, want 401 with wrong password", res.Code)
+	}
+	for _, url := range []string{"/freightsrv/admin/users", "/freightsrv/region-freights"} {
+		res = do(http.MethodGet, url, "", "zunkasite", c.Password)
+		aErr := apiError{}
+		json.Unmarshal(res.Body.Bytes(), &aErr)
+		if res.Code != 403 || aErr.Code != ERR_FORBIDDEN {
+			t.Errorf("%s, got code %d and %+v, want 403 for quoter", url, res.Code, aErr)
+		}
+	}
+
+	// Rates viewer can't change rate tables, rates admin can.
+	if res = do(http.MethodPut, "/freightsrv/admin/user/zunkasite", `{"roles": ["quoter", "viewer"]}`, "test-admin", adminPass); res.Code != 422 {
+		t.Errorf("invalid role, got code %d, want 422", res.Code)
+	}
+	if res = do(http.MethodPut, "/freightsrv/admin/user/zunkasite", `{"roles": ["rates-viewer"]}`, "test-admin", adminPass); res.Code != 200 {
+		t.Fatalf("updating roles, got code %d, body %s", res.Code, res.Body.String())
+	}
+	if res = do(http.MethodGet, "/freightsrv/region-freights", "", "zunkasite", c.Password); res.Code != 200 {
+		t.Errorf("got code %d, want 200 for rates viewer", res.Code)
+	}
+	if res = do(http.MethodDelete, "/freightsrv/region-freight/0", "", "zunkasite", c.Password); res.Code != 403 {
+		t.Errorf("got code %d, want 403 deleting as rates viewer", res.Code)
+	}
+	if res = do(http.MethodGet, "/freightsrv/hello", "", "zunkasite", c.Password); res.Code != 403 {
+		t.Errorf("got code %d, want 403 quoting as rates viewer", res.Code)
+	}
+	do(http.MethodPut, "/freightsrv/admin/user/zunkasite", `{"roles": ["quoter", "rates-admin"]}`, "test-admin", adminPass)
+	if res = do(http.MethodGet, "/freightsrv/region-freights", "", "zunkasite", c.Password); res.Code != 200 {
+		t.Errorf("got code %d, want 200 for rates admin, rates viewer included", res.Code)
+	}
+	if res = do(http.MethodDelete, "/freightsrv/region-freight/0", "", "zunkasite", c.Password); res.Code == 403 {
+		t.Errorf("got code 403 deleting as rates admin")
+	}
+
+	// Password not listed, last used set.
+	res = do(http.MethodGet, "/freightsrv/admin/user/zunkasite", "", "test-admin", adminPass)
+	u := apiUser{}
+	json.Unmarshal(res.Body.Bytes(), &u)
+	if res.Code != 200 || len(u.Credentials) != 1 || u.Credentials[0].Password != "" || u.Credentials[0].LastUsedAt == nil {
+		t.Errorf("got code %d, body %s, want one used credential without password", res.Code, res.Body.String())
+	}
+
+	// Expired credential.
+	sql3DB.MustExec("UPDATE api_credential SET expires_at=? WHERE id=?", time.Now().Add(-time.Minute).UTC().Format(SQLITE_TIME_FORMAT), c.ID)
+	clearAuthCache()
+	if res = do(http.MethodGet, "/freightsrv/hello", "", "zunkasite", c.Password); res.Code != 401 {
+		t.Errorf("got code %d, want 401 with expired credential", res.Code)
+	}
+
+	// Rotated credential, revoked.
+	res = do(http.MethodPost, "/freightsrv/admin/user/zunkasite/credential", `{"password": "a-long-enough-password"}`, "test-admin", adminPass)
+	json.Unmarshal(res.Body.Bytes(), &c)
+	if res = do(http.MethodGet, "/freightsrv/hello", "", "zunkasite", "a-long-enough-password"); res.Code != 200 {
+		t.Errorf("got code %d, want 200 with rotated credential", res.Code)
+	}
+	if res = do(http.MethodDelete, "/freightsrv/admin/user/zunkasite/credential/"+strconv.Itoa(c.ID), "", "test-admin", adminPass); res.Code != 200 {
+		t.Errorf("deleting credential, got code %d, body %s", res.Code, res.Body.String())
+	}
+	if res = do(http.MethodGet, "/freightsrv/hello", "", "zunkasite", "a-long-enough-password"); res.Code != 401 {
+		t.Errorf("got code %d, want 401 with deleted credential", res.Code)
+	}
+
+	// Last ops admin kept.
+	if res = do(http.MethodPut, "/freightsrv/admin/user/test-admin", `{"roles": []}`, "test-admin", adminPass); res.Code != 409 {
+		t.Errorf("removing last admin, got code %d, want 409", res.Code)
+	}
+	if res = do(http.MethodDelete, "/freightsrv/admin/user/test-admin", "", "test-admin", adminPass); res.Code != 409 {
+		t.Errorf("deleting last admin, got code %d, want 409", res.Code)
+	}
+	if res = do(http.MethodDelete, "/freightsrv/admin/user/zunkasite", "", "test-admin", adminPass); res.Code != 200 {
+		t.Errorf("deleting user, got code %d, body %s", res.Code, res.Body.String())
+	}
+
+	// No password hashes audited.
+	var hashes int
+	sql3DB.Get(&hashes, "SELECT COUNT(*) FROM audit_log WHERE entity IN ('api_user', 'api_credential') AND (before_json LIKE '%$2a$%' OR after_json LIKE '%$2a$%')")
+	if hashes != 0 {
+		t.Errorf("got %d audit entries with password hash", hashes)
+	}
+}
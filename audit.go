@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// Audit actions.
+const (
+	AUDIT_CREATE = "create"
+	AUDIT_UPDATE = "update"
+	AUDIT_DELETE = "delete"
+)
+
+// Rate table change.
+type auditEntry struct {
+	ID        int            `db:"id" json:"id"`
+	Entity    string         `db:"entity" json:"entity"` // Table name.
+	EntityID  int            `db:"entity_id" json:"entityId"`
+	Action    string         `db:"action" json:"action"`
+	Before    types.JSONText `db:"before_json" json:"before"` // null for create.
+	After     types.JSONText `db:"after_json" json:"after"`   // null for delete.
+	User      string         `db:"username" json:"user"`
+	RequestID string         `db:"request_id" json:"requestId"`
+	CreatedAt time.Time      `db:"created_at" json:"createdAt"`
+}
+
+// Audit list, filter by entity, user and date range.
+var auditList = listTable{
+	name: "audit_log",
+	columns: map[string]string{
+		"id":        "id",
+		"entity":    "entity",
+		"entityId":  "entity_id",
+		"action":    "action",
+		"user":      "username",
+		"createdAt": "created_at",
+	},
+	filters: []listFilter{
+		{param: "entity", column: "entity", kind: FILTER_IN},
+		{param: "entityId", column: "entity_id", kind: FILTER_IN},
+		{param: "action", column: "action", kind: FILTER_IN},
+		{param: "user", column: "username", kind: FILTER_IN},
+		{param: "from", column: "created_at", kind: FILTER_FROM},
+		{param: "to", column: "created_at", kind: FILTER_TO},
+	},
+	defaultSort: "id DESC",
+}
+
+// Find audit entries, newest first by default.
+func findAudit(opt listOptions) (entries []auditEntry, total int, err error) {
+	entries = []auditEntry{}
+	total, err = listRows(&entries, auditList, opt)
+	return entries, total, err
+}
+
+// Row as json, null if not exist.
+func snapshotRow(q sqlx.Queryer, table string, id int) (types.JSONText, error) {
+	row := map[string]interface{}{}
+	err := q.QueryRowx("SELECT * FROM "+table+" WHERE id=?", id).MapScan(row)
+	if err == sql.ErrNoRows {
+		return types.JSONText("null"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range row {
+		row[k] = dbValue(v)
+	}
+	b, err := json.Marshal(row)
+	return types.JSONText(b), err
+}
+
+// Save audit entry.
+func saveAudit(e sqlx.Execer, entry *auditEntry) error {
+	if len(entry.Before) == 0 {
+		entry.Before = types.JSONText("null")
+	}
+	if len(entry.After) == 0 {
+		entry.After = types.JSONText("null")
+	}
+	stm := "INSERT INTO audit_log(entity, entity_id, action, before_json, after_json, username, request_id) VALUES(?, ?, ?, ?, ?, ?, ?)"
+	_, err := e.Exec(stm, entry.Entity, entry.EntityID, entry.Action, string(entry.Before), string(entry.After), entry.User, entry.RequestID)
+	return err
+}
+
+// Audit entry for the authenticated user of request.
+func newAuditEntry(req *http.Request, entity string, id int, action string) *auditEntry {
+	return &auditEntry{
+		Entity:    entity,
+		EntityID:  id,
+		Action:    action,
+		User:      authUser(req),
+		RequestID: requestID(req),
+	}
+}
+
+// Audit change in its transaction, by has the entity, user and request id, nil for changes not made by requests.
+func auditTx(tx *sqlx.Tx, by *auditEntry, id int, action string, before types.JSONText) (err error) {
+	if by == nil {
+		return nil
+	}
+	entry := *by
+	entry.EntityID = id
+	entry.Action = action
+	entry.Before = before
+	if action != AUDIT_DELETE {
+		entry.After, err = snapshotRow(tx, entry.Entity, id)
+		if err != nil {
+			return err
+		}
+	}
+	return saveAudit(tx, &entry)
+}
+
+// Change made in a transaction and audited in it, not done if it can't be audited.
+// Change returns the row id, the new one on create.
+func auditedChange(by *auditEntry, id int, action string, change func(tx *sqlx.Tx) (int, error)) error {
+	tx, err := sql3DB.Beginx()
+	if err != nil {
+		return newInternalError(err)
+	}
+	defer tx.Rollback()
+	var before types.JSONText
+	if by != nil && action != AUDIT_CREATE {
+		if before, err = snapshotRow(tx, by.Entity, id); err != nil {
+			return newInternalError(err)
+		}
+	}
+	if id, err = change(tx); err != nil {
+		return err
+	}
+	if err = auditTx(tx, by, id, action, before); err != nil {
+		return newInternalError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return newInternalError(err)
+	}
+	return nil
+}
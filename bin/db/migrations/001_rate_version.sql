@@ -0,0 +1,56 @@
+-- Rate tables rows by version, existing rows go to the initial versions created by tables.sql.
+-- Sqlite can't change unique constraints, so tables are rebuilt, triggers are recreated by tables.sql.
+BEGIN TRANSACTION;
+
+CREATE TABLE freight_region_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    version_id INTEGER NOT NULL DEFAULT 1 REFERENCES rate_version(id),
+    region VARCHAR(64) CHECK(region IN ('north', 'northeast', 'midwest', 'southeast', 'south')) NOT NULL,
+    weight INTEGER CHECK(weight >= 100) NOT NULL,    -- g
+    deadline INTEGER CHECK(deadline > 0) NOT NULL,  -- days
+    price INTEGER CHECK(price>0) NOT NULL,     -- R$ X 100
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (version_id, region, weight, deadline)
+);
+INSERT INTO freight_region_new(id, region, weight, deadline, price, created_at, updated_at)
+    SELECT id, region, weight, deadline, price, created_at, updated_at FROM freight_region;
+DROP TABLE freight_region;
+ALTER TABLE freight_region_new RENAME TO freight_region;
+
+CREATE TABLE motoboy_freight_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    version_id INTEGER NOT NULL DEFAULT 3 REFERENCES rate_version(id),
+    state VARCHAR(64) CHECK(state IN ('mg')) NOT NULL DEFAULT 'mg',
+    city VARCHAR(64)  NOT NULL,
+    city_norm VARCHAR(64)  NOT NULL, -- Normalized city name.
+    deadline INTEGER CHECK(deadline > 0) NOT NULL,  -- days
+    price INTEGER CHECK(price > 0) NOT NULL,     -- R$ X 100
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (version_id, state, city_norm)
+);
+INSERT INTO motoboy_freight_new(id, state, city, city_norm, deadline, price, created_at, updated_at)
+    SELECT id, state, city, city_norm, deadline, price, created_at, updated_at FROM motoboy_freight;
+DROP TABLE motoboy_freight;
+ALTER TABLE motoboy_freight_new RENAME TO motoboy_freight;
+
+CREATE TABLE dealer_freight_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    version_id INTEGER NOT NULL DEFAULT 2 REFERENCES rate_version(id),
+    dealer VARCHAR(64) NOT NULL,
+    weight INTEGER CHECK(weight >= 100) NOT NULL,    -- g
+    deadline INTEGER CHECK(deadline > 0) NOT NULL,  -- days
+    price INTEGER CHECK(price>=0) NOT NULL,     -- R$ X 100
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (version_id, dealer, weight, deadline)
+);
+INSERT INTO dealer_freight_new(id, dealer, weight, deadline, price, created_at, updated_at)
+    SELECT id, dealer, weight, deadline, price, created_at, updated_at FROM dealer_freight;
+DROP TABLE dealer_freight;
+ALTER TABLE dealer_freight_new RENAME TO dealer_freight;
+
+INSERT INTO schema_migration(name) VALUES ('001_rate_version');
+
+COMMIT;
@@ -0,0 +1,42 @@
+-- User admin flag replaced by roles, admins become ops-admin.
+-- Sqlite can't drop columns on older versions, so api_user is rebuilt, triggers are recreated by tables.sql.
+-- Foreign keys off while api_user is dropped, pragma has no effect inside a transaction.
+PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+
+-- Db created before users.
+CREATE TABLE IF NOT EXISTS api_user (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username VARCHAR(64) NOT NULL UNIQUE,
+    admin BOOLEAN NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE api_user_role (
+    user_id INTEGER NOT NULL REFERENCES api_user(id),
+    role VARCHAR(64) CHECK(role IN ('quoter', 'rates-viewer', 'rates-admin', 'ops-admin')) NOT NULL,
+    PRIMARY KEY (user_id, role)
+);
+INSERT INTO api_user_role(user_id, role) SELECT id, 'ops-admin' FROM api_user WHERE admin=1;
+
+CREATE TABLE api_user_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO api_user_new(id, username, created_at, updated_at)
+    SELECT id, username, created_at, updated_at FROM api_user;
+DROP TABLE api_user;
+ALTER TABLE api_user_new RENAME TO api_user;
+
+INSERT INTO schema_migration(name) VALUES ('002_user_role');
+
+-- Broken references listed and abort, update_db.sh runs with -bail.
+PRAGMA foreign_key_check;
+CREATE TEMP TABLE foreign_key_violation (n INTEGER CHECK(n = 0));
+INSERT INTO foreign_key_violation SELECT COUNT(*) FROM pragma_foreign_key_check;
+
+COMMIT;
+PRAGMA foreign_keys=ON;
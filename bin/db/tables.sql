@@ -3,9 +3,43 @@
 -- not working, reset to off when back to db
 pragma foreign_keys = on;
 
+-- Schema migrations applied by update_db.sh.
+CREATE TABLE IF NOT EXISTS schema_migration (
+    name VARCHAR(64) PRIMARY KEY,
+    applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+-- Already in this schema.
+INSERT OR IGNORE INTO schema_migration(name) VALUES ('001_rate_version');
+INSERT OR IGNORE INTO schema_migration(name) VALUES ('002_user_role');
+
+-- Rate table versions, the version with the latest effective_from not in the future is used.
+CREATE TABLE IF NOT EXISTS rate_version (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    entity VARCHAR(64) CHECK(entity IN ('freight_region', 'dealer_freight', 'motoboy_freight')) NOT NULL,
+    status VARCHAR(16) CHECK(status IN ('draft', 'scheduled', 'active', 'archived')) NOT NULL DEFAULT 'draft',
+    effective_from TIMESTAMP,   -- UTC, null for draft.
+    note VARCHAR(256) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS rate_version_entity ON rate_version(entity, effective_from);
+
+CREATE TRIGGER IF NOT EXISTS rate_version_trigger_updated_at
+AFTER UPDATE ON rate_version
+BEGIN
+   UPDATE rate_version SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+
+-- Initial versions, default version of rate tables rows.
+INSERT OR IGNORE INTO rate_version(id, entity, status, effective_from, note) VALUES (1, 'freight_region', 'active', '2000-01-01 00:00:00', 'Initial');
+INSERT OR IGNORE INTO rate_version(id, entity, status, effective_from, note) VALUES (2, 'dealer_freight', 'active', '2000-01-01 00:00:00', 'Initial');
+INSERT OR IGNORE INTO rate_version(id, entity, status, effective_from, note) VALUES (3, 'motoboy_freight', 'active', '2000-01-01 00:00:00', 'Initial');
+
 -- Freight by region.
 CREATE TABLE IF NOT EXISTS freight_region  (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
+    version_id INTEGER NOT NULL DEFAULT 1 REFERENCES rate_version(id),
     region VARCHAR(64) CHECK(region IN ('north', 'northeast', 'midwest', 'southeast', 'south')) NOT NULL,
     weight INTEGER CHECK(weight >= 100) NOT NULL,    -- g
     deadline INTEGER CHECK(deadline > 0) NOT NULL,  -- days
@@ -14,7 +48,7 @@ CREATE TABLE IF NOT EXISTS freight_region  (
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     --  updated_at timestamp NOT NULL DEFAULT (DATETIME('now', 'localtime')),
     --  created_at timestamp NOT NULL DEFAULT (DATETIME('now', 'localtime')),
-    UNIQUE (region, weight, deadline)
+    UNIQUE (version_id, region, weight, deadline)
 ); 
 
 CREATE TRIGGER IF NOT EXISTS freight_region_trigger_updated_at
@@ -28,6 +62,7 @@ END;
 -- Motoboy freight.
 CREATE TABLE IF NOT EXISTS motoboy_freight  (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
+    version_id INTEGER NOT NULL DEFAULT 3 REFERENCES rate_version(id),
     state VARCHAR(64) CHECK(state IN ('mg')) NOT NULL DEFAULT 'mg',
     city VARCHAR(64)  NOT NULL,
     city_norm VARCHAR(64)  NOT NULL, -- Normalized city name.
@@ -35,7 +70,7 @@ CREATE TABLE IF NOT EXISTS motoboy_freight  (
     price INTEGER CHECK(price > 0) NOT NULL,     -- R$ X 100
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    UNIQUE (state, city_norm)
+    UNIQUE (version_id, state, city_norm)
 ); 
 
 CREATE TRIGGER IF NOT EXISTS motoboy_freight_trigger_updated_at
@@ -47,13 +82,14 @@ END;
 -- Dealer freight.
 CREATE TABLE IF NOT EXISTS dealer_freight (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
+    version_id INTEGER NOT NULL DEFAULT 2 REFERENCES rate_version(id),
     dealer VARCHAR(64) NOT NULL,
     weight INTEGER CHECK(weight >= 100) NOT NULL,    -- g
     deadline INTEGER CHECK(deadline > 0) NOT NULL,  -- days
     price INTEGER CHECK(price>=0) NOT NULL,     -- R$ X 100
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    UNIQUE (dealer, weight, deadline)
+    UNIQUE (version_id, dealer, weight, deadline)
 ); 
 
 CREATE TRIGGER IF NOT EXISTS dealer_freight_trigger_updated_at
@@ -61,3 +97,98 @@ AFTER UPDATE ON dealer_freight
 BEGIN
    UPDATE dealer_freight SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
 END;
+
+-- Audit of rate table changes, append only.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    entity VARCHAR(64) NOT NULL,  -- Table name.
+    entity_id INTEGER NOT NULL,
+    action VARCHAR(16) CHECK(action IN ('create', 'update', 'delete')) NOT NULL,
+    before_json TEXT NOT NULL DEFAULT 'null',   -- Row before change.
+    after_json TEXT NOT NULL DEFAULT 'null',    -- Row after change.
+    username VARCHAR(64) NOT NULL,
+    request_id VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_entity ON audit_log(entity, entity_id);
+CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log(created_at);
+
+CREATE TRIGGER IF NOT EXISTS audit_log_trigger_no_update
+BEFORE UPDATE ON audit_log
+BEGIN
+   SELECT RAISE(ABORT, 'audit_log is append only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_log_trigger_no_delete
+BEFORE DELETE ON audit_log
+BEGIN
+   SELECT RAISE(ABORT, 'audit_log is append only');
+END;
+
+-- Freight quotes, purged after retention period.
+CREATE TABLE IF NOT EXISTS quote (
+    id VARCHAR(32) PRIMARY KEY,
+    client VARCHAR(16) NOT NULL,  -- zunka or zoom.
+    username VARCHAR(64) NOT NULL DEFAULT '',
+    request_id VARCHAR(64) NOT NULL DEFAULT '',
+    cep_destiny VARCHAR(8) NOT NULL DEFAULT '',
+    request_json TEXT NOT NULL DEFAULT 'null',  -- Request body.
+    packs_json TEXT NOT NULL DEFAULT '[]',      -- Packs sent to providers.
+    providers_json TEXT NOT NULL DEFAULT '[]',  -- Result of each provider.
+    freights_json TEXT NOT NULL DEFAULT '[]',   -- Freights returned.
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS quote_created_at ON quote(created_at);
+
+-- Quote statistics by hour.
+CREATE TABLE IF NOT EXISTS quote_stat (
+    hour TIMESTAMP NOT NULL,                -- UTC hour start.
+    client VARCHAR(16) NOT NULL,            -- zunka or zoom.
+    region VARCHAR(16) NOT NULL DEFAULT '', -- Destiny region, empty if unknown.
+    event VARCHAR(16) CHECK(event IN ('quote', 'offer', 'confirm')) NOT NULL,
+    carrier VARCHAR(64) NOT NULL DEFAULT '',
+    service_code VARCHAR(16) NOT NULL DEFAULT '',
+    fallback VARCHAR(32) NOT NULL DEFAULT '',   -- Why Correios was not used, empty if it was.
+    price_band VARCHAR(16) NOT NULL DEFAULT '', -- Like 25-50, empty for quote event.
+    count INTEGER NOT NULL DEFAULT 0,
+    price_sum REAL NOT NULL DEFAULT 0,
+    price_min REAL NOT NULL DEFAULT 0,
+    price_max REAL NOT NULL DEFAULT 0,
+    PRIMARY KEY (hour, client, region, event, carrier, service_code, fallback, price_band)
+);
+
+-- Api users, route access by roles.
+CREATE TABLE IF NOT EXISTS api_user (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER IF NOT EXISTS api_user_trigger_updated_at
+AFTER UPDATE ON api_user
+BEGIN
+   UPDATE api_user SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+
+-- User credentials, more than one active to rotate them.
+CREATE TABLE IF NOT EXISTS api_credential (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES api_user(id),
+    password_hash VARCHAR(128) NOT NULL,    -- bcrypt.
+    description VARCHAR(256) NOT NULL DEFAULT '',
+    expires_at TIMESTAMP,                   -- UTC, null for no expiration.
+    last_used_at TIMESTAMP,                 -- UTC, null if never used.
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS api_credential_user_id ON api_credential(user_id);
+
+-- User roles, routes declare the role required.
+CREATE TABLE IF NOT EXISTS api_user_role (
+    user_id INTEGER NOT NULL REFERENCES api_user(id),
+    role VARCHAR(64) CHECK(role IN ('quoter', 'rates-viewer', 'rates-admin', 'ops-admin')) NOT NULL,
+    PRIMARY KEY (user_id, role)
+);
@@ -14,8 +14,17 @@ fi
 
 DB=$ZUNKAPATH/db/$ZUNKA_FREIGHT_DB
 
-# Create db if not exist.
+# Update db if exist.
 if [[ -f $DB ]]; then
 	echo Updateing $DB
+	# Migrations not applied yet, before tables.sql that marks them as applied.
+	sqlite3 $DB "CREATE TABLE IF NOT EXISTS schema_migration (name VARCHAR(64) PRIMARY KEY, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP);"
+	for MIGRATION in $(dirname $0)/migrations/*.sql; do
+		NAME=$(basename $MIGRATION .sql)
+		if [[ -z $(sqlite3 $DB "SELECT name FROM schema_migration WHERE name='$NAME';") ]]; then
+			echo Applying $NAME
+			sqlite3 -bail $DB < $MIGRATION || exit 1
+		fi
+	done
     sqlite3 $DB < $(dirname $0)/tables.sql
 fi
\ No newline at end of file
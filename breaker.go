@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	BREAKER_CLOSED    = "closed"    // Calling upstream.
+	BREAKER_OPEN      = "open"      // Not calling upstream, failing fast.
+	BREAKER_HALF_OPEN = "half-open" // One trial call, closed if it succeeds.
+)
+
+// Breaker state metric values, by state.
+var breakerStateValues = map[string]float64{BREAKER_CLOSED: 0, BREAKER_HALF_OPEN: 1, BREAKER_OPEN: 2}
+
+// Call not made, upstream failing.
+var errCircuitOpen = errors.New("circuit open, upstream failing")
+
+// Circuit breaker of an upstream service, thresholds from upstream config.
+type circuitBreaker struct {
+	service  string
+	mu       sync.Mutex
+	state    string
+	failures int // Consecutive.
+	openedAt time.Time
+	trial    bool // Half-open call in flight.
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*circuitBreaker{}
+)
+
+// Breaker by upstream service.
+func upstreamBreaker(service string) *circuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[service]
+	if !ok {
+		b = &circuitBreaker{service: service, state: BREAKER_CLOSED}
+		breakers[service] = b
+		upstreamBreakerState.set(breakerStateValues[b.state], service)
+	}
+	return b
+}
+
+// If call can be made, half-open after open time.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BREAKER_OPEN:
+		if time.Since(b.openedAt) < cfg.Upstreams.get(b.service).BreakerOpenTime {
+			upstreamRejected.inc(b.service)
+			return false
+		}
+		b.setState(BREAKER_HALF_OPEN)
+		b.trial = true
+		return true
+	case BREAKER_HALF_OPEN:
+		if b.trial {
+			upstreamRejected.inc(b.service)
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// Record call result, open after consecutive failures or a half-open failure.
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if success {
+		b.failures = 0
+		b.setState(BREAKER_CLOSED)
+		return
+	}
+	b.failures++
+	threshold := cfg.Upstreams.get(b.service).BreakerFailures
+	if b.state == BREAKER_HALF_OPEN || (threshold > 0 && b.failures >= threshold) {
+		b.openedAt = time.Now()
+		b.setState(BREAKER_OPEN)
+	}
+}
+
+// Call abandoned by caller, not an upstream result.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Must be called locked.
+func (b *circuitBreaker) setState(state string) {
+	if state == b.state {
+		return
+	}
+	logWarning(context.Background(), "Circuit breaker of %s changed from %s to %s", b.service, b.state, state)
+	b.state = state
+	upstreamBreakerState.set(breakerStateValues[state], b.service)
+}
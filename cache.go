@@ -0,0 +1,325 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// Cache backends.
+const (
+	CACHE_REDIS  = "redis"
+	CACHE_MEMORY = "memory"
+)
+
+// Keys by scan batch.
+const CACHE_SCAN_COUNT = 500
+
+// Key not in cache or expired.
+var errCacheMiss = errors.New("cache miss")
+
+// Cache used by all key families.
+var cache Cache = newMemoryCache(defaultConfig().Cache.MemoryMaxEntries)
+
+// Key value cache with expiration.
+type Cache interface {
+	Get(key string) (string, error)                      // errCacheMiss if no key.
+	Set(key string, val string, exp time.Duration) error // No expiration if exp not positive.
+	Del(keys ...string) error
+	Scan(match string, fn func(keys []string) error) error // Keys matching glob pattern, by batch, without blocking.
+	Size(key string) (int64, error)                        // Memory used in bytes.
+	Ping(ctx context.Context) error
+	Backend() string
+	TakeToken(key string, rate float64, burst int) (wait time.Duration, err error) // Token bucket, wait is zero if token taken.
+}
+
+// Use configured backend, memory if redis not reachable.
+func initCache() {
+	if cfg.Cache.Backend == CACHE_MEMORY {
+		cache = newMemoryCache(cfg.Cache.MemoryMaxEntries)
+		return
+	}
+	rc := newRedisCache(cfg.Redis)
+	if err := rc.Ping(context.Background()); err != nil {
+		logWarning(context.Background(), "Couldn't connect to Redis DB, using memory cache. %s", err)
+		rc.Close()
+		cache = newMemoryCache(cfg.Cache.MemoryMaxEntries)
+		return
+	}
+	cache = rc
+}
+
+func closeCache() {
+	if rc, ok := cache.(*redisCache); ok {
+		rc.Close()
+	}
+}
+
+/**************************************************************************************************
+* REDIS
+**************************************************************************************************/
+type redisCache struct {
+	client *redis.Client
+}
+
+func newRedisCache(c redisConfig) *redisCache {
+	return &redisCache{client: redis.NewClient(&redis.Options{
+		Addr:     c.Addr,
+		Password: c.Password,
+		DB:       c.DB,
+	})}
+}
+
+func (rc *redisCache) Get(key string) (string, error) {
+	val, err := rc.client.Get(key).Result()
+	if err == redis.Nil {
+		return "", errCacheMiss
+	}
+	return val, err
+}
+
+func (rc *redisCache) Set(key string, val string, exp time.Duration) error {
+	if exp < 0 {
+		exp = 0
+	}
+	return rc.client.Set(key, val, exp).Err()
+}
+
+func (rc *redisCache) Del(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return rc.client.Del(keys...).Err()
+}
+
+// Scan, not keys, to not block redis.
+func (rc *redisCache) Scan(match string, fn func(keys []string) error) error {
+	cursor := uint64(0)
+	for {
+		keys, next, err := rc.client.Scan(cursor, match, CACHE_SCAN_COUNT).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err = fn(keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (rc *redisCache) Size(key string) (int64, error) {
+	size, err := rc.client.MemoryUsage(key).Result()
+	if err == redis.Nil {
+		return 0, errCacheMiss
+	}
+	return size, err
+}
+
+func (rc *redisCache) Ping(ctx context.Context) error {
+	return rc.client.WithContext(ctx).Ping().Err()
+}
+
+func (rc *redisCache) Backend() string {
+	return CACHE_REDIS
+}
+
+// Token bucket as hash, atomic for all instances.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+return wait
+`)
+
+func (rc *redisCache) TakeToken(key string, rate float64, burst int) (time.Duration, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	wait, err := takeTokenScript.Run(rc.client, []string{key}, rate, burst, now, bucketTTL(rate, burst).Milliseconds()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+func (rc *redisCache) Close() error {
+	return rc.client.Close()
+}
+
+/**************************************************************************************************
+* MEMORY
+**************************************************************************************************/
+// In process LRU cache, least recently used keys are evicted above max entries.
+type memoryCache struct {
+	maxEntries int
+	mu         sync.Mutex
+	ll         *list.List // Most recently used first.
+	items      map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key       string
+	val       string
+	expiresAt time.Time // Zero for no expiration.
+}
+
+func newMemoryCache(maxEntries int) *memoryCache {
+	return &memoryCache{maxEntries: maxEntries, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+func (mc *memoryCache) Get(key string) (string, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	el, ok := mc.items[key]
+	if !ok {
+		return "", errCacheMiss
+	}
+	entry := el.Value.(*memoryEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		mc.remove(el)
+		return "", errCacheMiss
+	}
+	mc.ll.MoveToFront(el)
+	return entry.val, nil
+}
+
+func (mc *memoryCache) Set(key string, val string, exp time.Duration) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.set(key, val, exp)
+	return nil
+}
+
+// Must be called locked.
+func (mc *memoryCache) set(key string, val string, exp time.Duration) {
+	entry := &memoryEntry{key: key, val: val}
+	if exp > 0 {
+		entry.expiresAt = time.Now().Add(exp)
+	}
+	if el, ok := mc.items[key]; ok {
+		el.Value = entry
+		mc.ll.MoveToFront(el)
+		return
+	}
+	mc.items[key] = mc.ll.PushFront(entry)
+	for mc.maxEntries > 0 && mc.ll.Len() > mc.maxEntries {
+		mc.remove(mc.ll.Back())
+	}
+}
+
+func (mc *memoryCache) Del(keys ...string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, key := range keys {
+		if el, ok := mc.items[key]; ok {
+			mc.remove(el)
+		}
+	}
+	return nil
+}
+
+// Keys matched while locked, fn called after, so it can change the cache.
+func (mc *memoryCache) Scan(match string, fn func(keys []string) error) error {
+	keys := []string{}
+	mc.mu.Lock()
+	now := time.Now()
+	for key, el := range mc.items {
+		expiresAt := el.Value.(*memoryEntry).expiresAt
+		if ok, _ := path.Match(match, key); ok && (expiresAt.IsZero() || now.Before(expiresAt)) {
+			keys = append(keys, key)
+		}
+	}
+	mc.mu.Unlock()
+	for i := 0; i < len(keys); i += CACHE_SCAN_COUNT {
+		end := i + CACHE_SCAN_COUNT
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := fn(keys[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Key and value length.
+func (mc *memoryCache) Size(key string) (int64, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	el, ok := mc.items[key]
+	if !ok {
+		return 0, errCacheMiss
+	}
+	return int64(len(key) + len(el.Value.(*memoryEntry).val)), nil
+}
+
+func (mc *memoryCache) remove(el *list.Element) {
+	mc.ll.Remove(el)
+	delete(mc.items, el.Value.(*memoryEntry).key)
+}
+
+func (mc *memoryCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (mc *memoryCache) Backend() string {
+	return CACHE_MEMORY
+}
+
+// Token bucket kept as "tokens unix-ms" value.
+func (mc *memoryCache) TakeToken(key string, rate float64, burst int) (time.Duration, error) {
+	now := time.Now()
+	tokens, ts := float64(burst), now
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if el, ok := mc.items[key]; ok {
+		entry := el.Value.(*memoryEntry)
+		var ms int64
+		if now.Before(entry.expiresAt) {
+			if _, err := fmt.Sscanf(entry.val, "%g %d", &tokens, &ms); err == nil {
+				ts = time.Unix(0, ms*int64(time.Millisecond))
+			}
+		}
+	}
+	if elapsed := now.Sub(ts).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(burst), tokens+elapsed*rate)
+	}
+	wait := time.Duration(0)
+	if tokens >= 1 {
+		tokens--
+	} else {
+		wait = time.Duration(math.Ceil((1-tokens)/rate*1000)) * time.Millisecond
+	}
+	mc.set(key, fmt.Sprintf("%g %d", tokens, now.UnixNano()/int64(time.Millisecond)), bucketTTL(rate, burst))
+	return wait, nil
+}
+
+/**************************************************************************************************
+* TOKEN BUCKET
+**************************************************************************************************/
+// Time to refill the bucket, after it a missing bucket is the same as a full one.
+func bucketTTL(rate float64, burst int) time.Duration {
+	return time.Duration(float64(burst)/rate*float64(time.Second)) + time.Second
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Cache key family.
+type cacheFamily struct {
+	name   string
+	prefix string
+	cepKey string // Key after prefix by destination CEP prefix, %s for CEP prefix, empty if not by CEP.
+}
+
+var cacheFamilies = []cacheFamily{
+	{CACHE_CORREIOS, CACHE_KEY_CORREIOS, "????????-%s*"},
+	{CACHE_CEP_REGION, CACHE_KEY_CEP_REGION, "%s*"},
+	{CACHE_VIA_CEP_ADDRESS, CACHE_KEY_VIA_CEP_ADDRESS, "%s*"},
+	{CACHE_IBGE_CITIES, CACHE_KEY_IBGE_CITIES, ""},
+	{CACHE_QUOTE_RESERVATION, CACHE_KEY_QUOTE_RESERVATION, ""},
+	{CACHE_RATE_LIMIT, CACHE_KEY_RATE_LIMIT, ""},
+}
+
+// Family keys count and memory use.
+type cacheFamilyStat struct {
+	Family string `json:"family"`
+	Keys   int    `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// Cache backend and families.
+type cacheStats struct {
+	Backend  string            `json:"backend"`
+	Families []cacheFamilyStat `json:"families"`
+}
+
+// Cached Correios freights of a pack.
+type correiosCacheLookup struct {
+	Key        string     `json:"key"`
+	Pack       pack       `json:"pack"` // Changed to Correios limits and bucket.
+	Freights   []*freight `json:"freights"`
+	FreshUntil time.Time  `json:"freshUntil"`
+	Stale      bool       `json:"stale"`
+}
+
+func findCacheFamily(name string) (cacheFamily, error) {
+	for _, f := range cacheFamilies {
+		if f.name == name {
+			return f, nil
+		}
+	}
+	names := []string{}
+	for _, f := range cacheFamilies {
+		names = append(names, f.name)
+	}
+	return cacheFamily{}, newBadRequestError(ERR_INVALID_QUERY, "Invalid family: %s, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// Keys count and memory use by family.
+func getCacheStats() (stats cacheStats, err error) {
+	stats = cacheStats{Backend: cache.Backend(), Families: []cacheFamilyStat{}}
+	for _, f := range cacheFamilies {
+		stat := cacheFamilyStat{Family: f.name}
+		err = cache.Scan(f.prefix+"*", func(keys []string) error {
+			for _, key := range keys {
+				size, err := cache.Size(key)
+				// Expired after scan.
+				if err == errCacheMiss {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				stat.Keys++
+				stat.Bytes += size
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, newInternalError(err)
+		}
+		stats.Families = append(stats.Families, stat)
+	}
+	return stats, nil
+}
+
+// Cached Correios freights of pack.
+func lookupCorreiosCache(p pack) (lookup correiosCacheLookup, err error) {
+	if err = p.ValidateCorreios(); err != nil {
+		return lookup, err
+	}
+	p = p.correiosBucket()
+	entry, ok := getCorreiosCacheEntry(&p)
+	if !ok {
+		return lookup, newNotFoundError(ERR_NOT_FOUND, "No Correios freights cached for pack")
+	}
+	return correiosCacheLookup{
+		Key:        makeCorreiosKey(&p),
+		Pack:       p,
+		Freights:   entry.Freights,
+		FreshUntil: entry.FreshUntil,
+		Stale:      time.Now().After(entry.FreshUntil),
+	}, nil
+}
+
+// Purge family, keys of destination CEP prefix or both, family or CEP prefix required.
+func purgeCache(family string, cepPrefix string) (deleted int, err error) {
+	cepPrefix = strings.ReplaceAll(cepPrefix, "-", "")
+	if family == "" && cepPrefix == "" {
+		return 0, newBadRequestError(ERR_INVALID_QUERY, "family or cep required")
+	}
+	if cepPrefix != "" && !regexp.MustCompile(`^[0-9]{1,8}$`).MatchString(cepPrefix) {
+		return 0, newBadRequestError(ERR_INVALID_QUERY, "Invalid cep: %s, must be a CEP or CEP prefix", cepPrefix)
+	}
+	families := cacheFamilies
+	if family != "" {
+		f, err := findCacheFamily(family)
+		if err != nil {
+			return 0, err
+		}
+		if cepPrefix != "" && f.cepKey == "" {
+			return 0, newBadRequestError(ERR_INVALID_QUERY, "Family %s keys are not by CEP", family)
+		}
+		families = []cacheFamily{f}
+	}
+	for _, f := range families {
+		match := f.prefix + "*"
+		if cepPrefix != "" {
+			if f.cepKey == "" {
+				continue
+			}
+			match = f.prefix + fmt.Sprintf(f.cepKey, cepPrefix)
+		}
+		// Scan batches deleted by call.
+		err = cache.Scan(match, func(keys []string) error {
+			if err := cache.Del(keys...); err != nil {
+				return err
+			}
+			deleted += len(keys)
+			return nil
+		})
+		if err != nil {
+			return deleted, newInternalError(err)
+		}
+	}
+	return deleted, nil
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"regexp"
 	"strings"
 	"time"
 	// "github.com/go-redis/redis/v7"
@@ -20,8 +19,11 @@ type viaCEPAddress struct {
 	State    string `json:"uf"`
 }
 
+// ViaCEP calls in flight, by CEP.
+var viaCEPFlight = newFlightGroup(CACHE_VIA_CEP_ADDRESS)
+
 // Get address by CEP.
-func getAddressByCEP(cep string) (address viaCEPAddress, err error) {
+func getAddressByCEP(ctx context.Context, cep string) (address viaCEPAddress, err error) {
 	// Try cache.
 	pAddressJson, ok := getViaCEPAddressCache(&cep)
 	// log.Printf("ok: %v, pAddressJson: %v", ok, *pAddressJson)
@@ -35,30 +37,51 @@ func getAddressByCEP(cep string) (address viaCEPAddress, err error) {
 	cep = strings.ReplaceAll(cep, "-", "")
 
 	// Check if CEP is valid "00000000".
-	cepRE := regexp.MustCompile(`^\d{8}$`)
-	if !cepRE.MatchString(cep) {
-		return address, fmt.Errorf("CEP \"%s\" inválid", cep)
+	if err = validateCEP("cep", cep); err != nil {
+		return address, err
 	}
 
-	// Get address from.
+	// Concurrent lookups for the same CEP share one call, not canceled with the request.
+	val, err, _ := viaCEPFlight.DoContext(ctx, cep, func() (interface{}, error) {
+		fetchCtx, cancel := detachedUpstreamContext(ctx, UPSTREAM_VIACEP)
+		defer cancel()
+		return fetchViaCEPAddress(fetchCtx, cep)
+	})
+	address, _ = val.(viaCEPAddress)
+	return address, err
+}
+
+// Get address from ViaCEP and cache it.
+func fetchViaCEPAddress(ctx context.Context, cep string) (address viaCEPAddress, err error) {
 	start := time.Now()
-	res, err := http.Get(`https://viacep.com.br/ws/` + cep + `/json/`)
-	if checkError(err) {
-		return address, err
+	res, err := getUpstream(ctx, UPSTREAM_VIACEP, `https://viacep.com.br/ws/`+cep+`/json/`)
+	if checkError(ctx, err) {
+		return address, newUpstreamError("ViaCEP", err)
 	}
-	log.Printf("[debug] Viacep response time: %.1fs", time.Since(start).Seconds())
+	logDebug(ctx, "ViaCEP response time: %.1fs", time.Since(start).Seconds())
 
 	// Read response.
 	resBody, err := ioutil.ReadAll(res.Body)
 	defer res.Body.Close()
-	if checkError(err) {
-		return address, err
+	if checkError(ctx, err) {
+		return address, newUpstreamError("ViaCEP", err)
 	}
 	// log.Printf("address: %s", resBody)
+	if res.StatusCode != http.StatusOK {
+		return address, newUpstreamError("ViaCEP", fmt.Errorf("status: %v, body: %s", res.StatusCode, resBody))
+	}
+
+	// ViaCEP answer {"erro": true} for unknown CEP.
+	notFound := struct {
+		Erro bool `json:"erro"`
+	}{}
+	if err = json.Unmarshal(resBody, &notFound); err == nil && notFound.Erro {
+		return address, newNotFoundError(ERR_CEP_NOT_FOUND, "CEP \"%s\" not found", cep)
+	}
 
 	err = json.Unmarshal(resBody, &address)
 	if err != nil {
-		return address, err
+		return address, newUpstreamError("ViaCEP", err)
 	}
 	// log.Printf("address: %+v", address)
 	resBodyString := string(resBody)
@@ -88,14 +111,14 @@ func getRegionByState(state string) string {
 }
 
 // Get region from cep.
-func getRegionByCEP(cep string) (region string, err error) {
+func getRegionByCEP(ctx context.Context, cep string) (region string, err error) {
 	// Try cache.
 	if region = getCEPRegion(cep); region != "" {
 		return region, nil
 	}
 
 	// Retrive address.
-	address, err := getAddressByCEP(cep)
+	address, err := getAddressByCEP(ctx, cep)
 	if err != nil {
 		return "", err
 	}
@@ -122,3 +145,49 @@ func getCEPByDealerLocation(dealer string) string {
 	}
 	return ""
 }
+
+// IBGE municipality.
+type ibgeCity struct {
+	Name string `json:"nome"`
+}
+
+// Check if city is a Minas Gerais municipality.
+func isMGCity(ctx context.Context, city string) (bool, error) {
+	cities, ok := getMGCitiesCache()
+	if !ok {
+		start := time.Now()
+		res, err := getUpstream(ctx, UPSTREAM_IBGE, `https://servicodados.ibge.gov.br/api/v1/localidades/estados/MG/municipios`)
+		if err != nil {
+			return false, newUpstreamError("IBGE", err)
+		}
+		defer res.Body.Close()
+		logDebug(ctx, "IBGE response time: %.1fs", time.Since(start).Seconds())
+		resBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return false, newUpstreamError("IBGE", err)
+		}
+		if res.StatusCode != http.StatusOK {
+			return false, newUpstreamError("IBGE", fmt.Errorf("status: %v, body: %s", res.StatusCode, resBody))
+		}
+		ibgeCities := []ibgeCity{}
+		err = json.Unmarshal(resBody, &ibgeCities)
+		if err != nil {
+			return false, newUpstreamError("IBGE", err)
+		}
+		if len(ibgeCities) == 0 {
+			return false, newUpstreamError("IBGE", fmt.Errorf("no city returned"))
+		}
+		cities = []string{}
+		for _, c := range ibgeCities {
+			cities = append(cities, normalizeCity(c.Name))
+		}
+		setMGCitiesCache(cities)
+	}
+	cityNorm := normalizeCity(city)
+	for _, c := range cities {
+		if c == cityNorm {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Run modes.
+const (
+	RUN_DEVELOPMENT = "development"
+	RUN_PRODUCTION  = "production"
+)
+
+// Config file path, when --config not used.
+const CONFIG_ENV = "FREIGHTSRV_CONFIG"
+
+// Shown instead of secrets.
+const CONFIG_REDACTED = "******"
+
+// Effective configuration, defaults until loaded.
+var cfg = defaultConfig()
+
+// Configuration, loaded from yaml file, environment variables override it.
+type config struct {
+	Mode      string          `yaml:"mode" env:"RUN_MODE"`
+	Listen    string          `yaml:"listen" env:"FREIGHTSRV_LISTEN"`
+	ZunkaPath string          `yaml:"zunkaPath" env:"ZUNKAPATH"` // Log into log/freightsrv and db into db.
+	LogLevel  string          `yaml:"logLevel" env:"FREIGHTSRV_LOG_LEVEL"`
+	DB        dbConfig        `yaml:"db"`
+	Redis     redisConfig     `yaml:"redis"`
+	HTTP      httpConfig      `yaml:"http"`
+	Cache     cacheConfig     `yaml:"cache"`
+	Pack      packLimits      `yaml:"pack"`
+	Correios  correiosLimits  `yaml:"correios"`
+	Warm      warmConfig      `yaml:"warm"`
+	Upstreams upstreamsConfig `yaml:"upstreams"`
+	Quote     quoteConfig     `yaml:"quote"`
+	RateLimit rateLimitConfig `yaml:"rateLimit"`
+}
+
+type dbConfig struct {
+	File string `yaml:"file" env:"ZUNKA_FREIGHT_DB"`   // Into zunkaPath/db.
+	Path string `yaml:"path" env:"FREIGHTSRV_DB_PATH"` // Used instead of file if defined.
+}
+
+type redisConfig struct {
+	Addr     string `yaml:"addr" env:"FREIGHTSRV_REDIS_ADDR"`
+	Password string `yaml:"password" env:"FREIGHTSRV_REDIS_PASSWORD" secret:"true"`
+	DB       int    `yaml:"db" env:"FREIGHTSRV_REDIS_DB"`
+}
+
+type httpConfig struct {
+	ReadTimeout  time.Duration `yaml:"readTimeout" env:"FREIGHTSRV_HTTP_READ_TIMEOUT"`
+	WriteTimeout time.Duration `yaml:"writeTimeout" env:"FREIGHTSRV_HTTP_WRITE_TIMEOUT"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout" env:"FREIGHTSRV_HTTP_IDLE_TIMEOUT"`
+}
+
+// Cache backend and time to live.
+type cacheConfig struct {
+	Backend          string        `yaml:"backend" env:"FREIGHTSRV_CACHE_BACKEND"` // redis, falling back to memory if not reachable, or memory.
+	MemoryMaxEntries int           `yaml:"memoryMaxEntries" env:"FREIGHTSRV_CACHE_MEMORY_MAX_ENTRIES"`
+	CEPRegionTTL     time.Duration `yaml:"cepRegionTTL" env:"FREIGHTSRV_CACHE_CEP_REGION_TTL"`
+	ViaCEPAddressTTL time.Duration `yaml:"viaCEPAddressTTL" env:"FREIGHTSRV_CACHE_VIA_CEP_ADDRESS_TTL"`
+	IBGECitiesTTL    time.Duration `yaml:"ibgeCitiesTTL" env:"FREIGHTSRV_CACHE_IBGE_CITIES_TTL"`
+	CorreiosTTL      time.Duration `yaml:"correiosTTL" env:"FREIGHTSRV_CACHE_CORREIOS_TTL"`            // Fresh, refreshed in background after it.
+	CorreiosStaleTTL time.Duration `yaml:"correiosStaleTTL" env:"FREIGHTSRV_CACHE_CORREIOS_STALE_TTL"` // Stale served until it if Correios fails.
+}
+
+// Pack weight in grams and price in R$.
+type packLimits struct {
+	MinWeight int     `yaml:"minWeight" env:"FREIGHTSRV_PACK_MIN_WEIGHT"`
+	MaxWeight int     `yaml:"maxWeight" env:"FREIGHTSRV_PACK_MAX_WEIGHT"`
+	MinPrice  float64 `yaml:"minPrice" env:"FREIGHTSRV_PACK_MIN_PRICE"`
+	MaxPrice  float64 `yaml:"maxPrice" env:"FREIGHTSRV_PACK_MAX_PRICE"`
+}
+
+// Correios dimensions in cm, smaller packs are enlarged to min.
+// Packs are rounded up to buckets, so similar packs share cache, with prices not less than exact ones.
+type correiosLimits struct {
+	MinLength int `yaml:"minLength" env:"FREIGHTSRV_CORREIOS_MIN_LENGTH"`
+	MaxLength int `yaml:"maxLength" env:"FREIGHTSRV_CORREIOS_MAX_LENGTH"`
+	MinWidth  int `yaml:"minWidth" env:"FREIGHTSRV_CORREIOS_MIN_WIDTH"`
+	MaxWidth  int `yaml:"maxWidth" env:"FREIGHTSRV_CORREIOS_MAX_WIDTH"`
+	MinHeight int `yaml:"minHeight" env:"FREIGHTSRV_CORREIOS_MIN_HEIGHT"`
+	MaxHeight int `yaml:"maxHeight" env:"FREIGHTSRV_CORREIOS_MAX_HEIGHT"`
+	MinSum    int `yaml:"minSum" env:"FREIGHTSRV_CORREIOS_MIN_SUM"`
+	MaxSum    int `yaml:"maxSum" env:"FREIGHTSRV_CORREIOS_MAX_SUM"`
+	// Buckets, not used if zero.
+	WeightBands   []int   `yaml:"weightBands"`                                            // Carrier weight bands upper limit in g.
+	WeightStep    int     `yaml:"weightStep" env:"FREIGHTSRV_CORREIOS_WEIGHT_STEP"`       // Above last band, in g.
+	DimensionStep int     `yaml:"dimensionStep" env:"FREIGHTSRV_CORREIOS_DIMENSION_STEP"` // cm.
+	PriceStep     float64 `yaml:"priceStep" env:"FREIGHTSRV_CORREIOS_PRICE_STEP"`         // Declared value in R$, off by default, rounding up raises the quoted declared value fee.
+}
+
+// Token bucket rate limits by route, for authenticated user or source IP if not authenticated.
+type rateLimitConfig struct {
+	Enabled    bool                 `yaml:"enabled" env:"FREIGHTSRV_RATE_LIMIT_ENABLED"`
+	TrustProxy bool                 `yaml:"trustProxy" env:"FREIGHTSRV_RATE_LIMIT_TRUST_PROXY"` // Source IP from X-Forwarded-For, if behind a proxy.
+	Default    rateLimit            `yaml:"default" env:"FREIGHTSRV_RATE_LIMIT_"`
+	Routes     map[string]rateLimit `yaml:"routes"`                                 // By route, like /freightsrv/freights/zoom, default if not in it.
+	Auth       rateLimit            `yaml:"auth" env:"FREIGHTSRV_RATE_LIMIT_AUTH_"` // Authentication attempts by source IP.
+}
+
+type rateLimit struct {
+	Rate  float64 `yaml:"rate" env:"RATE"`   // Requests by second.
+	Burst int     `yaml:"burst" env:"BURST"` // Requests at once.
+}
+
+// Route rate limit.
+func (r rateLimitConfig) get(route string) rateLimit {
+	if rl, ok := r.Routes[route]; ok {
+		return rl
+	}
+	return r.Default
+}
+
+// Quote time budget, providers not answered in time are dropped.
+type quoteConfig struct {
+	Budget    time.Duration `yaml:"budget" env:"FREIGHTSRV_QUOTE_BUDGET"`
+	MaxBudget time.Duration `yaml:"maxBudget" env:"FREIGHTSRV_QUOTE_MAX_BUDGET"` // Max budget from request header.
+}
+
+// Upstream services, env tag of struct is the prefix of its fields env.
+type upstreamsConfig struct {
+	Correios  upstreamConfig `yaml:"correios" env:"FREIGHTSRV_CORREIOS_"`
+	ViaCEP    upstreamConfig `yaml:"viacep" env:"FREIGHTSRV_VIACEP_"`
+	IBGE      upstreamConfig `yaml:"ibge" env:"FREIGHTSRV_IBGE_"`
+	ZunkaSite upstreamConfig `yaml:"zunkasite" env:"FREIGHTSRV_ZUNKASITE_"`
+}
+
+type upstreamConfig struct {
+	ConnectTimeout time.Duration `yaml:"connectTimeout" env:"CONNECT_TIMEOUT"`
+	Timeout        time.Duration `yaml:"timeout" env:"TIMEOUT"`            // Each attempt, until response read.
+	Retries        int           `yaml:"retries" env:"RETRIES"`            // Idempotent calls only.
+	RetryBackoff   time.Duration `yaml:"retryBackoff" env:"RETRY_BACKOFF"` // Doubled each retry, with jitter.
+	// Circuit breaker.
+	BreakerFailures int           `yaml:"breakerFailures" env:"BREAKER_FAILURES"`  // Consecutive failed calls to open, 0 never opens.
+	BreakerOpenTime time.Duration `yaml:"breakerOpenTime" env:"BREAKER_OPEN_TIME"` // Open before a trial call.
+}
+
+// Upstream service config.
+// Max time of a call, all attempts with max backoff jitter.
+func (uc upstreamConfig) maxCallTime() time.Duration {
+	d := uc.Timeout
+	for attempt := 0; attempt < uc.Retries; attempt++ {
+		backoff := uc.RetryBackoff << uint(attempt)
+		d += backoff + backoff/2 + uc.Timeout
+	}
+	return d
+}
+
+func (u upstreamsConfig) get(service string) upstreamConfig {
+	switch service {
+	case UPSTREAM_CORREIOS:
+		return u.Correios
+	case UPSTREAM_IBGE:
+		return u.IBGE
+	case UPSTREAM_ZUNKASITE:
+		return u.ZunkaSite
+	default:
+		return u.ViaCEP
+	}
+}
+
+// Cache warming at off-peak hours.
+type warmConfig struct {
+	Enabled      bool          `yaml:"enabled" env:"FREIGHTSRV_WARM_ENABLED"`
+	StartHour    int           `yaml:"startHour" env:"FREIGHTSRV_WARM_START_HOUR"` // Brazil time.
+	EndHour      int           `yaml:"endHour" env:"FREIGHTSRV_WARM_END_HOUR"`
+	CallInterval time.Duration `yaml:"callInterval" env:"FREIGHTSRV_WARM_CALL_INTERVAL"` // Between upstream calls.
+	Top          int           `yaml:"top" env:"FREIGHTSRV_WARM_TOP"`                    // Most quoted destinations and packs.
+	CEPs         []string      `yaml:"ceps"`                                             // Like state capitals.
+	Packs        []warmPack    `yaml:"packs"`                                            // Like best-selling products, to each CEP.
+}
+
+// Pack dimensions in cm, weight in g and price in R$.
+type warmPack struct {
+	Name   string  `yaml:"name"`
+	Length int     `yaml:"length"`
+	Width  int     `yaml:"width"`
+	Height int     `yaml:"height"`
+	Weight int     `yaml:"weight"`
+	Price  float64 `yaml:"price"`
+}
+
+func defaultConfig() config {
+	return config{
+		Mode:   RUN_DEVELOPMENT,
+		Listen: ":8081",
+		Redis:  redisConfig{Addr: "localhost:6379"},
+		HTTP: httpConfig{
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  15 * time.Second,
+		},
+		Cache: cacheConfig{
+			Backend:          CACHE_REDIS,
+			MemoryMaxEntries: 10000,
+			CEPRegionTTL:     168 * time.Hour,
+			ViaCEPAddressTTL: 48 * time.Hour,
+			IBGECitiesTTL:    720 * time.Hour,
+			CorreiosTTL:      48 * time.Hour,
+			CorreiosStaleTTL: 168 * time.Hour,
+		},
+		Pack: packLimits{MinWeight: 1, MaxWeight: 50000, MinPrice: 1.0, MaxPrice: 1000000.0},
+		Correios: correiosLimits{
+			MinLength: 15, MaxLength: 105,
+			MinWidth: 10, MaxWidth: 105,
+			MinHeight: 1, MaxHeight: 105,
+			MinSum: 26, MaxSum: 200,
+			WeightBands:   []int{300, 1000},
+			WeightStep:    1000,
+			DimensionStep: 5,
+		},
+		Upstreams: upstreamsConfig{
+			Correios:  upstreamConfig{ConnectTimeout: 2 * time.Second, Timeout: 2500 * time.Millisecond, Retries: 1, RetryBackoff: 200 * time.Millisecond, BreakerFailures: 5, BreakerOpenTime: 30 * time.Second},
+			ViaCEP:    upstreamConfig{ConnectTimeout: 1 * time.Second, Timeout: 1500 * time.Millisecond, Retries: 2, RetryBackoff: 100 * time.Millisecond, BreakerFailures: 5, BreakerOpenTime: 30 * time.Second},
+			IBGE:      upstreamConfig{ConnectTimeout: 2 * time.Second, Timeout: 5 * time.Second, Retries: 2, RetryBackoff: 200 * time.Millisecond, BreakerFailures: 5, BreakerOpenTime: 30 * time.Second},
+			ZunkaSite: upstreamConfig{ConnectTimeout: 1 * time.Second, Timeout: 3 * time.Second, Retries: 1, RetryBackoff: 100 * time.Millisecond, BreakerFailures: 5, BreakerOpenTime: 30 * time.Second},
+		},
+		Warm: warmConfig{
+			Enabled:      true,
+			StartHour:    3,
+			EndHour:      6,
+			CallInterval: 2 * time.Second,
+			Top:          200,
+			CEPs:         []string{},
+			Packs:        []warmPack{},
+		},
+		Quote: quoteConfig{
+			Budget:    6 * time.Second,
+			MaxBudget: 9 * time.Second,
+		},
+		RateLimit: rateLimitConfig{
+			Enabled: true,
+			Default: rateLimit{Rate: 10, Burst: 50},
+			Routes: map[string]rateLimit{
+				"/freightsrv/freights/zoom":  {Rate: 1, Burst: 10},
+				"/freightsrv/freights/zunka": {Rate: 5, Burst: 30},
+			},
+			Auth: rateLimit{Rate: 20, Burst: 100},
+		},
+	}
+}
+
+// Load defaults, file if path not empty and environment overrides, then validate.
+func loadConfig(file string) (c config, err error) {
+	c = defaultConfig()
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return c, fmt.Errorf("reading config file: %v", err)
+		}
+		// Strict, so misspelled keys are not ignored.
+		if err = yaml.UnmarshalStrict(b, &c); err != nil {
+			return c, fmt.Errorf("parsing config file %s: %v", file, err)
+		}
+	}
+	if err = applyEnv(reflect.ValueOf(&c).Elem(), ""); err != nil {
+		return c, err
+	}
+	return c, c.validate()
+}
+
+// Override fields with env tag by environment variables, prefix from struct fields env tag.
+func applyEnv(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		sf := v.Type().Field(i)
+		if field.Kind() == reflect.Struct && field.Type() != reflect.TypeOf(time.Time{}) {
+			if err := applyEnv(field, prefix+sf.Tag.Get("env")); err != nil {
+				return err
+			}
+			continue
+		}
+		if sf.Tag.Get("env") == "" {
+			continue
+		}
+		name := prefix + sf.Tag.Get("env")
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, val); err != nil {
+			return fmt.Errorf("invalid %s: %s, %v", name, val, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, val string) error {
+	if _, ok := field.Interface().(time.Duration); ok {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Int:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// Check all values, so start-up fails with every problem listed.
+func (c config) validate() error {
+	errs := []string{}
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, a...))
+		}
+	}
+	check(c.Mode == RUN_DEVELOPMENT || c.Mode == RUN_PRODUCTION, "mode must be %s or %s", RUN_DEVELOPMENT, RUN_PRODUCTION)
+	check(c.Listen != "", "listen required")
+	check(c.dbPath() != "", "db.path or zunkaPath and db.file required")
+	if c.LogLevel != "" {
+		check(logLevelIndex(c.LogLevel) >= 0, "logLevel must be one of %s", strings.Join(logLevelNames, ", "))
+	}
+	check(c.Redis.Addr != "", "redis.addr required")
+	check(c.Redis.DB >= 0, "redis.db must not be negative")
+	check(c.HTTP.ReadTimeout > 0 && c.HTTP.WriteTimeout > 0 && c.HTTP.IdleTimeout > 0, "http timeouts must be positive")
+	check(c.Cache.Backend == CACHE_REDIS || c.Cache.Backend == CACHE_MEMORY, "cache.backend must be %s or %s", CACHE_REDIS, CACHE_MEMORY)
+	check(c.Cache.MemoryMaxEntries > 0, "cache.memoryMaxEntries must be positive")
+	check(c.Cache.CEPRegionTTL > 0 && c.Cache.ViaCEPAddressTTL > 0 && c.Cache.IBGECitiesTTL > 0 && c.Cache.CorreiosTTL > 0, "cache TTLs must be positive")
+	check(c.Cache.CorreiosStaleTTL >= c.Cache.CorreiosTTL, "cache.correiosStaleTTL must not be less than cache.correiosTTL")
+	check(c.Pack.MinWeight > 0 && c.Pack.MinWeight <= c.Pack.MaxWeight, "pack weight limits must be positive and minWeight not greater than maxWeight")
+	check(c.Pack.MinPrice > 0 && c.Pack.MinPrice <= c.Pack.MaxPrice, "pack price limits must be positive and minPrice not greater than maxPrice")
+	cl := c.Correios
+	check(cl.MinLength > 0 && cl.MinLength <= cl.MaxLength, "correios length limits must be positive and minLength not greater than maxLength")
+	check(cl.MinWidth > 0 && cl.MinWidth <= cl.MaxWidth, "correios width limits must be positive and minWidth not greater than maxWidth")
+	check(cl.MinHeight > 0 && cl.MinHeight <= cl.MaxHeight, "correios height limits must be positive and minHeight not greater than maxHeight")
+	check(cl.MinSum > 0 && cl.MinSum <= cl.MaxSum, "correios sum limits must be positive and minSum not greater than maxSum")
+	for i, band := range cl.WeightBands {
+		check(band > 0 && (i == 0 || band > cl.WeightBands[i-1]), "correios.weightBands must be positive and ascending")
+	}
+	check(cl.WeightStep >= 0 && cl.DimensionStep >= 0 && cl.PriceStep >= 0, "correios buckets steps must not be negative")
+	for _, service := range []string{UPSTREAM_CORREIOS, UPSTREAM_VIACEP, UPSTREAM_IBGE, UPSTREAM_ZUNKASITE} {
+		uc := c.Upstreams.get(service)
+		check(uc.ConnectTimeout > 0 && uc.Timeout > 0, "upstreams.%s timeouts must be positive", service)
+		check(uc.Retries >= 0 && uc.Retries <= 5 && uc.RetryBackoff >= 0, "upstreams.%s retries must be from 0 to 5 and retryBackoff not negative", service)
+		check(uc.BreakerFailures >= 0 && uc.BreakerOpenTime > 0, "upstreams.%s breakerFailures must not be negative and breakerOpenTime must be positive", service)
+	}
+	w := c.Warm
+	check(w.StartHour >= 0 && w.StartHour < 24 && w.EndHour >= 0 && w.EndHour < 24 && w.StartHour != w.EndHour, "warm hours must be from 0 to 23 and startHour different of endHour")
+	check(w.CallInterval > 0, "warm.callInterval must be positive")
+	check(w.Top >= 0, "warm.top must not be negative")
+	for _, cep := range w.CEPs {
+		check(validateCEP("cep", cep) == nil, "warm.ceps invalid CEP %s", cep)
+	}
+	for _, wp := range w.Packs {
+		check(wp.Length > 0 && wp.Width > 0 && wp.Height > 0 && wp.Weight > 0 && wp.Price > 0, "warm.packs %s dimensions, weight and price must be positive", wp.Name)
+	}
+	check(c.Quote.Budget > 0 && c.Quote.Budget <= c.Quote.MaxBudget, "quote.budget must be positive and not greater than quote.maxBudget")
+	check(c.Quote.MaxBudget < c.HTTP.WriteTimeout, "quote.maxBudget must be less than http.writeTimeout")
+	// Called while quoting, all attempts must fit in the budget.
+	for _, service := range []string{UPSTREAM_CORREIOS, UPSTREAM_VIACEP} {
+		d := c.Upstreams.get(service).maxCallTime()
+		check(d <= c.Quote.Budget, "upstreams.%s timeout with retries (%v) must not be greater than quote.budget (%v)", service, d, c.Quote.Budget)
+	}
+	check(c.RateLimit.Default.Rate > 0 && c.RateLimit.Default.Burst >= 1, "rateLimit.default rate must be positive and burst at least 1")
+	for route, rl := range c.RateLimit.Routes {
+		check(rl.Rate > 0 && rl.Burst >= 1, "rateLimit.routes %s rate must be positive and burst at least 1", route)
+	}
+	check(c.RateLimit.Auth.Rate > 0 && c.RateLimit.Auth.Burst >= 1, "rateLimit.auth rate must be positive and burst at least 1")
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Sqlite db file path.
+func (c config) dbPath() string {
+	if c.DB.Path != "" {
+		return c.DB.Path
+	}
+	if c.ZunkaPath == "" || c.DB.File == "" {
+		return ""
+	}
+	return path.Join(c.ZunkaPath, "db", c.DB.File)
+}
+
+// Log dir, empty to log only to stdout.
+func (c config) logDir() string {
+	if c.ZunkaPath == "" {
+		return ""
+	}
+	return path.Join(c.ZunkaPath, "log", "freightsrv")
+}
+
+// Yaml with secrets redacted.
+func (c config) redactedYAML() ([]byte, error) {
+	redact(reflect.ValueOf(&c).Elem())
+	return yaml.Marshal(c)
+}
+
+func redact(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			redact(field)
+			continue
+		}
+		if v.Type().Field(i).Tag.Get("secret") == "true" && field.Kind() == reflect.String && field.String() != "" {
+			field.SetString(CONFIG_REDACTED)
+		}
+	}
+}
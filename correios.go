@@ -2,10 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -22,61 +23,94 @@ const (
 	CORREIOS_ACKNOWLEDGMENT_RECEIPT = "N" // Aviso de recebimento.
 )
 
-func (p *pack) ValidateCorreios() bool {
+func (p *pack) ValidateCorreios() error {
 	// Basic validation.
-	if !p.Validate() {
-		return false
+	if err := p.Validate(); err != nil {
+		return err
 	}
 	// Length in cm.
-	minLength := 15
-	maxLength := 105
+	minLength := cfg.Correios.MinLength
+	maxLength := cfg.Correios.MaxLength
 	if p.Length < minLength {
-		log.Printf("[warning] [correios] Pack length changed from %v cm to %v cm", p.Length, minLength)
+		logDebug(context.TODO(), "Correios pack length changed from %v cm to %v cm", p.Length, minLength)
 		p.Length = minLength
 	}
 	if p.Length > maxLength {
-		log.Printf("[warning] [correios] Correios shipping not estimated. Length of %v cm greater than %v cm.", p.Length, maxLength)
-		return false
+		return newValidationError("length", ERR_CORREIOS_LIMIT, "Length of %v cm greater than %v cm", p.Length, maxLength)
 	}
 
 	// Width in cm.
-	minWidth := 10
-	maxWidth := 105
+	minWidth := cfg.Correios.MinWidth
+	maxWidth := cfg.Correios.MaxWidth
 	if p.Width < minWidth {
-		log.Printf("[warning] [correios] Pack width changed from %v cm to %v cm", p.Width, minWidth)
+		logDebug(context.TODO(), "Correios pack width changed from %v cm to %v cm", p.Width, minWidth)
 		p.Width = minWidth
 	}
 	if p.Width > maxWidth {
-		log.Printf("[warning] [correios] Correios shipping not estimated. Width of %v cm greater than %v cm.", p.Width, maxWidth)
-		return false
+		return newValidationError("width", ERR_CORREIOS_LIMIT, "Width of %v cm greater than %v cm", p.Width, maxWidth)
 	}
 
 	// Height in cm.
-	minHeight := 1
-	maxHeight := 105
+	minHeight := cfg.Correios.MinHeight
+	maxHeight := cfg.Correios.MaxHeight
 	if p.Height < minHeight {
-		log.Printf("[warning] [correios] Pack height changed from %v cm to %v cm", p.Height, minHeight)
+		logDebug(context.TODO(), "Correios pack height changed from %v cm to %v cm", p.Height, minHeight)
 		p.Height = minHeight
 	}
 	if p.Height > maxHeight {
-		log.Printf("[warning] [correios] Correios shipping not estimated. Height of %v cm greater than %v cm.", p.Height, maxHeight)
-		return false
+		return newValidationError("height", ERR_CORREIOS_LIMIT, "Height of %v cm greater than %v cm", p.Height, maxHeight)
 	}
 
 	// Dimensions sum.
 	sum := p.Length + p.Width + p.Height
-	minSum := 26
-	maxSum := 200
+	minSum := cfg.Correios.MinSum
+	maxSum := cfg.Correios.MaxSum
 	if sum < minSum {
-		log.Printf("[warning] [correios] Correios shipping not estimated. Sum dimensions of %v cm less than %v cm.", sum, minSum)
-		return false
+		return newValidationError("dimensions", ERR_CORREIOS_LIMIT, "Sum dimensions of %v cm less than %v cm", sum, minSum)
 	}
 	if sum > maxSum {
-		log.Printf("[warning] [correios] Correios shipping not estimated. Sum dimensions of %v cm greater than %v cm.", sum, maxSum)
-		return false
+		return newValidationError("dimensions", ERR_CORREIOS_LIMIT, "Sum dimensions of %v cm greater than %v cm", sum, maxSum)
 	}
 
-	return true
+	return nil
+}
+
+// Pack rounded up to buckets, dimensions not changed if the sum goes above limit.
+func (p pack) correiosBucket() pack {
+	cl := cfg.Correios
+	p.Weight = bucketWeight(p.Weight, cl.WeightBands, cl.WeightStep, cfg.Pack.MaxWeight)
+	length := roundUpToStep(p.Length, cl.DimensionStep, cl.MaxLength)
+	width := roundUpToStep(p.Width, cl.DimensionStep, cl.MaxWidth)
+	height := roundUpToStep(p.Height, cl.DimensionStep, cl.MaxHeight)
+	if length+width+height <= cl.MaxSum {
+		p.Length, p.Width, p.Height = length, width, height
+	}
+	if cl.PriceStep > 0 {
+		p.Price = math.Min(math.Ceil(p.Price/cl.PriceStep)*cl.PriceStep, cfg.Pack.MaxPrice)
+	}
+	return p
+}
+
+// Weight up to first band not less than it, or to step above last band.
+func bucketWeight(weight int, bands []int, step int, max int) int {
+	for _, band := range bands {
+		if weight <= band {
+			return band
+		}
+	}
+	return roundUpToStep(weight, step, max)
+}
+
+// Value up to next step multiple, not above max.
+func roundUpToStep(val int, step int, max int) int {
+	if step <= 1 {
+		return val
+	}
+	val = (val + step - 1) / step * step
+	if val > max {
+		return max
+	}
+	return val
 }
 
 type correiosXMLService struct {
@@ -96,29 +130,82 @@ type correiosXMLResult struct {
 	Result  correiosXMLServices `xml:"Servicos"`
 }
 
+// Correios calls in flight, by cache key.
+var correiosFlight = newFlightGroup(CACHE_CORREIOS)
+
 // Get correios freight by pack.
-func getCorreiosFreightByPack(c chan *freightsOk, p *pack) {
+func getCorreiosFreightByPack(ctx context.Context, c chan *freightsOk, p *pack) {
 	result := &freightsOk{
 		Freights: []*freight{},
 	}
 	result.CEPOrigin = p.CEPOrigin
 	result.CEPDestiny = p.CEPDestiny
 
-	if !p.ValidateCorreios() {
+	if err := p.ValidateCorreios(); err != nil {
+		logWarning(ctx, "Correios shipping not estimated. %v", err)
 		c <- result
 		return
 	}
 
-	// Get from cache.
-	temp, ok := getCorreiosCache(p)
+	// Quote bucket, not exact pack.
+	bp := p.correiosBucket()
+
+	// Get from cache, stale freights are served while refreshed in background.
+	temp, stale, ok := getCorreiosCache(&bp)
 	if ok {
 		// log.Printf("result: %+v", temp)
+		if makeCorreiosKey(&bp) != makeCorreiosKey(p) {
+			cacheBucketHits.inc(CACHE_CORREIOS)
+		}
+		if stale {
+			for _, fr := range temp {
+				fr.Stale = true
+			}
+			go refreshCorreiosCache(ctx, bp)
+		}
 		result.Freights = temp
 		result.Ok = true
 		c <- result
 		return
 	}
-	// Not in the cache.
+	// Not in the cache, concurrent requests for the same pack share one call.
+	// The call is not canceled with the request, so it is cached even if this request gives up.
+	val, err, _ := correiosFlight.DoContext(ctx, makeCorreiosKey(&bp), func() (interface{}, error) {
+		fetchCtx, cancel := detachedUpstreamContext(ctx, UPSTREAM_CORREIOS)
+		defer cancel()
+		return fetchCorreiosFreights(fetchCtx, &bp)
+	})
+	if err != nil {
+		result.Err = err
+		c <- result
+		return
+	}
+	// Copy, so callers sharing the call don't share freights.
+	frs, _ := val.([]*freight)
+	for _, fr := range frs {
+		frCopy := *fr
+		result.Freights = append(result.Freights, &frCopy)
+	}
+	result.Ok = true
+	c <- result
+}
+
+// Refresh stale Correios cache, it is kept until hard TTL if Correios fails.
+func refreshCorreiosCache(ctx context.Context, p pack) {
+	// Not canceled with request.
+	ctx, cancel := detachedUpstreamContext(ctx, UPSTREAM_CORREIOS)
+	defer cancel()
+	_, err, _ := correiosFlight.Do(makeCorreiosKey(&p), func() (interface{}, error) {
+		return fetchCorreiosFreights(ctx, &p)
+	})
+	if err != nil {
+		logWarning(ctx, "Refreshing stale Correios freights, serving stale until hard TTL. %v", err)
+	}
+}
+
+// Get freights from Correios and cache them.
+func fetchCorreiosFreights(ctx context.Context, p *pack) (frs []*freight, err error) {
+	frs = []*freight{}
 	reqBody := []byte(`nCdEmpresa=` + CORREIOS_COMPANY_ADMIN_CODE +
 		`&sDsSenha=` + CORREIOS_COMPANY_PASSWORD +
 		`&nCdServico=` + CORREIOS_SERVICES_CODE +
@@ -139,49 +226,45 @@ func getCorreiosFreightByPack(c chan *freightsOk, p *pack) {
 	// log.Println("[debug] Correios request body: " + string(reqBody))
 
 	// Request product add.
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", CORREIOS_URL, bytes.NewBuffer(reqBody))
-	if checkError(err) {
-		c <- result
-		return
+	req, err := http.NewRequestWithContext(ctx, "POST", CORREIOS_URL, bytes.NewBuffer(reqBody))
+	if checkError(ctx, err) {
+		return frs, newInternalError(err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	start := time.Now()
-	res, err := client.Do(req)
-	if checkError(err) {
-		c <- result
-		return
+	// Quote only, safe to retry.
+	res, err := doUpstream(UPSTREAM_CORREIOS, req, true)
+	// Failing fast, freight from region.
+	if err == errCircuitOpen {
+		logDebug(ctx, "Correios not called, %v", err)
+		return frs, newUpstreamError("Correios", err)
 	}
-	log.Printf("[debug] Correios response time: %.1fs", time.Since(start).Seconds())
+	if checkError(ctx, err) {
+		return frs, newUpstreamError("Correios", err)
+	}
+	logDebug(ctx, "Correios response time: %.1fs", time.Since(start).Seconds())
 
 	defer res.Body.Close()
-	if checkError(err) {
-		c <- result
-		return
-	}
 
 	// Result.
 	resBody, err := ioutil.ReadAll(res.Body)
-	if checkError(err) {
-		c <- result
-		return
+	if checkError(ctx, err) {
+		return frs, newUpstreamError("Correios", err)
 	}
 	// log.Println("resBody:", string(resBody))
 
 	rCorreios := correiosXMLResult{}
 	err = xml.Unmarshal(resBody, &rCorreios)
-	if checkError(err) {
-		c <- result
-		return
+	if checkError(ctx, err) {
+		return frs, newUpstreamError("Correios", err)
 	}
-	// log.Printf("\n\nresult: %+v", result)
 
 	for _, service := range rCorreios.Result.Services {
 		// log.Printf("service: %+v", service)
 		if service.Error != 0 {
 			// log.Printf("[warning] [correios] pack: %+v, code: %d, error: %d, message: %v", p, service.Code, service.Error, service.MsgError)
-			log.Printf("[warning] [correios] service code: %d, error: %d\n\tmessage: %v\n\tpack: %+v\n\treqBody: %s", service.Code, service.Error, service.MsgError, p, reqBody)
+			logWarning(ctx, "Correios service code: %d, error: %d, message: %v, pack: %+v", service.Code, service.Error, service.MsgError, p)
 			continue
 		}
 		// Service description.
@@ -197,21 +280,17 @@ func getCorreiosFreightByPack(c chan *freightsOk, p *pack) {
 		price := strings.ReplaceAll(service.Price, ".", "")
 		price = strings.ReplaceAll(service.Price, ",", ".")
 		priceF, err := strconv.ParseFloat(price, 64)
-		if checkError(err) {
+		if checkError(ctx, err) {
 			continue
 		}
 		// log.Printf("Price: %v", priceF)
-		result.Freights = append(result.Freights, &freight{Carrier: "Correios", ServiceCode: strconv.Itoa(service.Code), ServiceDesc: serviceDesc, Price: priceF, Deadline: service.DeadLine})
+		frs = append(frs, &freight{Carrier: "Correios", ServiceCode: strconv.Itoa(service.Code), ServiceDesc: serviceDesc, Price: priceF, Deadline: service.DeadLine})
 	}
-	// log.Printf("result: %+v", result)
-	// log.Printf("result.Freights: %+v", result.Freights[0])
 	// Not cache empty values.
-	if len(result.Freights) > 0 {
-		setCorreiosCache(p, result.Freights)
+	if len(frs) > 0 {
+		setCorreiosCache(p, frs)
 	}
-	result.Ok = true
-	// log.Printf("result: %+v", result)
-	c <- result
+	return frs, nil
 }
 
 func testXML() {
@@ -241,6 +320,6 @@ func testXML() {
 
 	err = xml.Unmarshal(testString, &data)
 
-	checkError(err)
-	log.Printf("\n\ndata: %+v", data)
+	checkError(context.TODO(), err)
+	logDebug(context.TODO(), "data: %+v", data)
 }
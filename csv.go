@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// Import modes.
+const (
+	CSV_MODE_MERGE   = "merge"   // Insert new rows and update existing ones.
+	CSV_MODE_REPLACE = "replace" // Merge and delete rows not in the file.
+)
+
+// Max csv file size.
+const CSV_MAX_SIZE = 5 << 20
+
+// Row actions.
+const (
+	CSV_UNCHANGED = iota
+	CSV_INSERTED
+	CSV_UPDATED
+)
+
+// Rate table row from csv.
+type csvRow interface {
+	Validate(ctx context.Context) error
+	csvKey() string
+	upsert(tx *sqlx.Tx, version int) (id int, action int, before types.JSONText, err error)
+}
+
+// Csv rate table.
+type csvTable struct {
+	name   string
+	header []string
+	parse  func(record []string) (csvRow, error)
+}
+
+// Import result.
+type csvImportReport struct {
+	Mode      string           `json:"mode"`
+	Applied   bool             `json:"applied"` // False if some row was rejected.
+	Inserted  int              `json:"inserted"`
+	Updated   int              `json:"updated"`
+	Unchanged int              `json:"unchanged"`
+	Deleted   int              `json:"deleted"`
+	Rejected  []csvRejectedRow `json:"rejected"`
+}
+
+// Rejected row.
+type csvRejectedRow struct {
+	Line   int          `json:"line"`
+	Errors []fieldError `json:"errors"`
+}
+
+// Write records as csv file.
+func writeCSV(w http.ResponseWriter, filename string, header []string, records [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	cw.WriteAll(records)
+}
+
+// Read csv from request body, "," or ";" separated, header required.
+func readCSV(req *http.Request, header []string) (records [][]string, err error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, CSV_MAX_SIZE))
+	if err != nil {
+		return records, newBadRequestError(ERR_INVALID_BODY, "Can't read csv, max size is %d bytes", CSV_MAX_SIZE)
+	}
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")) // Excel BOM.
+	cr := csv.NewReader(bytes.NewReader(body))
+	// Spreadsheets in pt-BR use ";".
+	firstLine := body
+	if i := bytes.IndexByte(body, '\n'); i >= 0 {
+		firstLine = body[:i]
+	}
+	if bytes.Contains(firstLine, []byte(";")) && !bytes.Contains(firstLine, []byte(",")) {
+		cr.Comma = ';'
+	}
+	cr.FieldsPerRecord = len(header)
+	cr.TrimLeadingSpace = true
+
+	// Header.
+	fileHeader, err := cr.Read()
+	if err == io.EOF {
+		return records, newValidationError("header", ERR_INVALID_BODY, "Empty csv")
+	}
+	if err != nil {
+		return records, newBadRequestError(ERR_INVALID_BODY, "Invalid csv. %v", err)
+	}
+	for i := range header {
+		if strings.ToLower(strings.TrimSpace(fileHeader[i])) != header[i] {
+			return records, newValidationError("header", ERR_INVALID_BODY, "Invalid csv header, want %s", strings.Join(header, ","))
+		}
+	}
+	records, err = cr.ReadAll()
+	if err != nil {
+		return records, newBadRequestError(ERR_INVALID_BODY, "Invalid csv. %v", err)
+	}
+	return records, nil
+}
+
+// Import csv from request and write report, ?mode=merge (default) or ?mode=replace, ?version=id (default active).
+func handleCSVImport(w http.ResponseWriter, req *http.Request, table csvTable) {
+	mode := req.URL.Query().Get("mode")
+	if mode == "" {
+		mode = CSV_MODE_MERGE
+	}
+	records, err := readCSV(req, table.header)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	version, err := queryRateVersion(req.URL.Query(), table.name)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	report, err := importCSV(req.Context(), table, records, mode, version, newAuditEntry(req, table.name, 0, ""))
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Applied {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	w.Write(reportJSON)
+}
+
+// Import csv records into table version, all or nothing, changes are audited with user and request id from by.
+func importCSV(ctx context.Context, table csvTable, records [][]string, mode string, version int, by *auditEntry) (report csvImportReport, err error) {
+	report = csvImportReport{Mode: mode, Rejected: []csvRejectedRow{}}
+	if mode != CSV_MODE_MERGE && mode != CSV_MODE_REPLACE {
+		return report, newBadRequestError(ERR_INVALID_QUERY, "Invalid mode %s, must be %s or %s", mode, CSV_MODE_MERGE, CSV_MODE_REPLACE)
+	}
+
+	// Validated before the transaction, validation may call upstreams.
+	rows := []csvRow{}
+	keys := map[string]int{} // Key -> line.
+	for i, record := range records {
+		line := i + 2 // Header is line 1.
+		row, err := table.parse(record)
+		if err == nil {
+			err = row.Validate(ctx)
+		}
+		if err == nil {
+			if dupLine, ok := keys[row.csvKey()]; ok {
+				err = newValidationError("", ERR_CONFLICT, "Same row as line %d", dupLine)
+			}
+		}
+		if err != nil {
+			var aErr *apiError
+			if !errors.As(err, &aErr) {
+				return report, newInternalError(err)
+			}
+			rejected := csvRejectedRow{Line: line, Errors: aErr.Errors}
+			if len(rejected.Errors) == 0 {
+				rejected.Errors = []fieldError{{Field: aErr.Field, Code: aErr.Code, Message: aErr.Message}}
+			}
+			report.Rejected = append(report.Rejected, rejected)
+			continue
+		}
+		keys[row.csvKey()] = line
+		rows = append(rows, row)
+	}
+	// Nothing changed if some row is invalid.
+	if len(report.Rejected) > 0 {
+		return report, nil
+	}
+
+	tx, err := sql3DB.Beginx()
+	if err != nil {
+		return report, newInternalError(err)
+	}
+	defer tx.Rollback()
+	if version, err = editableRateVersion(tx, table.name, version); err != nil {
+		return report, err
+	}
+
+	ids := []interface{}{}
+	for _, row := range rows {
+		id, action, before, err := row.upsert(tx, version)
+		if err != nil {
+			return report, newDBError(err)
+		}
+		ids = append(ids, id)
+		switch action {
+		case CSV_INSERTED:
+			report.Inserted++
+			err = auditTx(tx, by, id, AUDIT_CREATE, nil)
+		case CSV_UPDATED:
+			report.Updated++
+			err = auditTx(tx, by, id, AUDIT_UPDATE, before)
+		default:
+			report.Unchanged++
+		}
+		if err != nil {
+			return report, newInternalError(err)
+		}
+	}
+
+	// Remove rows not in the file.
+	if mode == CSV_MODE_REPLACE {
+		stm := "SELECT id FROM " + table.name + " WHERE version_id=?"
+		if len(ids) > 0 {
+			stm += " AND id NOT IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+		}
+		delIDs := []int{}
+		if err = tx.Select(&delIDs, stm, append([]interface{}{version}, ids...)...); err != nil {
+			return report, newInternalError(err)
+		}
+		for _, id := range delIDs {
+			before, err := snapshotRow(tx, table.name, id)
+			if err != nil {
+				return report, newInternalError(err)
+			}
+			if _, err = tx.Exec("DELETE FROM "+table.name+" WHERE id=?", id); err != nil {
+				return report, newInternalError(err)
+			}
+			if err = auditTx(tx, by, id, AUDIT_DELETE, before); err != nil {
+				return report, newInternalError(err)
+			}
+			report.Deleted++
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return report, newInternalError(err)
+	}
+	report.Applied = true
+	return report, nil
+}
+
+// Csv integer field.
+func parseCSVInt(fes *fieldErrors, field string, val string) int {
+	num, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil {
+		fes.add(field, ERR_INVALID_FIELDS, "Invalid %s: %s", field, val)
+	}
+	return num
+}
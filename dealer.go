@@ -1,23 +1,58 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
-	"log"
-	"strings"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
 )
 
+// Dealer freight list, filter by dealer and weight.
+var dealerFreightList = listTable{
+	name: "dealer_freight",
+	columns: map[string]string{
+		"id":        "id",
+		"dealer":    "dealer",
+		"weight":    "weight",
+		"deadline":  "deadline",
+		"price":     "price",
+		"createdAt": "created_at",
+		"updatedAt": "updated_at",
+	},
+	filters: []listFilter{
+		{param: "dealer", column: "dealer", kind: FILTER_IN},
+		{param: "weightMin", column: "weight", kind: FILTER_MIN},
+		{param: "weightMax", column: "weight", kind: FILTER_MAX},
+	},
+	defaultSort: "dealer, weight, deadline",
+	versioned:   true,
+}
+
 // Get all dealer freights.
-func getAllDealerFreight() (frS []dealerFreight, ok bool) {
-	err = sql3DB.Select(&frS, "SELECT * FROM dealer_freight ORDER BY dealer, weight, deadline")
-	if checkError(err) {
-		return frS, false
+func getAllDealerFreight() (frS []dealerFreight, err error) {
+	opt, err := parseListOptions(url.Values{}, dealerFreightList)
+	if err != nil {
+		return frS, err
 	}
-	return frS, true
+	frS, _, err = findDealerFreight(opt)
+	return frS, err
+}
+
+// Find dealer freights, total is the count without pagination.
+func findDealerFreight(opt listOptions) (frS []dealerFreight, total int, err error) {
+	frS = []dealerFreight{}
+	total, err = listRows(&frS, dealerFreightList, opt)
+	return frS, total, err
 }
 
 // Get dealer freight by dealer_location  and weight.
-func getDealerFreightByDealerLocationAndWeight(c chan *freightsOk, dealer string, weight int) {
+func getDealerFreightByDealerLocationAndWeight(ctx context.Context, c chan *freightsOk, dealer string, weight int) {
 	result := &freightsOk{
 		Freights: []*freight{},
 	}
@@ -27,21 +62,21 @@ func getDealerFreightByDealerLocationAndWeight(c chan *freightsOk, dealer string
 
 	// Inválid CEP origin.
 	if result.CEPOrigin == "" {
-		log.Printf("[warning] Could not get CEP origin for product dealer %v with weight of %v grams", dealer, weight)
+		logWarning(ctx, "Could not get CEP origin for product dealer %v with weight of %v grams", dealer, weight)
 		c <- result
 		return
 	}
 
 	// Inválid weight.
 	if weight == 0 {
-		log.Printf("[warning] Product delaer %v have an invalid weight of %v grams", dealer, weight)
+		logWarning(ctx, "Product delaer %v have an invalid weight of %v grams", dealer, weight)
 		c <- result
 		return
 	}
 
-	frs, ok := getDealerFreightByDealerAndWeight(dealer, weight)
+	frs, ok := getDealerFreightByDealerAndWeight(ctx, dealer, weight)
 	if !ok {
-		log.Printf("[warning] Not received valids freights for product delaer %v and weight of %v grams", dealer, weight)
+		logWarning(ctx, "Not received valids freights for product delaer %v and weight of %v grams", dealer, weight)
 		c <- result
 		return
 	}
@@ -59,30 +94,35 @@ func getDealerFreightByDealerLocationAndWeight(c chan *freightsOk, dealer string
 }
 
 // Get dealer freight by dealer and weight.
-func getDealerFreightByDealerAndWeight(dealer string, weight int) (frs []dealerFreight, ok bool) {
+func getDealerFreightByDealerAndWeight(ctx context.Context, dealer string, weight int) (frs []dealerFreight, ok bool) {
 	// Inváid weight.
 	if weight == 0 {
-		log.Printf("[warning] [dealer] Invalid product dealer %v with weight of %v grams", dealer, weight)
+		logWarning(ctx, "Invalid product dealer %v with weight of %v grams", dealer, weight)
+		return frs, false
+	}
+	// Rate version at quote time.
+	version, err := activeRateVersion(sql3DB, "dealer_freight", time.Now())
+	if checkError(ctx, err) {
 		return frs, false
 	}
 	// Select weight.
 	var weightSel int
-	err = sql3DB.Get(&weightSel, "SELECT CASE WHEN MIN(weight) IS NULL THEN 0 ELSE MIN(weight) END FROM dealer_freight WHERE dealer==? AND weight>=? ORDER BY deadline;", dealer, weight)
-	if checkError(err) {
-		log.Printf("[error] [dealer] getting freight by dealer and weight, prodcut dealer %v with weight of %v grams, error: %v", dealer, weight, err)
+	err = sql3DB.Get(&weightSel, "SELECT CASE WHEN MIN(weight) IS NULL THEN 0 ELSE MIN(weight) END FROM dealer_freight WHERE version_id=? AND dealer==? AND weight>=? ORDER BY deadline;", version, dealer, weight)
+	if err != nil {
+		logError(ctx, "Getting freight by dealer and weight, product dealer %v with weight of %v grams. %v", dealer, weight, err)
 		return frs, false
 	}
 	// log.Printf("SELECT CASE WHEN MIN(weight) IS NULL THEN 0 ELSE MIN(weight) END FROM dealer_freight WHERE dealer==%v AND weight>=%v ORDER BY deadline;", dealer, weight)
 	// log.Printf("weightSel: %v", weightSel)
 	// NULL from sqlite, no record for selected dealer and weight.
 	if weightSel == 0 {
-		log.Printf("[warning] [dealer] Getting freight by dealer and weight, product dealer %v with weight of %v grams not returned a weight limit", dealer, weight)
+		logWarning(ctx, "Getting freight by dealer and weight, product dealer %v with weight of %v grams not returned a weight limit", dealer, weight)
 		return frs, false
 	}
 
-	err = sql3DB.Select(&frs, "SELECT * FROM dealer_freight WHERE dealer=? AND weight==? ORDER BY deadline", dealer, weightSel)
-	if checkError(err) {
-		log.Printf("[error] [dealer] getting freight by dealer and weight, product dealer %v with weight of %v grams, weightSel: %v, error: %v", dealer, weight, weightSel, err)
+	err = sql3DB.Select(&frs, "SELECT * FROM dealer_freight WHERE version_id=? AND dealer=? AND weight==? ORDER BY deadline", version, dealer, weightSel)
+	if err != nil {
+		logError(ctx, "Getting freight by dealer and weight, product dealer %v with weight of %v grams, weightSel: %v. %v", dealer, weight, weightSel, err)
 		return frs, false
 	}
 	// log.Printf("getFreightRegionByRegionAndWeight: %+v", frs)
@@ -90,64 +130,163 @@ func getDealerFreightByDealerAndWeight(dealer string, weight int) (frs []dealerF
 }
 
 // Get dealer freight by id.
-func getDealerFreightById(id int) (fr dealerFreight, ok bool) {
+func getDealerFreightById(id int) (fr dealerFreight, err error) {
 	err = sql3DB.Get(&fr, "SELECT * FROM dealer_freight WHERE id=?", id)
 	// log.Printf("id: %v", id)
-	if checkError(err) {
-		return fr, false
+	if err == sql.ErrNoRows {
+		return fr, newNotFoundError(ERR_NOT_FOUND, "Dealer freight %d not found", id)
+	}
+	if err != nil {
+		return fr, newInternalError(err)
 	}
-	return fr, true
+	return fr, nil
 }
 
-// Create dealer freight.
-func createDealerFreight(fr *dealerFreight) bool {
-	stm := "INSERT INTO dealer_freight(dealer, weight, deadline, price) VALUES(?, ?, ?, ?)"
-	result, err := sql3DB.Exec(stm, strings.ToLower(fr.Dealer), fr.Weight, fr.Deadline, fr.Price)
-	if checkError(err) {
-		return false
-	}
-	rowsAffected, err := result.RowsAffected()
-	if checkError(err) {
-		return false
-	}
-	// log.Printf("iRowsAffected: %+v", iRowsAffected)
-	if rowsAffected == 0 {
-		checkError(errors.New("Inserting into dealer_freight table, no affected row."))
-		return false
+// Create dealer freight, audited by.
+func createDealerFreight(ctx context.Context, fr *dealerFreight, by *auditEntry) error {
+	if err := fr.Validate(ctx); err != nil {
+		return err
 	}
-	return true
+	return auditedChange(by, 0, AUDIT_CREATE, func(tx *sqlx.Tx) (int, error) {
+		version, err := editableRateVersion(tx, "dealer_freight", fr.VersionID)
+		if err != nil {
+			return 0, err
+		}
+		fr.VersionID = version
+		if err := fr.checkDuplicate(tx); err != nil {
+			return 0, err
+		}
+		stm := "INSERT INTO dealer_freight(version_id, dealer, weight, deadline, price) VALUES(?, ?, ?, ?, ?)"
+		result, err := tx.Exec(stm, fr.VersionID, fr.Dealer, fr.Weight, fr.Deadline, fr.Price)
+		if err != nil {
+			return 0, newDBError(err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		// log.Printf("iRowsAffected: %+v", iRowsAffected)
+		if rowsAffected == 0 {
+			return 0, newInternalError(errors.New("Inserting into dealer_freight table, no affected row."))
+		}
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		fr.ID = int(lastID)
+		return fr.ID, nil
+	})
 }
 
-// Update freight region.
-func updateDealerFreight(fr *dealerFreight) bool {
-	stm := "UPDATE dealer_freight SET dealer=?, weight=?, deadline=?, price=? WHERE id=?"
-	result, err := sql3DB.Exec(stm, fr.Dealer, fr.Weight, fr.Deadline, fr.Price, fr.ID)
-	if checkError(err) {
-		return false
-	}
-	rowsAffected, err := result.RowsAffected()
-	if checkError(err) {
-		return false
+// Update dealer freight, audited by.
+func updateDealerFreight(ctx context.Context, fr *dealerFreight, by *auditEntry) error {
+	if err := validateID(fr.ID); err != nil {
+		return err
 	}
-	if rowsAffected == 0 {
-		checkError(errors.New("Updateing dealer_freight table, no affected row."))
-		return false
+	if err := fr.Validate(ctx); err != nil {
+		return err
 	}
-	return true
+	return auditedChange(by, fr.ID, AUDIT_UPDATE, func(tx *sqlx.Tx) (int, error) {
+		version, err := editableRowVersion(tx, "dealer_freight", fr.ID)
+		if err != nil {
+			return 0, err
+		}
+		fr.VersionID = version
+		if err := fr.checkDuplicate(tx); err != nil {
+			return 0, err
+		}
+		stm := "UPDATE dealer_freight SET dealer=?, weight=?, deadline=?, price=? WHERE id=?"
+		result, err := tx.Exec(stm, fr.Dealer, fr.Weight, fr.Deadline, fr.Price, fr.ID)
+		if err != nil {
+			return 0, newDBError(err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		if rowsAffected == 0 {
+			return 0, newNotFoundError(ERR_NOT_FOUND, "Dealer freight %d not found", fr.ID)
+		}
+		return fr.ID, nil
+	})
 }
 
-// Delete freight region.
-func deleteDealerFreight(id int) bool {
+// Delete dealer freight, audited by.
+func deleteDealerFreight(id int, by *auditEntry) error {
 	// log.Printf("DELETE FROM dealer_freight WHERE id=%d", id)
-	stm := "DELETE FROM dealer_freight WHERE id=?"
-	result, err := sql3DB.Exec(stm, id)
-	if checkError(err) {
-		return false
+	return auditedChange(by, id, AUDIT_DELETE, func(tx *sqlx.Tx) (int, error) {
+		if _, err := editableRowVersion(tx, "dealer_freight", id); err != nil {
+			return 0, err
+		}
+		stm := "DELETE FROM dealer_freight WHERE id=?"
+		result, err := tx.Exec(stm, id)
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		if rowsAffected == 0 {
+			return 0, newNotFoundError(ERR_NOT_FOUND, "Dealer freight %d not found", id)
+		}
+		return id, nil
+	})
+}
+
+/**************************************************************************************************
+* CSV
+**************************************************************************************************/
+// Dealer freight csv.
+var dealerFreightCSV = csvTable{
+	name:   "dealer_freight",
+	header: []string{"dealer", "weight", "deadline", "price"},
+	parse: func(record []string) (csvRow, error) {
+		fes := fieldErrors{}
+		fr := &dealerFreight{
+			Dealer:   record[0],
+			Weight:   parseCSVInt(&fes, "weight", record[1]),
+			Deadline: parseCSVInt(&fes, "deadline", record[2]),
+			Price:    parseCSVInt(&fes, "price", record[3]),
+		}
+		return fr, fes.err()
+	},
+}
+
+// Csv record.
+func (fr *dealerFreight) csvRecord() []string {
+	return []string{fr.Dealer, strconv.Itoa(fr.Weight), strconv.Itoa(fr.Deadline), strconv.Itoa(fr.Price)}
+}
+
+// Unique key.
+func (fr *dealerFreight) csvKey() string {
+	return fmt.Sprintf("%s-%d-%d", fr.Dealer, fr.Weight, fr.Deadline)
+}
+
+// Insert or update price by dealer, weight and deadline in version.
+func (fr *dealerFreight) upsert(tx *sqlx.Tx, version int) (id int, action int, before types.JSONText, err error) {
+	saved := dealerFreight{}
+	err = tx.Get(&saved, "SELECT * FROM dealer_freight WHERE version_id=? AND dealer=? AND weight=? AND deadline=?", version, fr.Dealer, fr.Weight, fr.Deadline)
+	// Insert.
+	if err == sql.ErrNoRows {
+		result, err := tx.Exec("INSERT INTO dealer_freight(version_id, dealer, weight, deadline, price) VALUES(?, ?, ?, ?, ?)", version, fr.Dealer, fr.Weight, fr.Deadline, fr.Price)
+		if err != nil {
+			return id, action, before, err
+		}
+		lastID, err := result.LastInsertId()
+		return int(lastID), CSV_INSERTED, before, err
+	}
+	if err != nil {
+		return id, action, before, err
+	}
+	if saved.Price == fr.Price {
+		return saved.ID, CSV_UNCHANGED, before, nil
 	}
-	rowsAffected, err := result.RowsAffected()
-	if rowsAffected == 0 {
-		checkError(errors.New(fmt.Sprintf("No rows was affected by deleting freight id: %d from dealer_freight table", id)))
-		return false
+	// Update.
+	before, err = snapshotRow(tx, "dealer_freight", saved.ID)
+	if err != nil {
+		return id, action, before, err
 	}
-	return true
+	_, err = tx.Exec("UPDATE dealer_freight SET price=? WHERE id=?", fr.Price, saved.ID)
+	return saved.ID, CSV_UPDATED, before, err
 }
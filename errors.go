@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Error codes returned to clients.
+const (
+	ERR_INVALID_BODY       = "invalid_body"
+	ERR_INVALID_ID         = "invalid_id"
+	ERR_INVALID_QUERY      = "invalid_query"
+	ERR_INVALID_HEADER     = "invalid_header"
+	ERR_INVALID_CEP        = "invalid_cep"
+	ERR_INVALID_WEIGHT     = "invalid_weight"
+	ERR_INVALID_PRICE      = "invalid_price"
+	ERR_INVALID_DIMENSIONS = "invalid_dimensions"
+	ERR_INVALID_FIELDS     = "invalid_fields"
+	ERR_INVALID_REGION     = "invalid_region"
+	ERR_INVALID_DEALER     = "invalid_dealer"
+	ERR_INVALID_DEADLINE   = "invalid_deadline"
+	ERR_INVALID_CITY       = "invalid_city"
+	ERR_INVALID_VERSION    = "invalid_version"
+	ERR_INVALID_LOG_LEVEL  = "invalid_log_level"
+	ERR_REQUIRED           = "required"
+	ERR_CONFLICT           = "conflict"
+	ERR_FORBIDDEN          = "forbidden"
+	ERR_CORREIOS_LIMIT     = "correios_limit"
+	ERR_NOT_FOUND          = "not_found"
+	ERR_CEP_NOT_FOUND      = "cep_not_found"
+	ERR_PRODUCT_NOT_FOUND  = "product_not_found"
+	ERR_QUOTE_EXPIRED      = "quote_expired"
+	ERR_QUOTE_CHANGED      = "quote_changed"
+	ERR_RATE_LIMITED       = "rate_limited"
+	ERR_UPSTREAM           = "upstream_error"
+	ERR_UNAVAILABLE        = "unavailable"
+	ERR_INTERNAL           = "internal_error"
+)
+
+// Api error, sent to clients as json.
+type apiError struct {
+	Status    int          `json:"-"`
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Field     string       `json:"field,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"` // One for each invalid field.
+	Details   interface{}  `json:"details,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+	err       error        // Cause, only logged.
+}
+
+// Invalid field.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	msg := e.Code + ": " + e.Message
+	if e.Field != "" {
+		msg = e.Code + " [" + e.Field + "]: " + e.Message
+	}
+	for _, fe := range e.Errors {
+		msg += fmt.Sprintf(" (%s [%s]: %s)", fe.Code, fe.Field, fe.Message)
+	}
+	if e.err != nil {
+		msg += ". " + e.err.Error()
+	}
+	return msg
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+// Malformed request.
+func newBadRequestError(code string, format string, a ...interface{}) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Well formed request with invalid value.
+func newValidationError(field string, code string, format string, a ...interface{}) *apiError {
+	return &apiError{Status: http.StatusUnprocessableEntity, Code: code, Field: field, Message: fmt.Sprintf(format, a...)}
+}
+
+// Resource not found.
+func newNotFoundError(code string, format string, a ...interface{}) *apiError {
+	return &apiError{Status: http.StatusNotFound, Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Authenticated user without the role required.
+func newForbiddenError(format string, a ...interface{}) *apiError {
+	return &apiError{Status: http.StatusForbidden, Code: ERR_FORBIDDEN, Message: fmt.Sprintf(format, a...)}
+}
+
+// Resource already exist.
+func newConflictError(format string, a ...interface{}) *apiError {
+	return &apiError{Status: http.StatusConflict, Code: ERR_CONFLICT, Message: fmt.Sprintf(format, a...)}
+}
+
+// Quote can't be confirmed as reserved, details has the new quote if any.
+func newQuoteError(code string, details interface{}, format string, a ...interface{}) *apiError {
+	return &apiError{Status: http.StatusConflict, Code: code, Message: fmt.Sprintf(format, a...), Details: details}
+}
+
+// Too many requests, retry after wait.
+func newRateLimitError(wait time.Duration) *apiError {
+	return &apiError{Status: http.StatusTooManyRequests, Code: ERR_RATE_LIMITED, Message: fmt.Sprintf("Too many requests, retry after %.0fs", math.Ceil(wait.Seconds()))}
+}
+
+// Upstream service (Correios, ViaCEP, zunkasite) failed.
+func newUpstreamError(service string, err error) *apiError {
+	return &apiError{Status: http.StatusBadGateway, Code: ERR_UPSTREAM, Message: fmt.Sprintf("%s did not respond correctly", service), err: err}
+}
+
+// Service can't answer now.
+func newUnavailableError(format string, a ...interface{}) *apiError {
+	return &apiError{Status: http.StatusServiceUnavailable, Code: ERR_UNAVAILABLE, Message: fmt.Sprintf(format, a...)}
+}
+
+// Unexpected error.
+func newInternalError(err error) *apiError {
+	return &apiError{Status: http.StatusInternalServerError, Code: ERR_INTERNAL, Message: "Alguma coisa deu errado", err: err}
+}
+
+// Sqlite error, constraint violations are client errors.
+func newDBError(err error) *apiError {
+	if sqlErr, ok := err.(sqlite3.Error); ok {
+		switch sqlErr.ExtendedCode {
+		case sqlite3.ErrConstraintUnique:
+			aErr := newConflictError("Already exist")
+			aErr.err = err
+			return aErr
+		case sqlite3.ErrConstraintCheck:
+			aErr := newValidationError("", ERR_INVALID_FIELDS, "Invalid fields")
+			aErr.err = err
+			return aErr
+		}
+	}
+	return newInternalError(err)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Result of waiting callers if the call panics.
+var errFlightFailed = errors.New("shared call failed")
+
+// Calls in flight, concurrent callers with same key share the first call result.
+type flightGroup struct {
+	family string // Coalesced calls metric label.
+	mu     sync.Mutex
+	calls  map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{} // Closed when call finished.
+	val  interface{}
+	err  error
+}
+
+func newFlightGroup(family string) *flightGroup {
+	return &flightGroup{family: family, calls: map[string]*flightCall{}}
+}
+
+// Run fn once for concurrent callers with same key, shared is true for callers waiting another one call.
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	call, shared := g.join(key)
+	if shared {
+		<-call.done
+		return call.val, call.err, true
+	}
+	defer g.finish(key, call)
+	call.val, call.err = fn()
+	return call.val, call.err, false
+}
+
+// Like Do, but fn runs in background and each caller waits until the result or its ctx is done.
+// Callers giving up don't cancel the call, fn must use a context of its own.
+func (g *flightGroup) DoContext(ctx context.Context, key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	call, shared := g.join(key)
+	if !shared {
+		go func() {
+			defer g.finish(key, call)
+			defer func() {
+				if r := recover(); r != nil {
+					logError(ctx, "Shared %s call panicked. %v", g.family, r)
+				}
+			}()
+			call.val, call.err = fn()
+		}()
+	}
+	select {
+	case <-call.done:
+		return call.val, call.err, shared
+	case <-ctx.Done():
+		return nil, ctx.Err(), shared
+	}
+}
+
+// Call in flight for key, or a new one.
+func (g *flightGroup) join(key string) (call *flightCall, shared bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		coalescedCalls.inc(g.family)
+		return call, true
+	}
+	call = &flightCall{done: make(chan struct{}), err: errFlightFailed}
+	g.calls[key] = call
+	return call, false
+}
+
+func (g *flightGroup) finish(key string, call *flightCall) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(call.done)
+}
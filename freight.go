@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"regexp"
 	"strings"
 	"time"
@@ -12,7 +11,8 @@ type freight struct {
 	ServiceCode string  `json:"serviceCode"`
 	ServiceDesc string  `json:"serviceDesc"`
 	Price       float64 `json:"price"`
-	Deadline    int     `json:"deadline"` // Days.
+	Deadline    int     `json:"deadline"`        // Days.
+	Stale       bool    `json:"stale,omitempty"` // From cache after soft TTL, upstream not confirmed it.
 }
 
 type freightInfo struct {
@@ -26,12 +26,15 @@ type freightInfo struct {
 type freightsOk struct {
 	Freights   []*freight
 	Ok         bool
+	Err        error // Why not ok, if not a normal no result.
 	CEPOrigin  string
 	CEPDestiny string
+	Region     string // Destiny region, if looked up.
 }
 
 type regionFreight struct {
 	ID        int       `db:"id" json:"id"`
+	VersionID int       `db:"version_id" json:"versionId"` // Rate version, active version if 0.
 	Region    string    `db:"region" json:"region"`
 	Weight    int       `db:"weight" json:"weight"`     // g
 	Deadline  int       `db:"deadline" json:"deadline"` // days
@@ -42,6 +45,7 @@ type regionFreight struct {
 
 type motoboyFreight struct {
 	ID        int       `db:"id" json:"id"`
+	VersionID int       `db:"version_id" json:"versionId"` // Rate version, active version if 0.
 	State     string    `db:"state" json:"-"`
 	City      string    `db:"city" json:"city"`
 	CityNorm  string    `db:"city_norm" json:"-"`       // Normalized city
@@ -53,6 +57,7 @@ type motoboyFreight struct {
 
 type dealerFreight struct {
 	ID        int       `db:"id" json:"id"`
+	VersionID int       `db:"version_id" json:"versionId"` // Rate version, active version if 0.
 	Dealer    string    `db:"dealer" json:"dealer"`
 	Weight    int       `db:"weight" json:"weight"`     // g
 	Deadline  int       `db:"deadline" json:"deadline"` // days
@@ -73,52 +78,52 @@ type pack struct {
 	Price         float64 `json:"price"`  // R$.
 }
 
-func (p *pack) Validate() bool {
-
+// Validate CEP "00000000" or "00000-000".
+func validateCEP(field string, cep string) error {
 	regCep := regexp.MustCompile(`^[0-9]{8}$`)
+	if !regCep.MatchString(strings.ReplaceAll(cep, "-", "")) {
+		return newValidationError(field, ERR_INVALID_CEP, "Invalid CEP: %v", cep)
+	}
+	return nil
+}
 
+func (p *pack) Validate() error {
 	// Origin CEP.
 	p.CEPOrigin = strings.ReplaceAll(p.CEPOrigin, "-", "")
 	if p.CEPOrigin == "" {
 		p.CEPOrigin = CEP_ORIGIN
 	}
-	if !regCep.MatchString(p.CEPOrigin) {
-		log.Printf("[warning] Invalid CEP origin: %v", p.CEPOrigin)
-		return false
+	if err := validateCEP("cepOrigin", p.CEPOrigin); err != nil {
+		return err
 	}
 
 	// Destiny CEP.
 	p.CEPDestiny = strings.ReplaceAll(p.CEPDestiny, "-", "")
-	if !regCep.MatchString(p.CEPDestiny) {
-		log.Printf("[warning] Invalid CEP destiny: %v", p.CEPDestiny)
-		return false
+	if err := validateCEP("cepDestiny", p.CEPDestiny); err != nil {
+		return err
 	}
 
 	// Weight in kg.
-	minWeight := 1
-	maxWeight := 50000
+	minWeight := cfg.Pack.MinWeight
+	maxWeight := cfg.Pack.MaxWeight
 	if p.Weight < minWeight {
-		log.Printf("[warning] Invalid weight of %v grams. Must be more than %v grams", p.Weight, minWeight)
-		return false
+		return newValidationError("weight", ERR_INVALID_WEIGHT, "Invalid weight of %v grams. Must be more than %v grams", p.Weight, minWeight)
 	}
 	if p.Weight > maxWeight {
-		log.Printf("[warning] Invalid weight of %v grams. Must be less than %v grams", p.Weight, maxWeight)
-		return false
+		return newValidationError("weight", ERR_INVALID_WEIGHT, "Invalid weight of %v grams. Must be less than %v grams", p.Weight, maxWeight)
 	}
 
 	// Price in R$.
-	minPrice := 1.0
-	maxPrice := 1000000.0
+	minPrice := cfg.Pack.MinPrice
+	maxPrice := cfg.Pack.MaxPrice
 	if p.Price < minPrice {
-		log.Printf("[warning] Invalid price of R$ %v. Must be more than R$ %v", p.Price, minPrice)
-		return false
+		return newValidationError("price", ERR_INVALID_PRICE, "Invalid price of R$ %v. Must be more than R$ %v", p.Price, minPrice)
 	}
 	if p.Price > maxPrice {
-		log.Printf("[warning] Invalid price of R$ %v. Must be less than R$ %v", p.Price, maxPrice)
-		return false
+		return newValidationError("price", ERR_INVALID_PRICE, "Invalid price of R$ %v. Must be less than R$ %v", p.Price, maxPrice)
 	}
 
-	return true
+	return nil
 }
 
 type zunkaProducts struct {
@@ -139,6 +144,31 @@ type zunkaProduct struct {
 	Price         float64 `json:"price"` // R$.
 }
 
+// Validate product measurements and price.
+func (zp *zunkaProduct) Validate() error {
+	// Invalid lenght.
+	if zp.Length == 0 {
+		return newValidationError("length", ERR_INVALID_DIMENSIONS, "Invalid product [%v] length [%v]", zp.ID, zp.Length)
+	}
+	// Invalid width.
+	if zp.Width == 0 {
+		return newValidationError("width", ERR_INVALID_DIMENSIONS, "Invalid product [%v] width [%v]", zp.ID, zp.Width)
+	}
+	// Invalid height.
+	if zp.Height == 0 {
+		return newValidationError("height", ERR_INVALID_DIMENSIONS, "Invalid product [%v] height [%v]", zp.ID, zp.Height)
+	}
+	// Invalid weight.
+	if zp.Weight == 0 {
+		return newValidationError("weight", ERR_INVALID_WEIGHT, "Invalid product [%v] weight [%v]", zp.ID, zp.Weight)
+	}
+	// Invalid price.
+	if zp.Price < cfg.Pack.MinPrice || zp.Price > cfg.Pack.MaxPrice {
+		return newValidationError("price", ERR_INVALID_PRICE, "Invalid product [%v] price [%v]", zp.ID, zp.Price)
+	}
+	return nil
+}
+
 // Zoom freight request.
 type zoomFregihtRequest struct {
 	Zipcode string                   `json:"zipcode"` // Dealer.
@@ -160,6 +190,7 @@ type zoomFregihtRequestItem struct {
 type zoomFregihtResponse struct {
 	ID        string                `json:"id"`        // Dealer.
 	Estimates []zoomFregihtEstimate `json:"estimates"` // cm.
+	TimedOut  []string              `json:"timedOut"`  // Providers not answered in quote budget.
 }
 
 // Zoom freight request.
@@ -7,5 +7,7 @@ require (
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/mattn/go-sqlite3 v1.14.3
-	golang.org/x/text v0.3.2
+	golang.org/x/crypto v0.14.0
+	golang.org/x/text v0.13.0
+	gopkg.in/yaml.v2 v2.4.0
 )
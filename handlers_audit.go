@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Audit entries, ?entity=freight_region&user=zunkasite&from=2020-01-01&to=2020-01-31.
+func getAuditHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	// Filter, sort and pagination.
+	opt, err := parseListOptions(req.URL.Query(), auditList)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	// Get data.
+	entries, total, err := findAudit(opt)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	// Convert to json.
+	entriesJSON, err := json.Marshal(entries)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	// Send response.
+	setTotalCountHeader(w, total)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(entriesJSON)
+}
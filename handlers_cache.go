@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Cache families with keys count and memory use.
+func getCacheStatsHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	stats, err := getCacheStats()
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeCacheJSON(w, req, stats)
+}
+
+// Cached Correios freights, ?cepOrigin=31170210&cepDestiny=01001000&length=20&width=15&height=10&weight=1000&price=100.
+func getCorreiosCacheHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	query := req.URL.Query()
+	p := pack{CEPOrigin: query.Get("cepOrigin"), CEPDestiny: query.Get("cepDestiny")}
+	names := []string{"length", "width", "height", "weight"}
+	for i, dest := range []*int{&p.Length, &p.Width, &p.Height, &p.Weight} {
+		val, err := strconv.Atoi(query.Get(names[i]))
+		if err != nil {
+			writeError(w, req, newBadRequestError(ERR_INVALID_QUERY, "Invalid %s: %s", names[i], query.Get(names[i])))
+			return
+		}
+		*dest = val
+	}
+	price, err := strconv.ParseFloat(query.Get("price"), 64)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_QUERY, "Invalid price: %s", query.Get("price")))
+		return
+	}
+	p.Price = price
+	lookup, err := lookupCorreiosCache(p)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeCacheJSON(w, req, lookup)
+}
+
+// Purge cache, ?family=correios, ?cep=31170 for keys by destination CEP prefix or both.
+func purgeCacheHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	family := req.URL.Query().Get("family")
+	cep := req.URL.Query().Get("cep")
+	deleted, err := purgeCache(family, cep)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	logInfo(req.Context(), "Cache purged by %s, family: %q, cep: %q, %d key(s) deleted", authUser(req), family, cep, deleted)
+	writeCacheJSON(w, req, map[string]int{"deleted": deleted})
+}
+
+func writeCacheJSON(w http.ResponseWriter, req *http.Request, v interface{}) {
+	vJSON, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(vJSON)
+}
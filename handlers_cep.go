@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -14,23 +13,23 @@ import (
 func addressHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		log.Printf("Error reading body: %v", err)
+		logWarning(req.Context(), "Reading body. %v", err)
 		http.Error(w, "can't read body", http.StatusBadRequest)
 		return
 	}
 	cep := string(body)
 	// log.Printf("body: %s", cep)
 
-	address, err := getAddressByCEP(cep)
+	address, err := getAddressByCEP(req.Context(), cep)
 	if err != nil {
-		log.Printf("Getting address from CEP %s. %v", cep, err)
+		logWarning(req.Context(), "Getting address from CEP %s. %v", cep, err)
 		http.Error(w, fmt.Sprintf("Can't get address from CEP %s", cep), http.StatusBadRequest)
 		return
 	}
 
 	addressJSON, err := json.Marshal(address)
 	if err != nil {
-		log.Printf("Getting address from CEP %s. %v", cep, err)
+		logError(req.Context(), "Getting address from CEP %s. %v", cep, err)
 		http.Error(w, "Internal error", http.StatusBadRequest)
 		return
 	}
@@ -14,21 +14,21 @@ func createDealerFreightHandler(w http.ResponseWriter, req *http.Request, ps htt
 	// Data.
 	fr := dealerFreight{}
 	body, err := ioutil.ReadAll(req.Body)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
 		return
 	}
 	// log.Printf("body: %v\n", string(body))
 	err = json.Unmarshal(body, &fr)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
 		return
 	}
 
 	// Create.
-	ok := createDealerFreight(&fr)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	err = createDealerFreight(req.Context(), &fr, newAuditEntry(req, "dealer_freight", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	w.WriteHeader(200)
@@ -36,19 +36,26 @@ func createDealerFreightHandler(w http.ResponseWriter, req *http.Request, ps htt
 
 // All dealer freights.
 func getAllDealerFreightHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	// Filter, sort and pagination.
+	opt, err := parseListOptions(req.URL.Query(), dealerFreightList)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
 	// Get data.
-	freights, ok := getAllDealerFreight()
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	freights, total, err := findDealerFreight(opt)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Convert to json.
 	freightJSON, err := json.Marshal(freights)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Send response.
+	setTotalCountHeader(w, total)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(freightJSON)
 }
@@ -58,21 +65,21 @@ func getOneDealerFreightHandler(w http.ResponseWriter, req *http.Request, ps htt
 	// log.Printf("*** GET *** %v\n", ps.ByName("id"))
 	// Get id.
 	id, err := strconv.Atoi(ps.ByName("id"))
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_ID, "Invalid id: %v", ps.ByName("id")))
 		return
 	}
 
 	// Get data.
-	fr, ok := getDealerFreightById(id)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	fr, err := getDealerFreightById(id)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Convert to json.
 	frJSON, err := json.Marshal(fr)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Send response.
@@ -85,21 +92,21 @@ func updateDealerFreightHandler(w http.ResponseWriter, req *http.Request, ps htt
 	// Data.
 	fr := dealerFreight{}
 	body, err := ioutil.ReadAll(req.Body)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
 		return
 	}
 	// log.Printf("body: %v\n", string(body))
 	err = json.Unmarshal(body, &fr)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
 		return
 	}
 
 	// Update.
-	ok := updateDealerFreight(&fr)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	err = updateDealerFreight(req.Context(), &fr, newAuditEntry(req, "dealer_freight", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	w.WriteHeader(200)
@@ -108,15 +115,39 @@ func updateDealerFreightHandler(w http.ResponseWriter, req *http.Request, ps htt
 // Delete dealer freight.
 func deleteDealerFreightHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	id, err := strconv.Atoi(ps.ByName("id"))
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_ID, "Invalid id: %v", ps.ByName("id")))
 		return
 	}
 	// Delete.
-	ok := deleteDealerFreight(id)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	err = deleteDealerFreight(id, newAuditEntry(req, "dealer_freight", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	w.WriteHeader(200)
 }
+
+// Export dealer freights as csv, same filters and sort as list.
+func exportDealerFreightCSVHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	opt, err := parseListOptions(req.URL.Query(), dealerFreightList)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	freights, _, err := findDealerFreight(opt)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	records := [][]string{}
+	for i := range freights {
+		records = append(records, freights[i].csvRecord())
+	}
+	writeCSV(w, "dealer_freight.csv", dealerFreightCSV.header, records)
+}
+
+// Import dealer freights from csv.
+func importDealerFreightCSVHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	handleCSVImport(w, req, dealerFreightCSV)
+}
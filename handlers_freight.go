@@ -2,11 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"sort"
 	"strconv"
@@ -16,33 +16,71 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
-// Freight by product for Zunka.
+// Freight by product for Zunka, ?reserve=true or ?reserve=minutes to lock prices until checkout.
 func freightsZunkaHandlerV2(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	reserve, err := parseReserve(req.URL.Query().Get("reserve"))
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	detail, err := parseDetail(req.URL.Query().Get("detail"))
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	ctx, cancel, err := quoteContext(req)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	defer cancel()
 	body, err := ioutil.ReadAll(req.Body)
-	if checkError(err) {
-		http.Error(w, "Error reading body", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
 		return
 	}
 	// log.Printf("body: %s", string(body))
 	productsIn := zunkaProducts{}
 
 	err = json.Unmarshal(body, &productsIn)
-	if checkError(err) {
-		http.Error(w, fmt.Sprintf("Error unmarshalling body: %v", body), http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
 		return
 	}
 	// log.Printf("[debug] products zunka: %+v", productsIn)
 
 	// Get freights by products
-	frsOut, ok := getFreightsByProducts(productsIn)
-	if !ok {
-		http.Error(w, "Could not getting freights", http.StatusInternalServerError)
-		return
+	trace := quoteTrace{Packs: []pack{}, Providers: []quoteProvider{}}
+	frsOut, err := getFreightsByProducts(ctx, productsIn, &trace)
+	setTimedOutHeader(w, &trace)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	// Response keeps the freights list, quote id in header.
+	quoteID := saveQuote(req, QUOTE_ZUNKA, productsIn.CepDestiny, body, &trace, frsOut)
+	recordQuoteStats(req.Context(), QUOTE_ZUNKA, &trace, frsOut)
+	observeWarmPacks(trace.Packs)
+	w.Header().Set("X-Quote-ID", quoteID)
+	if reserve > 0 {
+		expiresAt, err := reserveQuote(quoteID, frsOut, reserve)
+		if err != nil {
+			// Checkout will quote again at confirmation.
+			logError(req.Context(), "Reserving quote %s. %v", quoteID, err)
+		} else {
+			w.Header().Set("X-Reservation-ID", quoteID)
+			w.Header().Set("X-Reservation-Expires", expiresAt.In(brLocation).Format(time.RFC3339))
+		}
 	}
 
-	frsJson, err := json.Marshal(frsOut)
+	var frsJson []byte
+	if detail {
+		frsJson, err = json.Marshal(zunkaFreightsDetail{Freights: frsOut, TimedOut: trace.timedOut()})
+	} else {
+		frsJson, err = json.Marshal(frsOut)
+	}
 	if err != nil {
-		HandleError(w, err)
+		writeError(w, req, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -52,18 +90,24 @@ func freightsZunkaHandlerV2(w http.ResponseWriter, req *http.Request, ps httprou
 
 // Zoom freights.
 func freightsZoomHandlerV2(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	ctx, cancel, err := quoteContext(req)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	defer cancel()
 	// Get products ids and destiny CEP.
 	body, err := ioutil.ReadAll(req.Body)
-	if checkError(err) {
-		http.Error(w, "can't read body", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
 		return
 	}
 	// log.Printf("body: %s", string(body))
 	// log.Printf("[debug] zoom freight request: %s", body)
 	fRequest := zoomFregihtRequest{}
 	err = json.Unmarshal(body, &fRequest)
-	if checkError(err) {
-		http.Error(w, "Error unmarshalling body", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
 		return
 	}
 
@@ -76,60 +120,56 @@ func freightsZoomHandlerV2(w http.ResponseWriter, req *http.Request, ps httprout
 	}
 	// Products ids request.
 	reqBody, err := json.Marshal(prodIds)
-	if checkError(err) {
-		http.Error(w, "Error marshalling products ids.", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// log.Printf("reqBody: %s", reqBody)
 	// start := time.Now()
-	client := &http.Client{}
-	req, err = http.NewRequest("GET", zunkaSiteHost()+"/setup/product-info", bytes.NewBuffer(reqBody))
-	req.Header.Set("Content-Type", "application/json")
-	if checkError(err) {
-		http.Error(w, "Error creating request to zunkasite", http.StatusInternalServerError)
+	zReq, err := http.NewRequestWithContext(ctx, "GET", zunkaSiteHost()+"/setup/product-info", bytes.NewBuffer(reqBody))
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
-	req.SetBasicAuth(zunkaSiteUser(), zunkaSitePass())
-	res, err := client.Do(req)
-	if checkError(err) {
-		http.Error(w, "Error requesting products information to zunkasite.", http.StatusInternalServerError)
+	zReq.Header.Set("Content-Type", "application/json")
+	zReq.SetBasicAuth(zunkaSiteUser(), zunkaSitePass())
+	res, err := doUpstream(UPSTREAM_ZUNKASITE, zReq, true)
+	if err != nil {
+		writeError(w, req, newUpstreamError("zunkasite", err))
 		return
 	}
 	defer res.Body.Close()
 	// Result.
 	resBody, err := ioutil.ReadAll(res.Body)
-	if checkError(err) {
-		http.Error(w, "Error reading body from zunkasite response.", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newUpstreamError("zunkasite", err))
 		return
 	}
 	// log.Printf("[debug] Requesting product information from zunkasite, response time: %.3fs", time.Since(start).Seconds())
 	// log.Printf("resBody: %s", resBody)
 	// Bad request.
 	if res.StatusCode == 400 {
-		log.Printf("[warn] Requesting product information from zunkasite, status: %v, body: %v", res.StatusCode, string(resBody))
-		http.Error(w, string(resBody), http.StatusBadRequest)
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "%s", strings.TrimSpace(string(resBody))))
 		return
 	}
 	// No 200 status.
 	if res.StatusCode != 200 {
 		err = errors.New(fmt.Sprintf("Error requesting product information from zunkasite.\n\nstatus: %v\n\nbody: %v", res.StatusCode, string(resBody)))
-		if checkError(err) {
-			http.Error(w, "Error requesting product information from zunkasite.", http.StatusInternalServerError)
-			return
-		}
+		writeError(w, req, newUpstreamError("zunkasite", err))
+		return
 	}
 
 	// Products informartions returned by zoom site.
 	zProducts := []zunkaProduct{}
 	// log.Printf("[debug] resBody: %v", resBody)
 	err = json.Unmarshal(resBody, &zProducts)
-	if checkError(err) {
-		http.Error(w, "Can't read body from zunka.", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newUpstreamError("zunkasite", err))
 		return
 	}
 	// log.Printf("zProducts: %+v", zProducts)
 	if len(zProducts) != len(prodIds.Ids) {
-		http.Error(w, "Some of product(s) was not found.", http.StatusBadRequest)
+		writeError(w, req, newNotFoundError(ERR_PRODUCT_NOT_FOUND, "Some of product(s) was not found."))
 		return
 	}
 
@@ -147,9 +187,11 @@ func freightsZoomHandlerV2(w http.ResponseWriter, req *http.Request, ps httprout
 	}
 	// log.Printf("products after update quantity: %+v", products)
 
-	frsOut, ok := getFreightsByProducts(products)
-	if !ok {
-		http.Error(w, "Could not getting freights", http.StatusInternalServerError)
+	trace := quoteTrace{Packs: []pack{}, Providers: []quoteProvider{}}
+	frsOut, err := getFreightsByProducts(ctx, products, &trace)
+	setTimedOutHeader(w, &trace)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 
@@ -161,6 +203,8 @@ func freightsZoomHandlerV2(w http.ResponseWriter, req *http.Request, ps httprout
 		}
 	}
 	frsOut = temp
+	recordQuoteStats(req.Context(), QUOTE_ZOOM, &trace, frsOut)
+	observeWarmPacks(trace.Packs)
 
 	// Convert to zoom freight
 	zoomFrEst := []zoomFregihtEstimate{}
@@ -176,14 +220,15 @@ func freightsZoomHandlerV2(w http.ResponseWriter, req *http.Request, ps httprout
 
 	// Zoom freight type message
 	zoomFrResponse := zoomFregihtResponse{
-		ID:        strconv.FormatInt(time.Now().Unix(), 10),
+		ID:        saveQuote(req, QUOTE_ZOOM, fRequest.Zipcode, body, &trace, zoomFrEst),
 		Estimates: zoomFrEst,
+		TimedOut:  trace.timedOut(),
 	}
 
 	// log.Printf("zoomFrEst: %v", zoomFrEst)
 	zoomFrResponseJSON, err := json.Marshal(zoomFrResponse)
 	if err != nil {
-		HandleError(w, err)
+		writeError(w, req, err)
 		return
 	}
 	// log.Printf("[debug] zoom freight response: %v", string(zoomFrResponseJSON))
@@ -204,15 +249,15 @@ func freightsZoomHandlerV2(w http.ResponseWriter, req *http.Request, ps httprout
 // Freight for Zunka.
 func freightsZunkaHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	body, err := ioutil.ReadAll(req.Body)
-	if checkError(err) {
-		http.Error(w, "Error reading body: %v", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
 		return
 	}
 	// log.Printf("body: %s", string(body))
 	p := pack{}
 	err = json.Unmarshal(body, &p)
-	if checkError(err) {
-		http.Error(w, "Error unmarshalling body: %v", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
 		return
 	}
 	// log.Printf("[debug] Pack zunka handler: %+v", p)
@@ -230,15 +275,15 @@ func freightsZunkaHandler(w http.ResponseWriter, req *http.Request, ps httproute
 
 	// Correios
 	cCorreios := make(chan *freightsOk)
-	go getCorreiosFreightByPack(cCorreios, &p)
+	go getCorreiosFreightByPack(req.Context(), cCorreios, &p)
 
 	// Motoboy.
 	cMotoboy := make(chan *freightsOk)
-	go getMotoboyFreightByCEP(cMotoboy, p.CEPDestiny)
+	go getMotoboyFreightByCEP(req.Context(), cMotoboy, p.CEPDestiny)
 
 	// Region.
 	cRegion := make(chan *freightsOk)
-	go getFreightRegionByCEPAndWeight(cRegion, p.CEPDestiny, p.Weight)
+	go getFreightRegionByCEPAndWeight(req.Context(), cRegion, p.CEPDestiny, p.Weight)
 
 	frsOkMotoboy, frsOkCorreios, frsOkRegion := <-cMotoboy, <-cCorreios, <-cRegion
 
@@ -282,7 +327,7 @@ func freightsZunkaHandler(w http.ResponseWriter, req *http.Request, ps httproute
 
 	frInfoSJson, err := json.Marshal(frInfoS)
 	if err != nil {
-		HandleError(w, err)
+		writeError(w, req, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -293,16 +338,16 @@ func freightsZunkaHandler(w http.ResponseWriter, req *http.Request, ps httproute
 func freightsZoomHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	// Get products ids and CEP.
 	body, err := ioutil.ReadAll(req.Body)
-	if checkError(err) {
-		http.Error(w, "can't read body", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
 		return
 	}
 	// log.Printf("body: %s", string(body))
 	// log.Printf("[debug] zoom freight request: %s", body)
 	fRequest := zoomFregihtRequest{}
 	err = json.Unmarshal(body, &fRequest)
-	if checkError(err) {
-		http.Error(w, "Error unmarshalling body", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
 		return
 	}
 	// Get products information.
@@ -314,78 +359,74 @@ func freightsZoomHandler(w http.ResponseWriter, req *http.Request, ps httprouter
 	}
 	// Products ids request.
 	reqBody, err := json.Marshal(prodIds)
-	if checkError(err) {
-		http.Error(w, "Error marshalling products ids.", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// log.Printf("reqBody: %s", reqBody)
 	start := time.Now()
-	client := &http.Client{}
-	req, err = http.NewRequest("GET", zunkaSiteHost()+"/setup/product-info", bytes.NewBuffer(reqBody))
-	req.Header.Set("Content-Type", "application/json")
-	if checkError(err) {
-		http.Error(w, "Error creating request to zunkasite", http.StatusInternalServerError)
+	zReq, err := http.NewRequestWithContext(req.Context(), "GET", zunkaSiteHost()+"/setup/product-info", bytes.NewBuffer(reqBody))
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
-	req.SetBasicAuth(zunkaSiteUser(), zunkaSitePass())
-	res, err := client.Do(req)
-	if checkError(err) {
-		http.Error(w, "Error requesting products information to zunkasite.", http.StatusInternalServerError)
+	zReq.Header.Set("Content-Type", "application/json")
+	zReq.SetBasicAuth(zunkaSiteUser(), zunkaSitePass())
+	res, err := doUpstream(UPSTREAM_ZUNKASITE, zReq, true)
+	if err != nil {
+		writeError(w, req, newUpstreamError("zunkasite", err))
 		return
 	}
 	defer res.Body.Close()
 	// Result.
 	resBody, err := ioutil.ReadAll(res.Body)
-	if checkError(err) {
-		http.Error(w, "Error reading body from zunkasite response.", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newUpstreamError("zunkasite", err))
 		return
 	}
-	log.Printf("[debug] Requesting product information from zunkasite, response time: %.3fs", time.Since(start).Seconds())
+	logDebug(req.Context(), "Requesting product information from zunkasite, response time: %.3fs", time.Since(start).Seconds())
 	// log.Printf("resBody: %s", resBody)
 	// Bad request.
 	if res.StatusCode == 400 {
-		log.Printf("[warn] Requesting product information from zunkasite, status: %v, body: %v", res.StatusCode, string(resBody))
-		http.Error(w, string(resBody), http.StatusBadRequest)
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "%s", strings.TrimSpace(string(resBody))))
 		return
 	}
 	// No 200 status.
 	if res.StatusCode != 200 {
 		err = errors.New(fmt.Sprintf("Error requesting product information from zunkasite.\n\nstatus: %v\n\nbody: %v", res.StatusCode, string(resBody)))
-		if checkError(err) {
-			http.Error(w, "Error requesting product information from zunkasite.", http.StatusInternalServerError)
-			return
-		}
+		writeError(w, req, newUpstreamError("zunkasite", err))
+		return
 	}
 
 	// Products informartions returned by zoom site.
 	zProducts := []zunkaProduct{}
 	// log.Printf("[debug] resBody: %v", resBody)
 	err = json.Unmarshal(resBody, &zProducts)
-	if checkError(err) {
-		http.Error(w, "Can't read body from zunka.", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newUpstreamError("zunkasite", err))
 		return
 	}
 	// log.Printf("zProducts: %v", zProducts)
 	if len(zProducts) != len(prodIds.Ids) {
-		http.Error(w, "Some of product(s) was not found.", http.StatusBadRequest)
+		writeError(w, req, newNotFoundError(ERR_PRODUCT_NOT_FOUND, "Some of product(s) was not found."))
 		return
 	}
 
 	// Create pack.
-	p, ok := createPack(zProducts, fRequest.Zipcode)
+	p, ok := createPack(req.Context(), zProducts, fRequest.Zipcode)
 	if !ok {
-		http.Error(w, "Invalid product dimensions.", http.StatusInternalServerError)
+		writeError(w, req, newValidationError("items", ERR_INVALID_DIMENSIONS, "Invalid product dimensions."))
 		return
 	}
 	// log.Printf("[debug] Pack zoom handler: %+v\n", p)
 
 	// Correios
 	cCorreios := make(chan *freightsOk)
-	go getCorreiosFreightByPack(cCorreios, &p)
+	go getCorreiosFreightByPack(req.Context(), cCorreios, &p)
 
 	// Region.
 	cRegion := make(chan *freightsOk)
-	go getFreightRegionByCEPAndWeight(cRegion, p.CEPDestiny, p.Weight)
+	go getFreightRegionByCEPAndWeight(req.Context(), cRegion, p.CEPDestiny, p.Weight)
 
 	frsOkCorreios, frsOkRegion := <-cCorreios, <-cRegion
 
@@ -424,10 +465,10 @@ func freightsZoomHandler(w http.ResponseWriter, req *http.Request, ps httprouter
 	// log.Printf("zoomFrEst: %v", zoomFrEst)
 	zoomFrResponseJSON, err := json.Marshal(zoomFrResponse)
 	if err != nil {
-		HandleError(w, err)
+		writeError(w, req, err)
 		return
 	}
-	log.Printf("[debug] zoom freight response: %v", string(zoomFrResponseJSON))
+	logDebug(req.Context(), "Zoom freight response: %v", string(zoomFrResponseJSON))
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(zoomFrResponseJSON)
 
@@ -452,25 +493,8 @@ func createPackV2(CEPOrigin string, CEPDestiny string, products []zunkaProduct)
 	p.CEPDestiny = CEPDestiny
 	// Products loop.
 	for _, product := range products {
-		// Invalid lenght.
-		if product.Length == 0 {
-			return p, fmt.Errorf("Invalid product [%v] length [%v].", product.ID, product.Length)
-		}
-		// Invalid width.
-		if product.Width == 0 {
-			return p, fmt.Errorf("Invalid product [%v] width [%v].", product.ID, product.Width)
-		}
-		// Invalid height.
-		if product.Height == 0 {
-			return p, fmt.Errorf("Invalid product [%v] height [%v].", product.ID, product.Height)
-		}
-		// Invalid weight.
-		if product.Weight == 0 {
-			return p, fmt.Errorf("Invalid product [%v] weight [%v].", product.ID, product.Weight)
-		}
-		// Invalid price.
-		if product.Price < 1.0 || product.Price > 1000000.0 {
-			return p, fmt.Errorf("Invalid product [%v] price [%v].", product.ID, product.Price)
+		if err = product.Validate(); err != nil {
+			return p, err
 		}
 
 		// Delaer
@@ -501,7 +525,7 @@ func createPackV2(CEPOrigin string, CEPDestiny string, products []zunkaProduct)
 }
 
 // Create pack.
-func createPack(products []zunkaProduct, CEPDestiny string) (p pack, ok bool) {
+func createPack(ctx context.Context, products []zunkaProduct, CEPDestiny string) (p pack, ok bool) {
 	if len(products) == 0 {
 		return
 	}
@@ -510,12 +534,12 @@ func createPack(products []zunkaProduct, CEPDestiny string) (p pack, ok bool) {
 	for _, product := range products {
 		// Invalid measurments.
 		if product.Length == 0 || product.Width == 0 || product.Height == 0 || product.Weight == 0 || product.Price == 0 {
-			checkError(fmt.Errorf("Invalid product dimensions: %v", product))
+			logWarning(ctx, "Invalid product dimensions: %v", product)
 			return
 		}
 		// Invalid price.
 		if product.Price < 1.0 || product.Price > 1000000.0 {
-			checkError(fmt.Errorf("Invalid product price: %v", product))
+			logWarning(ctx, "Invalid product price: %v", product)
 			return
 		}
 		// Price.
@@ -545,38 +569,22 @@ func createPack(products []zunkaProduct, CEPDestiny string) (p pack, ok bool) {
 	return p, true
 }
 
-// Get freights by products.
-func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool) {
+// Get freights by products, packs and providers results are added to trace if not nil.
+func getFreightsByProducts(ctx context.Context, productsIn zunkaProducts, trace *quoteTrace) (frsOut []*freight, err error) {
+	if len(productsIn.Products) == 0 {
+		return frsOut, newValidationError("products", ERR_INVALID_BODY, "No products")
+	}
 	// Products list for each dealer location.
 	dealerProductsMap := make(map[string][]zunkaProduct)
-	for _, product := range productsIn.Products {
-		if product.Dealer == "Aldo" || product.Dealer == "Allnations" {
-			// Invalid lenght.
-			if product.Length == 0 {
-				log.Printf("Invalid product [%v] length [%v]", product.ID, product.Length)
-				return
-			}
-			// Invalid width.
-			if product.Width == 0 {
-				log.Printf("Invalid product [%v] width [%v].", product.ID, product.Width)
-				return
+	for i, product := range productsIn.Products {
+		if err = product.Validate(); err != nil {
+			var aErr *apiError
+			if errors.As(err, &aErr) {
+				aErr.Field = fmt.Sprintf("products[%d].%s", i, aErr.Field)
 			}
-			// Invalid height.
-			if product.Height == 0 {
-				log.Printf("Invalid product [%v] height [%v].", product.ID, product.Height)
-				return
-			}
-			// Invalid weight.
-			if product.Weight == 0 {
-				log.Printf("Invalid product [%v] weight [%v].", product.ID, product.Weight)
-				return
-			}
-			// Invalid price.
-			if product.Price < 1.0 || product.Price > 1000000.0 {
-				log.Printf("Invalid product [%v] price [%v].", product.ID, product.Price)
-				return
-			}
-
+			return frsOut, err
+		}
+		if product.Dealer == "Aldo" || product.Dealer == "Allnations" {
 			dealer := strings.ToLower(product.Dealer)
 			if product.StockLocation != "" {
 				dealer = dealer + "_" + strings.ToLower(product.StockLocation)
@@ -595,8 +603,12 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 	// Zunka to client.
 	zunkaToClientPack, err := createPackV2(CEP_ZUNKA, productsIn.CepDestiny, productsIn.Products)
 	// log.Printf("Zunka pack: %+v\n\n", zunkaToClientPack)
-	if checkError(err) {
-		return
+	if err != nil {
+		return frsOut, err
+	}
+	// Invalid CEP from client.
+	if err = validateCEP("cepDestiny", zunkaToClientPack.CEPDestiny); err != nil {
+		return frsOut, err
 	}
 	// Dealer to zunka.
 	dealerPacks := []pack{}
@@ -608,46 +620,57 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 		// log.Printf("dealer: %v", dealer)
 		p, err := createPackV2(getCEPByDealerLocation(dealer), CEP_ZUNKA, dealerToZunkaProducts)
 		// log.Printf("Dealer pack: %+v\n\n", p)
-		if checkError(err) {
-			return
+		if err != nil {
+			return frsOut, err
 		}
 		dealerPacks = append(dealerPacks, p)
 	}
 	// Number of pakcs come from dealers, one for each.
 	dealerPacksCount := len(dealerPacks)
+	if trace != nil {
+		trace.Packs = append(append(trace.Packs, zunkaToClientPack), dealerPacks...)
+	}
 
+	// Buffered, providers not answered in time don't block.
 	chanFreightS := [](chan *freightsOk){}
+	// Provider of each channel.
+	providerS := []string{}
 
 	// Zunka correios.
-	chanFreight := make(chan *freightsOk)
+	chanFreight := make(chan *freightsOk, 1)
 	chanFreightS = append(chanFreightS, chanFreight)
-	go getCorreiosFreightByPack(chanFreight, &zunkaToClientPack)
+	providerS = append(providerS, "correios")
+	go getCorreiosFreightByPack(ctx, chanFreight, &zunkaToClientPack)
 
 	// Zunka motoboy.
-	chanFreight = make(chan *freightsOk)
+	chanFreight = make(chan *freightsOk, 1)
 	chanFreightS = append(chanFreightS, chanFreight)
+	providerS = append(providerS, "motoboy")
 	// log.Printf("zunkaToClientPack: %+v", zunkaToClientPack)
-	go getMotoboyFreightByCEP(chanFreight, zunkaToClientPack.CEPDestiny)
+	go getMotoboyFreightByCEP(ctx, chanFreight, zunkaToClientPack.CEPDestiny)
 
 	// Zunka region.
-	chanFreight = make(chan *freightsOk)
+	chanFreight = make(chan *freightsOk, 1)
 	chanFreightS = append(chanFreightS, chanFreight)
-	go getFreightRegionByCEPAndWeight(chanFreight, zunkaToClientPack.CEPDestiny, zunkaToClientPack.Weight)
+	providerS = append(providerS, "region")
+	go getFreightRegionByCEPAndWeight(ctx, chanFreight, zunkaToClientPack.CEPDestiny, zunkaToClientPack.Weight)
 
 	// Dealer
 	for i := range dealerPacks {
 		// Correios
-		chanDealer := make(chan *freightsOk)
+		chanDealer := make(chan *freightsOk, 1)
 		chanFreightS = append(chanFreightS, chanDealer)
+		providerS = append(providerS, "correios_dealer")
 		// dealerPacks[i].Dealer = fmt.Sprintf("%v", i)
 		// log.Printf("pack: %+v", &dealerPacks[i])
-		go getCorreiosFreightByPack(chanDealer, &dealerPacks[i])
+		go getCorreiosFreightByPack(ctx, chanDealer, &dealerPacks[i])
 
 		// Table
-		chanDealer = make(chan *freightsOk)
+		chanDealer = make(chan *freightsOk, 1)
 		chanFreightS = append(chanFreightS, chanDealer)
+		providerS = append(providerS, "dealer_table")
 		// log.Printf("dealerPack: %v", dealerPacks[i])
-		go getDealerFreightByDealerLocationAndWeight(chanDealer, dealerPacks[i].Dealer, dealerPacks[i].Weight)
+		go getDealerFreightByDealerLocationAndWeight(ctx, chanDealer, dealerPacks[i].Dealer, dealerPacks[i].Weight)
 	}
 
 	// Dealer region.
@@ -665,8 +688,29 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 	// Sum freight by service code.
 	dealerFrsCorreiosSum := make(map[string]*dealerFreights)
 	dealerFrsTableSum := make(map[string]*dealerFreights)
-	for _, c := range chanFreightS {
-		frsOk := <-c
+	// Last provider error, to explain an empty result.
+	var providerErr error
+	for i, c := range chanFreightS {
+		var frsOk *freightsOk
+		select {
+		case frsOk = <-c:
+		case <-ctx.Done():
+			// Answered just in time.
+			select {
+			case frsOk = <-c:
+			default:
+			}
+		}
+		// Not answered in quote budget or gave up because of it, combine freights arrived.
+		if frsOk == nil || (frsOk.Err != nil && ctx.Err() != nil) {
+			trace.addTimedOut(providerS[i])
+			providerErr = errQuoteBudget
+			continue
+		}
+		trace.addProvider(providerS[i], frsOk)
+		if frsOk.Err != nil {
+			providerErr = frsOk.Err
+		}
 		if frsOk.Ok {
 			// log.Printf("\nfrsOk: %+v\n", frsOk)
 			for _, fr := range frsOk.Freights {
@@ -695,6 +739,7 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 					frSum, ok := frSumMap[fr.ServiceCode]
 					if ok {
 						frSum.freight.Price += fr.Price
+						frSum.freight.Stale = frSum.freight.Stale || fr.Stale
 						if fr.Deadline > frSum.freight.Deadline {
 							frSum.freight.Deadline = fr.Deadline
 						}
@@ -710,6 +755,7 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 								ServiceDesc: fr.ServiceDesc,
 								Deadline:    fr.Deadline,
 								Price:       fr.Price,
+								Stale:       fr.Stale,
 							},
 						}
 						// log.Printf("dealerFrsCorreiosSum: %+v", dealerFrsCorreiosSum)
@@ -739,7 +785,7 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 			// log.Printf("dealerFrsCorreiosSum: %v", dealerFrsCorreiosSum)
 			if len(dealerFrsCorreiosSum) > 0 {
 				for i, fr := range dealerFrsCorreiosSum {
-					log.Printf("dealerFrsCorreiosSum[%v]: %v", i, fr)
+					logDebug(ctx, "dealerFrsCorreiosSum[%v]: %v", i, fr)
 				}
 			}
 
@@ -747,7 +793,7 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 			// log.Printf("dealerFrsTableSum: %v", dealerFrsTableSum)
 			if len(dealerFrsTableSum) > 0 {
 				for i, fr := range dealerFrsTableSum {
-					log.Printf("dealerFrsTableSum[%v]: %v", i, fr)
+					logDebug(ctx, "dealerFrsTableSum[%v]: %v", i, fr)
 				}
 			}
 
@@ -755,7 +801,7 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 			// log.Printf("zunkaFrsCorreios: %v", zunkaFrsCorreios)
 			if len(zunkaFrsCorreios) > 0 {
 				for i, fr := range zunkaFrsCorreios {
-					log.Printf("zunkaFrsCorreios[%v]: %v", i, fr)
+					logDebug(ctx, "zunkaFrsCorreios[%v]: %v", i, fr)
 				}
 			}
 
@@ -763,7 +809,7 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 			// log.Printf("zunkaFrsTable: %v", zunkaFrsTable)
 			if len(zunkaFrsTable) > 0 {
 				for i, fr := range zunkaFrsTable {
-					log.Printf("zunkaFrsTable[%v]: %v", i, fr)
+					logDebug(ctx, "zunkaFrsTable[%v]: %v", i, fr)
 				}
 			}
 		}
@@ -779,6 +825,7 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 					ServiceDesc: frZunka.ServiceDesc,
 					Price:       frZunka.Price + frDealer.Price,
 					Deadline:    frZunka.Deadline + frDealer.Deadline,
+					Stale:       frZunka.Stale || frDealer.Stale,
 				})
 			}
 		}
@@ -851,6 +898,7 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 					ServiceDesc: frZunkaMin.ServiceDesc,
 					Price:       frZunkaMin.Price + frDealerMin.Price,
 					Deadline:    frZunkaMin.Deadline + frDealerMin.Deadline,
+					Stale:       frZunkaMin.Stale || frDealerMin.Stale,
 				})
 				carrier = "Transportadora 2"
 				if frZunkaMax.Carrier == frDealerMax.Carrier {
@@ -862,6 +910,7 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 					ServiceDesc: frZunkaMax.ServiceDesc,
 					Price:       frZunkaMax.Price + frDealerMax.Price,
 					Deadline:    frZunkaMax.Deadline + frDealerMax.Deadline,
+					Stale:       frZunkaMax.Stale || frDealerMax.Stale,
 				})
 			}
 		}
@@ -889,6 +938,15 @@ func getFreightsByProducts(productsIn zunkaProducts) (frsOut []*freight, ok bool
 	// for _, fr := range frsOut {
 	// log.Printf("fr: %+v", fr)
 	// }
-	ok = true
-	return
+	// No freight because some provider failed.
+	if len(frsOut) == 0 && providerErr != nil {
+		var aErr *apiError
+		// Client error, like an unknown CEP.
+		if errors.As(providerErr, &aErr) && aErr.Status < http.StatusInternalServerError {
+			return frsOut, aErr
+		}
+		checkError(ctx, providerErr)
+		return frsOut, newUnavailableError("No freight available, carriers not responding")
+	}
+	return frsOut, nil
 }
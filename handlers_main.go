@@ -1,23 +1,38 @@
 package main
 
 import (
-	"log"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
 )
 
-// Handler error.
-func HandleError(w http.ResponseWriter, err error) {
-	if err != nil {
-		// http.Error(w, "Some thing wrong", 404)
-		if production {
-			http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		log.Println(err.Error())
+// Write error as json.
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	var aErr *apiError
+	if !errors.As(err, &aErr) {
+		aErr = newInternalError(err)
+	}
+	out := *aErr
+	out.RequestID = requestID(req)
+	// Show the cause for developers.
+	if !production && out.Status == http.StatusInternalServerError && out.err != nil {
+		out.Message = out.err.Error()
+	}
+
+	// Log where the error was written.
+	level := LOG_WARNING
+	if out.Status >= http.StatusInternalServerError {
+		level = LOG_ERROR
 	}
+	logf(req.Context(), level, 1, "%v", err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(out.Status)
+	_ = json.NewEncoder(w).Encode(out)
 }
 
 // Index handler.
@@ -25,3 +40,69 @@ func indexHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params)
 	w.WriteHeader(200)
 	w.Write([]byte("Hello!\n"))
 }
+
+// Metrics in Prometheus text format.
+func metricsHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	b := bytes.Buffer{}
+	writeMetrics(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// Log level, {"level": "info"}.
+func getLogLevelHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	writeLogLevelJSON(w, req)
+}
+
+// Change log level at runtime, {"level": "debug"}.
+func setLogLevelHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	in := struct {
+		Level string `json:"level"`
+	}{}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
+		return
+	}
+	err = json.Unmarshal(body, &in)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
+		return
+	}
+	before := getLogLevel()
+	if err = setLogLevel(in.Level); err != nil {
+		writeError(w, req, err)
+		return
+	}
+	logInfo(req.Context(), "Log level changed from %s to %s by %s", before, getLogLevel(), authUser(req))
+	writeLogLevelJSON(w, req)
+}
+
+func writeLogLevelJSON(w http.ResponseWriter, req *http.Request) {
+	levelJSON, err := json.Marshal(map[string]string{"level": getLogLevel()})
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(levelJSON)
+}
+
+// Process alive, no dependency checked.
+func healthzHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// Dependencies status, 503 only if can't serve.
+func readyzHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	r := checkReadiness(req.Context())
+	rJSON, err := json.Marshal(r)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(r.httpStatus())
+	w.Write(rJSON)
+}
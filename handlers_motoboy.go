@@ -11,19 +11,26 @@ import (
 
 // Motoboy deliveries.
 func getAllMotoboyFreightHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	// Filter, sort and pagination.
+	opt, err := parseListOptions(req.URL.Query(), motoboyFreightList)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
 	// Get data.
-	deliveries, err := getAllMotoboyFreight()
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	deliveries, total, err := findMotoboyFreight(opt)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Convert to json.
 	deliveriesJSON, err := json.Marshal(deliveries)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Send response.
+	setTotalCountHeader(w, total)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(deliveriesJSON)
 }
@@ -33,21 +40,21 @@ func getMotoboyFreightHandler(w http.ResponseWriter, req *http.Request, ps httpr
 	// log.Printf("*** GET *** %v\n", ps.ByName("id"))
 	// Get id.
 	id, err := strconv.Atoi(ps.ByName("id"))
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_ID, "Invalid id: %v", ps.ByName("id")))
 		return
 	}
 
 	// Get data.
-	fr, ok := getMotoboyFreightByID(id)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	fr, err := getMotoboyFreightByID(id)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Convert to json.
 	frJSON, err := json.Marshal(fr)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Send response.
@@ -61,21 +68,21 @@ func createMotoboyFreightHandler(w http.ResponseWriter, req *http.Request, ps ht
 	// Data.
 	fr := motoboyFreight{}
 	body, err := ioutil.ReadAll(req.Body)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
 		return
 	}
 	// log.Printf("body: %v\n", string(body))
 	err = json.Unmarshal(body, &fr)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
 		return
 	}
 
 	// Update.
-	ok := createMotoboyFreight(&fr)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	err = createMotoboyFreight(req.Context(), &fr, newAuditEntry(req, "motoboy_freight", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	w.WriteHeader(200)
@@ -85,14 +92,14 @@ func createMotoboyFreightHandler(w http.ResponseWriter, req *http.Request, ps ht
 func deleteMotoboyFreightHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	// log.Printf("*** DELETE *** \n")
 	id, err := strconv.Atoi(ps.ByName("id"))
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_ID, "Invalid id: %v", ps.ByName("id")))
 		return
 	}
 	// Delete.
-	ok := deleteMotoboyFreight(id)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	err = deleteMotoboyFreight(id, newAuditEntry(req, "motoboy_freight", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	w.WriteHeader(200)
@@ -104,22 +111,46 @@ func updateMotoboyFreightHandler(w http.ResponseWriter, req *http.Request, ps ht
 	// Data.
 	fr := motoboyFreight{}
 	body, err := ioutil.ReadAll(req.Body)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
 		return
 	}
 	// log.Printf("body: %v\n", string(body))
 	err = json.Unmarshal(body, &fr)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
 		return
 	}
 
 	// Update.
-	ok := updateMotoboyFreightById(&fr)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	err = updateMotoboyFreightById(req.Context(), &fr, newAuditEntry(req, "motoboy_freight", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	w.WriteHeader(200)
 }
+
+// Export motoboy freights as csv, same filters and sort as list.
+func exportMotoboyFreightCSVHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	opt, err := parseListOptions(req.URL.Query(), motoboyFreightList)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	freights, _, err := findMotoboyFreight(opt)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	records := [][]string{}
+	for i := range freights {
+		records = append(records, freights[i].csvRecord())
+	}
+	writeCSV(w, "motoboy_freight.csv", motoboyFreightCSV.header, records)
+}
+
+// Import motoboy freights from csv.
+func importMotoboyFreightCSVHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	handleCSVImport(w, req, motoboyFreightCSV)
+}
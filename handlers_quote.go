@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// One quote, with request, packs and providers results.
+func getQuoteHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	q, err := getQuoteByID(ps.ByName("id"))
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	qJSON, err := json.Marshal(q)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(qJSON)
+}
+
+// Confirm service chosen at checkout, guaranteed price or quote_expired/quote_changed error with the new quote.
+func confirmQuoteHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	// Data.
+	choice := quoteChoice{}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
+		return
+	}
+	err = json.Unmarshal(body, &choice)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
+		return
+	}
+
+	// Confirm.
+	conf, err := confirmQuote(req, ps.ByName("id"), choice)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	confJSON, err := json.Marshal(conf)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(confJSON)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Quote stats, ?groupBy=region,carrier&client=zunka&from=2020-01-01&to=2020-01-31.
+func getQuoteStatsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	stats, err := findQuoteStats(req.URL.Query())
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	statsJSON, err := json.Marshal(stats)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(statsJSON)
+}
+
+// Export quote stats as csv, same filters and grouping as json.
+func exportQuoteStatsCSVHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	stats, err := findQuoteStats(req.URL.Query())
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	records := [][]string{}
+	for i := range stats {
+		records = append(records, stats[i].csvRecord())
+	}
+	writeCSV(w, "quote_stats.csv", quoteStatCSVHeader, records)
+}
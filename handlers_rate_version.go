@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Rate versions, ?entity=freight_region&status=scheduled.
+func getAllRateVersionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	// Filter, sort and pagination.
+	opt, err := parseListOptions(req.URL.Query(), rateVersionList)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	// Get data.
+	vs, total, err := findRateVersion(opt)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	// Send response.
+	setTotalCountHeader(w, total)
+	writeRateVersionJSON(w, req, vs)
+}
+
+// One rate version.
+func getOneRateVersionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_ID, "Invalid id: %v", ps.ByName("id")))
+		return
+	}
+	v, err := getRateVersion(id)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeRateVersionJSON(w, req, v)
+}
+
+// Create draft rate version, rows copied from copyFrom or active version.
+func createRateVersionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	// Data.
+	in := struct {
+		Entity   string `json:"entity"`
+		Note     string `json:"note"`
+		CopyFrom int    `json:"copyFrom"`
+	}{}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
+		return
+	}
+	err = json.Unmarshal(body, &in)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
+		return
+	}
+
+	// Create.
+	v := rateVersion{Entity: in.Entity, Note: in.Note}
+	err = createRateVersion(&v, in.CopyFrom, newAuditEntry(req, "rate_version", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeRateVersionJSON(w, req, v)
+}
+
+// Schedule, activate or change rate version to draft.
+func updateRateVersionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_ID, "Invalid id: %v", ps.ByName("id")))
+		return
+	}
+	// Data.
+	change := rateVersionChange{}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
+		return
+	}
+	err = json.Unmarshal(body, &change)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
+		return
+	}
+
+	// Update.
+	v, err := updateRateVersion(id, change, newAuditEntry(req, "rate_version", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeRateVersionJSON(w, req, v)
+}
+
+// Delete draft or scheduled rate version.
+func deleteRateVersionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_ID, "Invalid id: %v", ps.ByName("id")))
+		return
+	}
+	// Delete.
+	err = deleteRateVersion(id, newAuditEntry(req, "rate_version", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// Diff rate versions, ?from=1&to=2.
+func diffRateVersionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	ids := []int{}
+	for _, param := range []string{"from", "to"} {
+		id, err := strconv.Atoi(req.URL.Query().Get(param))
+		if err != nil {
+			writeError(w, req, newBadRequestError(ERR_INVALID_QUERY, "Invalid %s: %v", param, req.URL.Query().Get(param)))
+			return
+		}
+		ids = append(ids, id)
+	}
+	diff, err := diffRateVersions(ids[0], ids[1])
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeRateVersionJSON(w, req, diff)
+}
+
+// Write rate version response.
+func writeRateVersionJSON(w http.ResponseWriter, req *http.Request, v interface{}) {
+	vJSON, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(vJSON)
+}
@@ -14,21 +14,21 @@ func createRegionFreightHandler(w http.ResponseWriter, req *http.Request, ps htt
 	// Data.
 	fr := regionFreight{}
 	body, err := ioutil.ReadAll(req.Body)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
 		return
 	}
 	// log.Printf("body: %v\n", string(body))
 	err = json.Unmarshal(body, &fr)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
 		return
 	}
 
 	// Create.
-	ok := createFreightRegion(&fr)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	err = createFreightRegion(req.Context(), &fr, newAuditEntry(req, "freight_region", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	w.WriteHeader(200)
@@ -36,19 +36,26 @@ func createRegionFreightHandler(w http.ResponseWriter, req *http.Request, ps htt
 
 // All region freights.
 func getAllRegionFreightHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	// Filter, sort and pagination.
+	opt, err := parseListOptions(req.URL.Query(), regionFreightList)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
 	// Get data.
-	freights, ok := getAllFreightRegion()
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	freights, total, err := findFreightRegion(opt)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Convert to json.
 	freightJSON, err := json.Marshal(freights)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Send response.
+	setTotalCountHeader(w, total)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(freightJSON)
 }
@@ -58,21 +65,21 @@ func getOneRegionFreightHandler(w http.ResponseWriter, req *http.Request, ps htt
 	// log.Printf("*** GET *** %v\n", ps.ByName("id"))
 	// Get id.
 	id, err := strconv.Atoi(ps.ByName("id"))
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_ID, "Invalid id: %v", ps.ByName("id")))
 		return
 	}
 
 	// Get data.
-	fr, ok := getFreightRegionById(id)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	fr, err := getFreightRegionById(id)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Convert to json.
 	frJSON, err := json.Marshal(fr)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	// Send response.
@@ -85,21 +92,21 @@ func updateRegionFreightHandler(w http.ResponseWriter, req *http.Request, ps htt
 	// Data.
 	fr := regionFreight{}
 	body, err := ioutil.ReadAll(req.Body)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Can't read body"))
 		return
 	}
 	// log.Printf("body: %v\n", string(body))
 	err = json.Unmarshal(body, &fr)
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err))
 		return
 	}
 
 	// Update.
-	ok := updateFreightRegion(&fr)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	err = updateFreightRegion(req.Context(), &fr, newAuditEntry(req, "freight_region", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	w.WriteHeader(200)
@@ -108,15 +115,39 @@ func updateRegionFreightHandler(w http.ResponseWriter, req *http.Request, ps htt
 // Delete region freight.
 func deleteRegionFreightHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	id, err := strconv.Atoi(ps.ByName("id"))
-	if checkError(err) {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_ID, "Invalid id: %v", ps.ByName("id")))
 		return
 	}
 	// Delete.
-	ok := deleteFreightRegion(id)
-	if !ok {
-		http.Error(w, "Alguma coisa deu errado", http.StatusInternalServerError)
+	err = deleteFreightRegion(id, newAuditEntry(req, "freight_region", 0, ""))
+	if err != nil {
+		writeError(w, req, err)
 		return
 	}
 	w.WriteHeader(200)
 }
+
+// Export region freights as csv, same filters and sort as list.
+func exportRegionFreightCSVHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	opt, err := parseListOptions(req.URL.Query(), regionFreightList)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	freights, _, err := findFreightRegion(opt)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	records := [][]string{}
+	for i := range freights {
+		records = append(records, freights[i].csvRecord())
+	}
+	writeCSV(w, "freight_region.csv", regionFreightCSV.header, records)
+}
+
+// Import region freights from csv.
+func importRegionFreightCSVHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	handleCSVImport(w, req, regionFreightCSV)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/julienschmidt/httprouter"
+)
+
+// All users with credentials, no password hashes.
+func getAllUsersHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	users, err := getAllUsers()
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeUserJSON(w, req, users)
+}
+
+// One user.
+func getOneUserHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	u, err := getUserByName(ps.ByName("username"))
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeUserJSON(w, req, u)
+}
+
+// Create user with roles, credentials created apart.
+func createUserHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	// Data.
+	in := struct {
+		Username string   `json:"username"`
+		Roles    []string `json:"roles"`
+	}{}
+	if err := readUserBody(req, &in); err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	// Create.
+	u := apiUser{Username: in.Username, Roles: in.Roles}
+	if err := createUser(&u); err != nil {
+		writeError(w, req, err)
+		return
+	}
+	auditUserChange(req, "api_user", u.ID, AUDIT_CREATE, nil, u)
+	writeUserJSON(w, req, u)
+}
+
+// Replace user roles.
+func updateUserHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	// Data.
+	in := struct {
+		Roles []string `json:"roles"`
+	}{}
+	if err := readUserBody(req, &in); err != nil {
+		writeError(w, req, err)
+		return
+	}
+	if in.Roles == nil {
+		writeError(w, req, newValidationError("roles", ERR_REQUIRED, "Roles is required"))
+		return
+	}
+
+	// Update.
+	before, err := getUserByName(ps.ByName("username"))
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	u, err := updateUserRoles(ps.ByName("username"), in.Roles)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	auditUserChange(req, "api_user", u.ID, AUDIT_UPDATE, before, u)
+	writeUserJSON(w, req, u)
+}
+
+// Delete user and its credentials.
+func deleteUserHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	u, err := deleteUser(ps.ByName("username"))
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	auditUserChange(req, "api_user", u.ID, AUDIT_DELETE, u, nil)
+	w.WriteHeader(200)
+}
+
+// Create user credential, the password is only sent in this response.
+func createCredentialHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	// Data.
+	in := struct {
+		Description string     `json:"description"`
+		ExpiresAt   *time.Time `json:"expiresAt"`
+		Password    string     `json:"password"`
+	}{}
+	if err := readUserBody(req, &in); err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	// Create.
+	c := apiCredential{Description: in.Description, ExpiresAt: in.ExpiresAt, Password: in.Password}
+	if err := createCredential(ps.ByName("username"), &c); err != nil {
+		writeError(w, req, err)
+		return
+	}
+	audited := c
+	audited.Password = ""
+	auditUserChange(req, "api_credential", c.ID, AUDIT_CREATE, nil, audited)
+	writeUserJSON(w, req, c)
+}
+
+// Revoke user credential.
+func deleteCredentialHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeError(w, req, newBadRequestError(ERR_INVALID_ID, "Invalid id: %v", ps.ByName("id")))
+		return
+	}
+	c, err := deleteCredential(ps.ByName("username"), id)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	auditUserChange(req, "api_credential", c.ID, AUDIT_DELETE, c, nil)
+	w.WriteHeader(200)
+}
+
+func readUserBody(req *http.Request, in interface{}) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return newBadRequestError(ERR_INVALID_BODY, "Can't read body")
+	}
+	if err = json.Unmarshal(body, in); err != nil {
+		return newBadRequestError(ERR_INVALID_BODY, "Invalid json. %v", err)
+	}
+	return nil
+}
+
+// Audit from public views, rows have password hashes.
+func auditUserChange(req *http.Request, entity string, id int, action string, before interface{}, after interface{}) {
+	entry := newAuditEntry(req, entity, id, action)
+	for _, v := range []struct {
+		src interface{}
+		dst *types.JSONText
+	}{{before, &entry.Before}, {after, &entry.After}} {
+		if v.src == nil {
+			continue
+		}
+		b, err := json.Marshal(v.src)
+		if err != nil {
+			logError(req.Context(), "Encoding %s %d to audit. %v", entity, id, err)
+			continue
+		}
+		*v.dst = types.JSONText(b)
+	}
+	if err := saveAudit(sql3DB, entry); err != nil {
+		logError(req.Context(), "Saving %s of %s %d by %s. %v", action, entity, id, entry.User, err)
+	}
+}
+
+// Write user response.
+func writeUserJSON(w http.ResponseWriter, req *http.Request, v interface{}) {
+	vJSON, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(vJSON)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Dependency status.
+const (
+	HEALTH_OK       = "ok"
+	HEALTH_DEGRADED = "degraded" // Serving, maybe slower or without some freights.
+	HEALTH_DOWN     = "down"     // Not serving.
+	HEALTH_UNKNOWN  = "unknown"  // Upstream not called yet.
+)
+
+// Max time for each readiness check.
+const READY_CHECK_TIMEOUT = 2 * time.Second
+
+// Upstream without a successful call for longer than it, after an error, is degraded.
+const READY_UPSTREAM_MAX_AGE = 30 * time.Minute
+
+// Upstream services checked by readiness.
+var readyUpstreams = []string{UPSTREAM_CORREIOS, UPSTREAM_VIACEP}
+
+// Readiness of service.
+type readiness struct {
+	Status string                      `json:"status"`
+	Checks map[string]dependencyHealth `json:"checks"`
+}
+
+// Dependency check result.
+type dependencyHealth struct {
+	Status         string     `json:"status"`
+	LatencyMs      float64    `json:"latencyMs,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	LastSuccess    *time.Time `json:"lastSuccess,omitempty"`
+	LastSuccessAge float64    `json:"lastSuccessAgeSec,omitempty"`
+	LastError      *time.Time `json:"lastError,omitempty"`
+	Breaker        string     `json:"breaker,omitempty"` // Upstream circuit breaker state.
+}
+
+// Last upstream calls result.
+type upstreamCalls struct {
+	lastSuccess time.Time
+	lastError   time.Time
+	err         string
+}
+
+var (
+	upstreamStatusMu sync.Mutex
+	upstreamStatus   = map[string]*upstreamCalls{}
+)
+
+// Keep upstream call result.
+func recordUpstreamCall(service string, err error) {
+	upstreamStatusMu.Lock()
+	defer upstreamStatusMu.Unlock()
+	calls, ok := upstreamStatus[service]
+	if !ok {
+		calls = &upstreamCalls{}
+		upstreamStatus[service] = calls
+	}
+	if err == nil {
+		calls.lastSuccess = time.Now()
+		return
+	}
+	calls.lastError = time.Now()
+	calls.err = err.Error()
+}
+
+// Upstream health from last calls and circuit breaker, checks nothing by itself to not load upstream.
+func checkUpstream(service string) dependencyHealth {
+	breaker := upstreamBreaker(service).currentState()
+	upstreamStatusMu.Lock()
+	defer upstreamStatusMu.Unlock()
+	calls, ok := upstreamStatus[service]
+	if !ok {
+		return dependencyHealth{Status: HEALTH_UNKNOWN, Breaker: breaker}
+	}
+	h := dependencyHealth{Status: HEALTH_OK, Breaker: breaker}
+	if !calls.lastSuccess.IsZero() {
+		lastSuccess := calls.lastSuccess
+		h.LastSuccess = &lastSuccess
+		h.LastSuccessAge = time.Since(lastSuccess).Truncate(time.Second).Seconds()
+	}
+	if !calls.lastError.IsZero() {
+		lastError := calls.lastError
+		h.LastError = &lastError
+		// Failing now and not recovered.
+		if calls.lastError.After(calls.lastSuccess) && time.Since(calls.lastSuccess) > READY_UPSTREAM_MAX_AGE {
+			h.Status = HEALTH_DEGRADED
+			h.Error = calls.err
+		}
+	}
+	if breaker == BREAKER_OPEN {
+		h.Status = HEALTH_DEGRADED
+		h.Error = errCircuitOpen.Error()
+	}
+	return h
+}
+
+// Cache ping, degraded if not reachable or using memory because redis was not.
+func checkCache(ctx context.Context) dependencyHealth {
+	start := time.Now()
+	err := cache.Ping(ctx)
+	h := dependencyHealth{Status: HEALTH_OK, LatencyMs: msSince(start)}
+	if err != nil {
+		h.Status = HEALTH_DEGRADED
+		h.Error = err.Error()
+	} else if cache.Backend() != cfg.Cache.Backend {
+		h.Status = HEALTH_DEGRADED
+		h.Error = fmt.Sprintf("%s not reachable at start-up, using %s cache", cfg.Cache.Backend, cache.Backend())
+	}
+	return h
+}
+
+// Sqlite query, rate tables are needed to quote.
+func checkSqlite(ctx context.Context) dependencyHealth {
+	start := time.Now()
+	var n int
+	err := sql3DB.GetContext(ctx, &n, "SELECT COUNT(*) FROM rate_version WHERE status=?", RATE_ACTIVE)
+	h := dependencyHealth{Status: HEALTH_OK, LatencyMs: msSince(start)}
+	if err != nil {
+		h.Status = HEALTH_DOWN
+		h.Error = err.Error()
+	}
+	return h
+}
+
+// Check dependencies, status is the worst of them.
+func checkReadiness(ctx context.Context) readiness {
+	ctx, cancel := context.WithTimeout(ctx, READY_CHECK_TIMEOUT)
+	defer cancel()
+	r := readiness{Status: HEALTH_OK, Checks: map[string]dependencyHealth{
+		"cache":  checkCache(ctx),
+		"sqlite": checkSqlite(ctx),
+	}}
+	for _, service := range readyUpstreams {
+		r.Checks[service] = checkUpstream(service)
+	}
+	for _, h := range r.Checks {
+		switch {
+		case h.Status == HEALTH_DOWN:
+			r.Status = HEALTH_DOWN
+		case h.Status == HEALTH_DEGRADED && r.Status == HEALTH_OK:
+			r.Status = HEALTH_DEGRADED
+		}
+	}
+	return r
+}
+
+// Http status of readiness, degraded is still serving.
+func (r readiness) httpStatus() int {
+	if r.Status == HEALTH_DOWN {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+func msSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
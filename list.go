@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter kinds.
+const (
+	FILTER_IN       = iota // One of comma separated values.
+	FILTER_MIN             // Column >= value.
+	FILTER_MAX             // Column <= value.
+	FILTER_CONTAINS        // Normalized city contains value.
+	FILTER_FROM            // Timestamp column >= date or time.
+	FILTER_TO              // Timestamp column <= time, or before next day for a date.
+)
+
+// Format of sqlite CURRENT_TIMESTAMP, UTC.
+const SQLITE_TIME_FORMAT = "2006-01-02 15:04:05"
+
+// Max rows by page.
+const LIST_MAX_LIMIT = 1000
+
+// Filter from query parameter.
+type listFilter struct {
+	param  string
+	column string
+	kind   int
+}
+
+// Table that can be listed.
+type listTable struct {
+	name        string
+	columns     map[string]string // Sortable, query name -> column.
+	filters     []listFilter
+	defaultSort string
+	versioned   bool // Rate table, filter by ?version=id or active version.
+}
+
+// List options from query string.
+type listOptions struct {
+	where  []string
+	args   []interface{}
+	sort   []string
+	limit  int // 0 for all rows.
+	offset int
+}
+
+// Parse query parameters like ?region=south,north&weightMin=1000&sort=-price,weight&limit=20&offset=40.
+func parseListOptions(query url.Values, table listTable) (opt listOptions, err error) {
+	// Filters.
+	for _, filter := range table.filters {
+		val := strings.TrimSpace(query.Get(filter.param))
+		if val == "" {
+			continue
+		}
+		switch filter.kind {
+		case FILTER_IN:
+			vals := strings.Split(strings.ToLower(val), ",")
+			for i := range vals {
+				vals[i] = strings.TrimSpace(vals[i])
+				opt.args = append(opt.args, vals[i])
+			}
+			opt.where = append(opt.where, filter.column+" IN (?"+strings.Repeat(", ?", len(vals)-1)+")")
+		case FILTER_MIN, FILTER_MAX:
+			num, err := strconv.Atoi(val)
+			if err != nil {
+				return opt, newBadRequestError(ERR_INVALID_QUERY, "Invalid %s: %s", filter.param, val)
+			}
+			op := " >= ?"
+			if filter.kind == FILTER_MAX {
+				op = " <= ?"
+			}
+			opt.where = append(opt.where, filter.column+op)
+			opt.args = append(opt.args, num)
+		case FILTER_CONTAINS:
+			// Escape like wildcards.
+			norm := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(normalizeCity(val))
+			opt.where = append(opt.where, filter.column+` LIKE ? ESCAPE '\'`)
+			opt.args = append(opt.args, "%"+norm+"%")
+		case FILTER_FROM, FILTER_TO:
+			t, isDate, err := parseListTime(val)
+			if err != nil {
+				return opt, newBadRequestError(ERR_INVALID_QUERY, "Invalid %s: %s, must be like 2006-01-02 or 2006-01-02T15:04:05Z", filter.param, val)
+			}
+			op := " >= ?"
+			if filter.kind == FILTER_TO {
+				op = " <= ?"
+				// Whole day.
+				if isDate {
+					op = " < ?"
+					t = t.AddDate(0, 0, 1)
+				}
+			}
+			opt.where = append(opt.where, filter.column+op)
+			opt.args = append(opt.args, t.UTC().Format(SQLITE_TIME_FORMAT))
+		}
+	}
+
+	// Rate version.
+	if table.versioned {
+		version, err := queryRateVersion(query, table.name)
+		if err != nil {
+			return opt, err
+		}
+		opt.where = append(opt.where, "version_id = ?")
+		opt.args = append(opt.args, version)
+	}
+
+	// Sort, "-" for descending.
+	if val := query.Get("sort"); val != "" {
+		for _, name := range strings.Split(val, ",") {
+			name = strings.TrimSpace(name)
+			order := "ASC"
+			if strings.HasPrefix(name, "-") {
+				order = "DESC"
+				name = name[1:]
+			}
+			column, ok := table.columns[name]
+			if !ok {
+				return opt, newBadRequestError(ERR_INVALID_QUERY, "Can't sort by %s", name)
+			}
+			opt.sort = append(opt.sort, column+" "+order)
+		}
+	}
+
+	// Pagination.
+	if val := query.Get("limit"); val != "" {
+		opt.limit, err = strconv.Atoi(val)
+		if err != nil || opt.limit < 1 || opt.limit > LIST_MAX_LIMIT {
+			return opt, newBadRequestError(ERR_INVALID_QUERY, "Invalid limit: %s, must be between 1 and %d", val, LIST_MAX_LIMIT)
+		}
+	}
+	if val := query.Get("offset"); val != "" {
+		opt.offset, err = strconv.Atoi(val)
+		if err != nil || opt.offset < 0 {
+			return opt, newBadRequestError(ERR_INVALID_QUERY, "Invalid offset: %s", val)
+		}
+	}
+	return opt, nil
+}
+
+// Date in Brazil time or RFC3339 time.
+func parseListTime(val string) (t time.Time, isDate bool, err error) {
+	t, err = time.ParseInLocation("2006-01-02", val, brLocation)
+	if err == nil {
+		return t, true, nil
+	}
+	t, err = time.Parse(time.RFC3339, val)
+	return t, false, err
+}
+
+// Select rows and total count of rows matching filters.
+func listRows(dest interface{}, table listTable, opt listOptions) (total int, err error) {
+	where := ""
+	if len(opt.where) > 0 {
+		where = " WHERE " + strings.Join(opt.where, " AND ")
+	}
+	err = sql3DB.Get(&total, "SELECT COUNT(*) FROM "+table.name+where, opt.args...)
+	if err != nil {
+		return total, newInternalError(err)
+	}
+
+	// Default sort as tie breaker.
+	orderBy := " ORDER BY " + strings.Join(append(opt.sort, table.defaultSort), ", ")
+	args := opt.args
+	limit := ""
+	if opt.limit > 0 {
+		limit = " LIMIT ? OFFSET ?"
+		args = append(args, opt.limit, opt.offset)
+	} else if opt.offset > 0 {
+		limit = " LIMIT -1 OFFSET ?"
+		args = append(args, opt.offset)
+	}
+	err = sql3DB.Select(dest, "SELECT * FROM "+table.name+where+orderBy+limit, args...)
+	if err != nil {
+		return total, newInternalError(err)
+	}
+	return total, nil
+}
+
+// Total rows header.
+func setTotalCountHeader(w http.ResponseWriter, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+}
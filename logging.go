@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels.
+const (
+	LOG_DEBUG int32 = iota
+	LOG_INFO
+	LOG_WARNING
+	LOG_ERROR
+)
+
+// Log level names, by level.
+var logLevelNames = []string{"debug", "info", "warning", "error"}
+
+// Lower level logged, changed at runtime by admin endpoint.
+var logLevel = LOG_DEBUG
+
+// Request id context key.
+const CTX_REQUEST_ID contextKey = "requestID"
+
+// Log line.
+type logEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Msg       string `json:"msg"`
+	RequestID string `json:"requestId,omitempty"`
+	Caller    string `json:"caller,omitempty"` // file:line function.
+	// Request, only for request log.
+	Method   string  `json:"method,omitempty"`
+	Path     string  `json:"path,omitempty"`
+	Status   int     `json:"status,omitempty"`
+	Duration float64 `json:"durationMs,omitempty"`
+}
+
+// Current log level name.
+func getLogLevel() string {
+	return logLevelNames[atomic.LoadInt32(&logLevel)]
+}
+
+// Log level by name, -1 if invalid.
+func logLevelIndex(name string) int32 {
+	for i, levelName := range logLevelNames {
+		if strings.ToLower(name) == levelName {
+			return int32(i)
+		}
+	}
+	return -1
+}
+
+// Set log level by name.
+func setLogLevel(name string) error {
+	if level := logLevelIndex(name); level >= 0 {
+		atomic.StoreInt32(&logLevel, level)
+		return nil
+	}
+	return newValidationError("level", ERR_INVALID_LOG_LEVEL, "Invalid log level: %s, must be one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+// Write log entry as a json line if level enabled.
+func writeLog(level int32, entry logEntry) {
+	if level < atomic.LoadInt32(&logLevel) {
+		return
+	}
+	entry.Time = time.Now().Format("2006-01-02T15:04:05.000000Z07:00")
+	entry.Level = logLevelNames[level]
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"level":"error","msg":%q}`, err.Error()))
+	}
+	log.Print(string(b))
+}
+
+// Log message, skip is the number of frames above logf caller.
+func logf(ctx context.Context, level int32, skip int, format string, a ...interface{}) {
+	if level < atomic.LoadInt32(&logLevel) {
+		return
+	}
+	entry := logEntry{Msg: fmt.Sprintf(format, a...), RequestID: ctxRequestID(ctx)}
+	if function, file, line, ok := runtime.Caller(skip + 1); ok {
+		entry.Caller = fmt.Sprintf("%s:%d %s", filepath.Base(file), line, runtime.FuncForPC(function).Name())
+	}
+	writeLog(level, entry)
+}
+
+func logDebug(ctx context.Context, format string, a ...interface{}) {
+	logf(ctx, LOG_DEBUG, 1, format, a...)
+}
+
+func logInfo(ctx context.Context, format string, a ...interface{}) {
+	logf(ctx, LOG_INFO, 1, format, a...)
+}
+
+func logWarning(ctx context.Context, format string, a ...interface{}) {
+	logf(ctx, LOG_WARNING, 1, format, a...)
+}
+
+func logError(ctx context.Context, format string, a ...interface{}) {
+	logf(ctx, LOG_ERROR, 1, format, a...)
+}
+
+// Log request, once for each request, after response.
+func logRequest(req *http.Request, status int, start time.Time) {
+	level := LOG_INFO
+	if status >= http.StatusInternalServerError {
+		level = LOG_ERROR
+	}
+	writeLog(level, logEntry{
+		Msg:       "request",
+		RequestID: requestID(req),
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Status:    status,
+		Duration:  msSince(start),
+	})
+}
+
+// Context with request id, sent to upstream services and logged.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, CTX_REQUEST_ID, id)
+}
+
+// Request id from context, empty if none.
+func ctxRequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(CTX_REQUEST_ID).(string)
+	return id
+}
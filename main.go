@@ -2,21 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
-	"path/filepath"
-	"runtime"
+	"strconv"
 	"time"
 	"unicode"
 
-	"github.com/go-redis/redis/v7"
 	"github.com/jmoiron/sqlx"
 	"github.com/julienschmidt/httprouter"
-	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/text/transform"
 	"golang.org/x/text/unicode/norm"
 )
@@ -28,9 +30,7 @@ const (
 	Zoom
 )
 
-// Server address.
-var runMode string
-var address string
+// Router.
 var router *httprouter.Router
 
 var err error
@@ -41,9 +41,6 @@ var initTime time.Time
 var sql3DBPath string
 var sql3DB *sqlx.DB
 
-// Redis.
-var redisClient *redis.Client
-
 // Production mode.
 var production bool
 
@@ -64,11 +61,6 @@ func normalizeString(str string) string {
 
 func init() {
 	// log.Printf("args: %+v", os.Args)
-	// Check if production mode.
-	if os.Getenv("RUN_MODE") == "production" {
-		production = true
-	}
-
 	// Brazil location.
 	brLocation, err = time.LoadLocation("America/Sao_Paulo")
 	if err != nil {
@@ -78,93 +70,135 @@ func init() {
 	// Text normalization.
 	trans = transform.Chain(norm.NFD, transform.RemoveFunc(isMn), norm.NFC)
 
-	// Listern address.
-	address = ":8081"
-
-	// Log path.
-	zunkaPath := os.Getenv("ZUNKAPATH")
-	if zunkaPath == "" {
-		panic("ZUNKAPATH not defined.")
-	}
-	logPath := path.Join(zunkaPath, "log", "freightsrv")
-	os.MkdirAll(logPath, os.ModePerm)
-	// Open log file.
-	logFile, err := os.OpenFile(path.Join(logPath, "freightsrv.log"), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
-	if err != nil {
-		panic(err)
-	}
-
-	// Log configuration.
-	mw := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(mw)
-	// log.SetFlags(log.LstdFlags)
-	// log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.SetPrefix("[freightsrv] ")
-	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lmsgprefix)
-
-	// Sqlite3 DB.
-	zunkaFreightDB := os.Getenv("ZUNKA_FREIGHT_DB")
-	if zunkaFreightDB == "" {
-		panic("ZUNKA_FREIGHT_DB not defined.")
-	}
-	sql3DBPath = path.Join(zunkaPath, "db", zunkaFreightDB)
+	// Log configuration, json lines with time from logger.
+	log.SetPrefix("")
+	log.SetFlags(0)
 
-	// Init router.
+	// Init router, routes by role required.
 	router = httprouter.New()
 
 	// Address.
-	router.GET("/freightsrv/address", checkAuthorization(addressHandler, []string{"zunkasite"}))
+	router.GET("/freightsrv/address", checkAuthorization(addressHandler, ROLE_QUOTER))
 
 	// Freights.
-	router.GET("/freightsrv/", checkAuthorization(indexHandler, []string{"zunkasite", "zoombuscape"}))
-	router.GET("/freightsrv/hello", checkAuthorization(indexHandler, []string{"zunkasite", "zoombuscape"}))
+	router.GET("/freightsrv/", checkAuthorization(indexHandler, ROLE_QUOTER))
+	router.GET("/freightsrv/hello", checkAuthorization(indexHandler, ROLE_QUOTER))
+	router.GET("/freightsrv/healthz", healthzHandler)
+	router.GET("/freightsrv/readyz", readyzHandler)
+	// Monitor, without prefix.
+	router.GET("/healthz", healthzHandler)
+	router.GET("/readyz", readyzHandler)
+	router.GET("/freightsrv/metrics", checkAuthorization(metricsHandler, ROLE_OPS_ADMIN))
+	router.GET("/freightsrv/admin/log-level", checkAuthorization(getLogLevelHandler, ROLE_OPS_ADMIN))
+	router.PUT("/freightsrv/admin/log-level", checkAuthorization(setLogLevelHandler, ROLE_OPS_ADMIN))
+	router.GET("/freightsrv/admin/cache", checkAuthorization(getCacheStatsHandler, ROLE_OPS_ADMIN))
+	router.GET("/freightsrv/admin/cache/correios", checkAuthorization(getCorreiosCacheHandler, ROLE_OPS_ADMIN))
+	router.DELETE("/freightsrv/admin/cache", checkAuthorization(purgeCacheHandler, ROLE_OPS_ADMIN))
 	// todo - remove user test from this point.
-	router.GET("/freightsrv/freights/zunka", checkAuthorization(freightsZunkaHandlerV2, []string{"zunkasite"}))
+	router.GET("/freightsrv/freights/zunka", checkAuthorization(freightsZunkaHandlerV2, ROLE_QUOTER))
 	// router.POST("/freightsrv/freights/zoom", checkAuthorization(freightsZoomHandler, []string{"zoombuscape"}))
-	router.POST("/freightsrv/freights/zoom", freightsZoomHandlerV2)
+	// No authorization, rate limited by source IP.
+	router.POST("/freightsrv/freights/zoom", checkRateLimit(freightsZoomHandlerV2))
 	// router.POST("/freightsrv/freights/zoom", freightsZoomHandler)
+	router.GET("/freightsrv/quotes/:id", checkAuthorization(getQuoteHandler, ROLE_QUOTER))
+	router.POST("/freightsrv/quotes/:id/confirm", checkAuthorization(confirmQuoteHandler, ROLE_QUOTER))
+	router.GET("/freightsrv/quote-stats", checkAuthorization(getQuoteStatsHandler, ROLE_RATES_VIEWER))
+	router.GET("/freightsrv/quote-stats/csv", checkAuthorization(exportQuoteStatsCSVHandler, ROLE_RATES_VIEWER))
 
 	// Motoboy.
-	router.GET("/freightsrv/motoboy-freights", checkAuthorization(getAllMotoboyFreightHandler, []string{"zunkasite"}))
-	router.GET("/freightsrv/motoboy-freight/:id", checkAuthorization(getMotoboyFreightHandler, []string{"zunkasite"}))
-	router.DELETE("/freightsrv/motoboy-freight/:id", checkAuthorization(deleteMotoboyFreightHandler, []string{"zunkasite"}))
-	router.PUT("/freightsrv/motoboy-freight", checkAuthorization(updateMotoboyFreightHandler, []string{"zunkasite"}))
-	router.POST("/freightsrv/motoboy-freight", checkAuthorization(createMotoboyFreightHandler, []string{"zunkasite"}))
+	router.GET("/freightsrv/motoboy-freights", checkAuthorization(getAllMotoboyFreightHandler, ROLE_RATES_VIEWER))
+	router.GET("/freightsrv/motoboy-freight/:id", checkAuthorization(getMotoboyFreightHandler, ROLE_RATES_VIEWER))
+	router.DELETE("/freightsrv/motoboy-freight/:id", checkAuthorization(deleteMotoboyFreightHandler, ROLE_RATES_ADMIN))
+	router.PUT("/freightsrv/motoboy-freight", checkAuthorization(updateMotoboyFreightHandler, ROLE_RATES_ADMIN))
+	router.POST("/freightsrv/motoboy-freight", checkAuthorization(createMotoboyFreightHandler, ROLE_RATES_ADMIN))
+	router.GET("/freightsrv/motoboy-freights/csv", checkAuthorization(exportMotoboyFreightCSVHandler, ROLE_RATES_VIEWER))
+	router.POST("/freightsrv/motoboy-freights/csv", checkAuthorization(importMotoboyFreightCSVHandler, ROLE_RATES_ADMIN))
 
 	// Region.
-	router.GET("/freightsrv/region-freights", checkAuthorization(getAllRegionFreightHandler, []string{"zunkasite"}))
-	router.GET("/freightsrv/region-freight/:id", checkAuthorization(getOneRegionFreightHandler, []string{"zunkasite"}))
-	router.DELETE("/freightsrv/region-freight/:id", checkAuthorization(deleteRegionFreightHandler, []string{"zunkasite"}))
-	router.PUT("/freightsrv/region-freight", checkAuthorization(updateRegionFreightHandler, []string{"zunkasite"}))
-	router.POST("/freightsrv/region-freight", checkAuthorization(createRegionFreightHandler, []string{"zunkasite"}))
+	router.GET("/freightsrv/region-freights", checkAuthorization(getAllRegionFreightHandler, ROLE_RATES_VIEWER))
+	router.GET("/freightsrv/region-freight/:id", checkAuthorization(getOneRegionFreightHandler, ROLE_RATES_VIEWER))
+	router.DELETE("/freightsrv/region-freight/:id", checkAuthorization(deleteRegionFreightHandler, ROLE_RATES_ADMIN))
+	router.PUT("/freightsrv/region-freight", checkAuthorization(updateRegionFreightHandler, ROLE_RATES_ADMIN))
+	router.POST("/freightsrv/region-freight", checkAuthorization(createRegionFreightHandler, ROLE_RATES_ADMIN))
+	router.GET("/freightsrv/region-freights/csv", checkAuthorization(exportRegionFreightCSVHandler, ROLE_RATES_VIEWER))
+	router.POST("/freightsrv/region-freights/csv", checkAuthorization(importRegionFreightCSVHandler, ROLE_RATES_ADMIN))
 
 	// Dealer.
-	router.GET("/freightsrv/dealer-freights", checkAuthorization(getAllDealerFreightHandler, []string{"zunkasite"}))
-	router.GET("/freightsrv/dealer-freight/:id", checkAuthorization(getOneDealerFreightHandler, []string{"zunkasite"}))
-	router.DELETE("/freightsrv/dealer-freight/:id", checkAuthorization(deleteDealerFreightHandler, []string{"zunkasite"}))
-	router.PUT("/freightsrv/dealer-freight", checkAuthorization(updateDealerFreightHandler, []string{"zunkasite"}))
-	router.POST("/freightsrv/dealer-freight", checkAuthorization(createDealerFreightHandler, []string{"zunkasite"}))
+	router.GET("/freightsrv/dealer-freights", checkAuthorization(getAllDealerFreightHandler, ROLE_RATES_VIEWER))
+	router.GET("/freightsrv/dealer-freight/:id", checkAuthorization(getOneDealerFreightHandler, ROLE_RATES_VIEWER))
+	router.DELETE("/freightsrv/dealer-freight/:id", checkAuthorization(deleteDealerFreightHandler, ROLE_RATES_ADMIN))
+	router.PUT("/freightsrv/dealer-freight", checkAuthorization(updateDealerFreightHandler, ROLE_RATES_ADMIN))
+	router.POST("/freightsrv/dealer-freight", checkAuthorization(createDealerFreightHandler, ROLE_RATES_ADMIN))
+	router.GET("/freightsrv/dealer-freights/csv", checkAuthorization(exportDealerFreightCSVHandler, ROLE_RATES_VIEWER))
+	router.POST("/freightsrv/dealer-freights/csv", checkAuthorization(importDealerFreightCSVHandler, ROLE_RATES_ADMIN))
+
+	// Rate versions.
+	router.GET("/freightsrv/rate-versions", checkAuthorization(getAllRateVersionHandler, ROLE_RATES_VIEWER))
+	router.GET("/freightsrv/rate-versions/diff", checkAuthorization(diffRateVersionHandler, ROLE_RATES_VIEWER))
+	router.GET("/freightsrv/rate-version/:id", checkAuthorization(getOneRateVersionHandler, ROLE_RATES_VIEWER))
+	router.DELETE("/freightsrv/rate-version/:id", checkAuthorization(deleteRateVersionHandler, ROLE_RATES_ADMIN))
+	router.PUT("/freightsrv/rate-version/:id", checkAuthorization(updateRateVersionHandler, ROLE_RATES_ADMIN))
+	router.POST("/freightsrv/rate-version", checkAuthorization(createRateVersionHandler, ROLE_RATES_ADMIN))
+
+	// Audit.
+	router.GET("/freightsrv/audit", checkAuthorization(getAuditHandler, ROLE_OPS_ADMIN))
+
+	// Users.
+	router.GET("/freightsrv/admin/users", checkAuthorization(getAllUsersHandler, ROLE_OPS_ADMIN))
+	router.GET("/freightsrv/admin/user/:username", checkAuthorization(getOneUserHandler, ROLE_OPS_ADMIN))
+	router.DELETE("/freightsrv/admin/user/:username", checkAuthorization(deleteUserHandler, ROLE_OPS_ADMIN))
+	router.PUT("/freightsrv/admin/user/:username", checkAuthorization(updateUserHandler, ROLE_OPS_ADMIN))
+	router.POST("/freightsrv/admin/user", checkAuthorization(createUserHandler, ROLE_OPS_ADMIN))
+	router.POST("/freightsrv/admin/user/:username/credential", checkAuthorization(createCredentialHandler, ROLE_OPS_ADMIN))
+	router.DELETE("/freightsrv/admin/user/:username/credential/:id", checkAuthorization(deleteCredentialHandler, ROLE_OPS_ADMIN))
 }
 
-func initRedis() {
-	// Connect to Redis DB.
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-	pong, err := redisClient.Ping().Result()
-	if err != nil || pong != "PONG" {
-		log.Panicf("[panic] Couldn't connect to Redis DB. %s", err)
+// Use configuration, log file and db path.
+func applyConfig(c config) error {
+	cfg = c
+	production = c.Mode == RUN_PRODUCTION
+	sql3DBPath = c.dbPath()
+
+	// Log level, info in production if not defined.
+	level := c.LogLevel
+	if level == "" {
+		level = logLevelNames[LOG_DEBUG]
+		if production {
+			level = logLevelNames[LOG_INFO]
+		}
 	}
-	// log.Printf("Connected to Redis")
-}
-func closeRedis() {
-	// log.Printf("Closing Redis connection...")
+	if err := setLogLevel(level); err != nil {
+		return err
+	}
+
+	// Log file.
+	logPath = c.logDir()
+	if logPath == "" {
+		log.SetOutput(os.Stdout)
+		return nil
+	}
+	os.MkdirAll(logPath, os.ModePerm)
+	logFile, err := os.OpenFile(path.Join(logPath, "freightsrv.log"), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(io.MultiWriter(os.Stdout, logFile))
+	return nil
 }
 
 func initSql3DB() {
-	sql3DB = sqlx.MustConnect("sqlite3", sql3DBPath)
+	// Driver observing statements latency, sqlite3 bind vars.
+	// Transactions lock for write at begin, so concurrent writers wait busy timeout instead of failing on lock upgrade.
+	db, err := sql.Open(SQLITE_METRICS_DRIVER, sql3DBPath+"?_txlock=immediate&_busy_timeout=5000")
+	if err != nil {
+		logError(context.Background(), "Couldn't open Sqlite3 DB. %s", err)
+		panic(err)
+	}
+	sql3DB = sqlx.NewDb(db, "sqlite3")
+	if err = sql3DB.Ping(); err != nil {
+		logError(context.Background(), "Couldn't connect to Sqlite3 DB. %s", err)
+		panic(err)
+	}
 	// log.Printf("Connected to Sqlite3")
 }
 
@@ -174,29 +208,73 @@ func closeSql3DB() {
 }
 
 func main() {
-	// Log start.
-	runMode := "development"
-	if production {
-		runMode = "production"
+	// Config.
+	configFile := flag.String("config", os.Getenv(CONFIG_ENV), "Config yaml file, environment variables override it.")
+	printConfig := flag.Bool("print-config", false, "Print effective config, secrets redacted, and exit.")
+	createAdmin := flag.String("create-admin", "", "Create ops-admin user with a generated password, print it and exit.")
+	flag.Parse()
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *printConfig {
+		b, err := c.redactedYAML()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(b)
+		return
 	}
-	log.Printf("Running in %v mode (version %s)\n", runMode, version)
+	if err = applyConfig(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Log start.
+	logInfo(context.Background(), "Running in %v mode (version %s), log level %s", cfg.Mode, version, getLogLevel())
 
-	// Redis.
-	initRedis()
-	defer closeRedis()
+	// Cache.
+	initCache()
+	defer closeCache()
 
 	// Sqlite3
 	initSql3DB()
 	defer closeSql3DB()
+	// Stats recorded in background.
+	defer quoteStatsWG.Wait()
+
+	// First admin, to manage the other users.
+	if *createAdmin != "" {
+		password, err := bootstrapAdmin(*createAdmin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Admin %s created, password: %s\n", *createAdmin, password)
+		return
+	}
+
+	// Activate scheduled rate versions.
+	go runRateVersionScheduler()
+
+	// Purge old quotes.
+	go runQuotePurge()
+
+	// Pre-fetch popular destinations at off-peak hours.
+	if cfg.Warm.Enabled {
+		go runCacheWarming()
+	}
 
 	// Create server.
 	server := &http.Server{
-		Addr:    address,
+		Addr:    cfg.Listen,
 		Handler: newLogger(router),
 		// ErrorLog:     logger,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
+		ReadTimeout:  cfg.HTTP.ReadTimeout,
+		WriteTimeout: cfg.HTTP.WriteTimeout,
+		IdleTimeout:  cfg.HTTP.IdleTimeout,
 	}
 
 	// Gracegull shutdown.
@@ -205,25 +283,27 @@ func main() {
 	signal.Notify(serverStopRequest, os.Interrupt)
 	go shutdown(server, serverStopRequest, serverStopFinish)
 
-	log.Printf("listen address: %s", address[1:])
+	logInfo(context.Background(), "Listen address: %s", cfg.Listen)
 	// log.Fatal(http.ListenAndServe(address, newLogger(router)))
 	if err = server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Error: Could not listen on %s. %v\n", address, err)
+		logError(context.Background(), "Could not listen on %s. %v", cfg.Listen, err)
+		os.Exit(1)
 	}
 	<-serverStopFinish
-	log.Println("Server stopped")
+	logInfo(context.Background(), "Server stopped")
 }
 
 func shutdown(server *http.Server, serverStopRequest <-chan os.Signal, serverStopFinish chan<- bool) {
 	<-serverStopRequest
-	log.Println("Server is shutting down...")
+	logInfo(context.Background(), "Server is shutting down...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	server.SetKeepAlivesEnabled(false)
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Could not gracefully shutdown the server: %v\n", err)
+		logError(context.Background(), "Could not gracefully shutdown the server: %v", err)
+		os.Exit(1)
 	}
 	close(serverStopFinish)
 }
@@ -231,38 +311,64 @@ func shutdown(server *http.Server, serverStopRequest <-chan os.Signal, serverSto
 /**************************************************************************************************
 * AUTHORIZATION MIDDLEWARE
 **************************************************************************************************/
-// Authorization.
-func checkAuthorization(h httprouter.Handle, users []string) httprouter.Handle {
+// Authorization by role required, rate limited by authenticated user.
+func checkAuthorization(h httprouter.Handle, role string) httprouter.Handle {
+	h = checkRateLimit(h)
 	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
 		user, pass, ok := req.BasicAuth()
 
 		// Check if api is valid for this user.
 		if ok {
-			// For test.
+			if !checkAuthRateLimit(w, req) {
+				return
+			}
+			// For test, all roles.
 			if !production && user == "bypass" && pass == "123456" {
-				h(w, req, p)
+				h(w, withAuthUser(req, user), p)
 				return
 
 			}
-			// Check if user exist.
-			for _, userValid := range users {
-				// Check if user is valid.
-				if userValid == user {
-					if checkUserPass(user, pass) {
-						h(w, req, p)
-						return
-					}
+			if roles, ok := checkCredentials(req.Context(), user, pass); ok {
+				if !hasRole(roles, role) {
+					logWarning(req.Context(), "User %s without role %s for %s %s", user, role, req.Method, req.URL.Path)
+					writeError(w, req, newForbiddenError("Role %s required", role))
+					return
 				}
+				h(w, withAuthUser(req, user), p)
+				return
 			}
 		}
 
 		// Unauthorised.
 		// log.Printf("Auth -> method: %v, url: %v, user: %v, pass: %v, ok: %v", req.Method, req.URL.Path, user, pass, ok)
-		w.Header().Set("WWW-Authenticate", `Basic realm="Please enter your username and password for this service"`)
-		w.WriteHeader(401)
-		w.Write([]byte("Unauthorised\n"))
-		return
+		writeUnauthorized(w)
+	}
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Please enter your username and password for this service"`)
+	w.WriteHeader(401)
+	w.Write([]byte("Unauthorised\n"))
+}
+
+// Context key type.
+type contextKey string
+
+// Authenticated user context key.
+const CTX_AUTH_USER contextKey = "authUser"
+
+// Request with authenticated user.
+func withAuthUser(req *http.Request, user string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), CTX_AUTH_USER, user))
+}
+
+// User authenticated by checkAuthorization.
+func authUser(req *http.Request) string {
+	if req == nil {
+		return ""
 	}
+	user, _ := req.Context().Value(CTX_AUTH_USER).(string)
+	return user
 }
 
 /**************************************************************************************************
@@ -273,13 +379,22 @@ type logger struct {
 	handler http.Handler
 }
 
-// Handle interface.
-// todo - why DELETE is logging twice?
+// Handle interface, logs once for each request, after the response.
 func (l *logger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// log.Printf("%s %s - begin", req.Method, req.URL.Path)
 	start := time.Now()
-	l.handler.ServeHTTP(w, req)
-	log.Printf("%s %s %v", req.Method, req.URL.Path, time.Since(start))
+	// Request id, from client or a new one.
+	id := req.Header.Get("X-Request-ID")
+	if id == "" {
+		id = newRequestID()
+		req.Header.Set("X-Request-ID", id)
+	}
+	w.Header().Set("X-Request-ID", id)
+	req = req.WithContext(withRequestID(req.Context(), id))
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	l.handler.ServeHTTP(rec, req)
+	observeRequest(req, rec.status, start)
+	logRequest(req, rec.status, start)
 	// log.Printf("header: %v", req.Header)
 }
 
@@ -288,21 +403,37 @@ func newLogger(h http.Handler) *logger {
 	return &logger{handler: h}
 }
 
+// New request id.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Request id set by logger middleware.
+func requestID(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	return req.Header.Get("X-Request-ID")
+}
+
 func checkFatalError(err error) {
 	if err != nil {
-		log.Fatal(err)
+		logError(context.Background(), "%v", err)
+		os.Exit(1)
 	}
 }
 
 /**************************************************************************************************
 * ERROS
 **************************************************************************************************/
-func checkError(err error) bool {
+// Log error with request id and where it happened, true if error.
+func checkError(ctx context.Context, err error) bool {
 	if err != nil {
-		// notice that we're using 1, so it will actually log where
-		// the error happened, 0 = this function, we don't want that.
-		function, file, line, _ := runtime.Caller(1)
-		log.Printf("[error] [%s] [%s:%d] %v", filepath.Base(file), runtime.FuncForPC(function).Name(), line, err)
+		logf(ctx, LOG_ERROR, 1, "%v", err)
 		return true
 	}
 	return false
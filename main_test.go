@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -26,20 +30,64 @@ func TestMain(m *testing.M) {
 }
 
 func setupTest() {
-	initRedis()
+	c, err := loadConfig(os.Getenv(CONFIG_ENV))
+	// No db configured, use a temporary one from db scripts.
+	if err != nil && c.dbPath() == "" {
+		c.DB.Path, err = createTestDB()
+	}
+	// Rate limit tested on its own, not limiting other tests.
+	c.RateLimit.Enabled = false
+	if err == nil {
+		err = applyConfig(c)
+	}
+	if err != nil {
+		log.Fatalf("Test config. %v", err)
+	}
+	initCache()
 	initSql3DB()
 
 	// Clean cep region.
 	cep := strings.ReplaceAll(cepNortheast, "-", "")
-	err := redisDel("cep-region-" + cep)
+	err = redisDel("cep-region-" + cep)
 	if err != nil {
 		log.Printf("Deleting cep-region. %v\n", err)
 	}
 }
 
 func shutdownTest() {
-	closeRedis()
+	quoteStatsWG.Wait()
+	closeCache()
 	closeSql3DB()
+	if testDBDir != "" {
+		os.RemoveAll(testDBDir)
+	}
+}
+
+// Temporary db dir, removed at shutdown.
+var testDBDir string
+
+// Create db from tables and data scripts.
+func createTestDB() (string, error) {
+	var err error
+	if testDBDir, err = ioutil.TempDir("", "freightsrv"); err != nil {
+		return "", err
+	}
+	dbPath := path.Join(testDBDir, "freight.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	for _, script := range []string{"bin/db/tables.sql", "bin/db/data.sql"} {
+		b, err := ioutil.ReadFile(script)
+		if err != nil {
+			return "", err
+		}
+		if _, err = db.Exec(string(b)); err != nil {
+			return "", fmt.Errorf("%s: %v", script, err)
+		}
+	}
+	return dbPath, nil
 }
 
 func Test_TextNormalization(t *testing.T) {
@@ -51,6 +99,86 @@ func Test_TextNormalization(t *testing.T) {
 	}
 }
 
+func TestConfig(t *testing.T) {
+	// Defaults, file and environment override.
+	file := path.Join(os.TempDir(), "freightsrv-test-config.yaml")
+	defer os.Remove(file)
+	yml := "zunkaPath: /tmp/zunka\ndb:\n  file: freight.db\nredis:\n  password: secret\ncache:\n  correiosTTL: 12h\npack:\n  maxWeight: 30000\n"
+	if err := ioutil.WriteFile(file, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Db from file only.
+	for _, name := range []string{"ZUNKAPATH", "ZUNKA_FREIGHT_DB", "FREIGHTSRV_DB_PATH"} {
+		if val, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			defer os.Setenv(name, val)
+		}
+	}
+	os.Setenv("FREIGHTSRV_LISTEN", ":9090")
+	defer os.Unsetenv("FREIGHTSRV_LISTEN")
+	c, err := loadConfig(file)
+	if err != nil {
+		t.Fatalf("Loading config. %v", err)
+	}
+	if c.Listen != ":9090" || c.Cache.CorreiosTTL != 12*time.Hour || c.Cache.CEPRegionTTL != 168*time.Hour || c.Pack.MaxWeight != 30000 || c.Correios.MaxSum != 200 {
+		t.Errorf("Unexpected config: %+v", c)
+	}
+	if c.dbPath() != "/tmp/zunka/db/freight.db" {
+		t.Errorf("db path = %q", c.dbPath())
+	}
+
+	// Redacted.
+	b, err := c.redactedYAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") || !strings.Contains(string(b), CONFIG_REDACTED) || !strings.Contains(string(b), "correiosTTL: 12h0m0s") {
+		t.Errorf("Redacted config:\n%s", b)
+	}
+	if c.Redis.Password != "secret" {
+		t.Errorf("Config changed by redaction")
+	}
+
+	// Invalid.
+	os.Setenv("FREIGHTSRV_PACK_MIN_WEIGHT", "40000")
+	defer os.Unsetenv("FREIGHTSRV_PACK_MIN_WEIGHT")
+	if _, err = loadConfig(file); err == nil || !strings.Contains(err.Error(), "minWeight") {
+		t.Errorf("Want weight limits error, got %v", err)
+	}
+	os.Unsetenv("FREIGHTSRV_PACK_MIN_WEIGHT")
+	os.Setenv("FREIGHTSRV_CORREIOS_TIMEOUT", "4s")
+	if _, err = loadConfig(file); err == nil || !strings.Contains(err.Error(), "upstreams.correios timeout with retries") {
+		t.Errorf("Want correios over quote budget error, got %v", err)
+	}
+	os.Unsetenv("FREIGHTSRV_CORREIOS_TIMEOUT")
+	os.Setenv("FREIGHTSRV_PACK_MIN_WEIGHT", "abc")
+	if _, err = loadConfig(file); err == nil || !strings.Contains(err.Error(), "FREIGHTSRV_PACK_MIN_WEIGHT") {
+		t.Errorf("Want invalid env error, got %v", err)
+	}
+	if err = ioutil.WriteFile(file, []byte("lisen: :8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Unsetenv("FREIGHTSRV_PACK_MIN_WEIGHT")
+	if _, err = loadConfig(file); err == nil {
+		t.Errorf("Want unknown key error")
+	}
+}
+
+// Product price limits from config.
+func TestZunkaProductValidatePrice(t *testing.T) {
+	defer func(p packLimits) { cfg.Pack = p }(cfg.Pack)
+	cfg.Pack.MaxPrice = 5000
+	zp := zunkaProduct{ID: "1234", Length: 20, Width: 90, Height: 39, Weight: 1250, Quantity: 1, Price: 4000}
+	if err := zp.Validate(); err != nil {
+		t.Errorf("Validating price under max. %v", err)
+	}
+	zp.Price = 6000
+	aErr, ok := zp.Validate().(*apiError)
+	if !ok || aErr.Code != ERR_INVALID_PRICE {
+		t.Errorf("got %v, want %s", aErr, ERR_INVALID_PRICE)
+	}
+}
+
 func TestRedis(t *testing.T) {
 	want := "Hello!"
 	key := "freightsrv-test"
@@ -66,6 +194,404 @@ func TestRedis(t *testing.T) {
 	}
 }
 
+func TestMemoryCache(t *testing.T) {
+	mc := newMemoryCache(2)
+	mc.Set("a", "1", 0)
+	mc.Set("b", "2", time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if _, err := mc.Get("b"); err != errCacheMiss {
+		t.Errorf("Expired key, got err %v, want cache miss", err)
+	}
+	// Least recently used evicted.
+	mc.Set("b", "2", time.Minute)
+	mc.Get("a")
+	mc.Set("c", "3", time.Minute)
+	if _, err := mc.Get("b"); err != errCacheMiss {
+		t.Errorf("Evicted key, got err %v, want cache miss", err)
+	}
+	if val, err := mc.Get("a"); err != nil || val != "1" {
+		t.Errorf("Get a = %q, %v, want 1", val, err)
+	}
+	mc.Del("a")
+	if _, err := mc.Get("a"); err != errCacheMiss {
+		t.Errorf("Deleted key, got err %v, want cache miss", err)
+	}
+
+	// Key families with memory backend.
+	defer func(c Cache) { cache = c }(cache)
+	cache = mc
+	setCEPRegion("31170-210", "south")
+	if region := getCEPRegion("31170210"); region != "south" {
+		t.Errorf("CEP region = %q, want south", region)
+	}
+	p := pack{CEPOrigin: "31170210", CEPDestiny: "01001000", Weight: 1000, Length: 20, Height: 10, Width: 15, Price: 100}
+	setCorreiosCache(&p, []*freight{{Carrier: "Correios", ServiceCode: "04014", Price: 30, Deadline: 3}})
+	if frs, stale, ok := getCorreiosCache(&p); !ok || stale || len(frs) != 1 || frs[0].Price != 30 {
+		t.Errorf("Correios cache = %+v, %v", frs, ok)
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	mc := newMemoryCache(10)
+	for i := 0; i < 2; i++ {
+		if wait, err := mc.TakeToken("bucket", 10, 2); err != nil || wait != 0 {
+			t.Fatalf("take %d = %v, %v, want burst of 2", i, wait, err)
+		}
+	}
+	// Empty, one token by 100ms.
+	wait, err := mc.TakeToken("bucket", 10, 2)
+	if err != nil || wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("wait = %v, %v, want up to 100ms", wait, err)
+	}
+	time.Sleep(110 * time.Millisecond)
+	if wait, err = mc.TakeToken("bucket", 10, 2); err != nil || wait != 0 {
+		t.Errorf("wait = %v, %v, want token refilled", wait, err)
+	}
+	if wait, _ = mc.TakeToken("other", 10, 2); wait != 0 {
+		t.Errorf("wait = %v, want other bucket full", wait)
+	}
+}
+
+func TestCorreiosStaleCache(t *testing.T) {
+	defer func(c Cache, conf config) { cache, cfg = c, conf }(cache, cfg)
+	cache = newMemoryCache(10)
+	p := pack{CEPOrigin: "31170210", CEPDestiny: "01001000", Weight: 1000, Length: 20, Height: 10, Width: 15, Price: 100}
+	frs := []*freight{{Carrier: "Correios", ServiceCode: "04014", Price: 30, Deadline: 3}}
+
+	// Legacy entry, only freights.
+	frsJSON, _ := json.Marshal(frs)
+	redisSet(makeCorreiosKey(&p), string(frsJSON), time.Minute)
+	if _, stale, ok := getCorreiosCache(&p); !ok || stale {
+		t.Errorf("Legacy entry, got ok %v, stale %v, want fresh", ok, stale)
+	}
+
+	// After soft TTL.
+	cfg.Cache.CorreiosTTL = -time.Minute
+	setCorreiosCache(&p, frs)
+	got, stale, ok := getCorreiosCache(&p)
+	if !ok || !stale || len(got) != 1 || got[0].Price != 30 {
+		t.Fatalf("got %+v, ok %v, stale %v, want stale freight", got, ok, stale)
+	}
+
+	// Served flagged, refresh in background.
+	c := make(chan *freightsOk)
+	go getCorreiosFreightByPack(context.Background(), c, &p)
+	result := <-c
+	if !result.Ok || len(result.Freights) != 1 || !result.Freights[0].Stale {
+		t.Errorf("got %+v, want stale freight", result)
+	}
+	b, _ := json.Marshal(result.Freights[0])
+	if !strings.Contains(string(b), `"stale":true`) {
+		t.Errorf("got %s, want stale flag", b)
+	}
+}
+
+func TestCorreiosBucket(t *testing.T) {
+	defer func(c Cache) { cache = c }(cache)
+	cache = newMemoryCache(10)
+
+	for weight, want := range map[int]int{250: 300, 300: 300, 301: 1000, 1001: 2000, 29500: 30000} {
+		if got := (pack{Weight: weight}).correiosBucket().Weight; got != want {
+			t.Errorf("weight %d bucket = %d, want %d", weight, got, want)
+		}
+	}
+	p := pack{CEPOrigin: "31170210", CEPDestiny: "01001000", Length: 21, Width: 16, Height: 11, Weight: 950, Price: 101.5}
+	bp := p.correiosBucket()
+	if bp.Length != 25 || bp.Width != 20 || bp.Height != 15 || bp.Weight != 1000 || bp.Price != 101.5 {
+		t.Errorf("bucket = %+v", bp)
+	}
+	// Price rounded only if configured.
+	defer func(step float64) { cfg.Correios.PriceStep = step }(cfg.Correios.PriceStep)
+	cfg.Correios.PriceStep = 50
+	if got := p.correiosBucket().Price; got != 150 {
+		t.Errorf("price bucket = %v, want 150", got)
+	}
+	cfg.Correios.PriceStep = 0
+	// Sum above limit, exact dimensions.
+	if bp := (pack{Length: 99, Width: 51, Height: 48}).correiosBucket(); bp.Length != 99 || bp.Width != 51 || bp.Height != 48 {
+		t.Errorf("bucket = %+v, want exact dimensions", bp)
+	}
+
+	// Similar pack, same bucket.
+	setCorreiosCache(&bp, []*freight{{Carrier: "Correios", ServiceCode: "04014", Price: 30, Deadline: 3}})
+	similar := pack{CEPOrigin: "31170210", CEPDestiny: "01001000", Length: 24, Width: 18, Height: 12, Weight: 700, Price: 101.5}
+	cacheBucketHits.mu.Lock()
+	before := cacheBucketHits.values[CACHE_CORREIOS]
+	cacheBucketHits.mu.Unlock()
+	c := make(chan *freightsOk)
+	go getCorreiosFreightByPack(context.Background(), c, &similar)
+	if result := <-c; !result.Ok || len(result.Freights) != 1 || result.Freights[0].Price != 30 {
+		t.Errorf("got %+v, want bucket freight", result)
+	}
+	cacheBucketHits.mu.Lock()
+	after := cacheBucketHits.values[CACHE_CORREIOS]
+	cacheBucketHits.mu.Unlock()
+	if after != before+1 {
+		t.Errorf("bucket hits %v, want %v", after, before+1)
+	}
+}
+
+func TestCacheWarming(t *testing.T) {
+	defer func(c Cache, conf config, counts map[warmKey]*warmCount) { cache, cfg, warmCounts = c, conf, counts }(cache, cfg, warmCounts)
+	cache = newMemoryCache(100)
+	warmCounts = map[warmKey]*warmCount{}
+	cfg.Warm.CEPs = []string{"01001-000"}
+	cfg.Warm.Packs = []warmPack{{Name: "notebook", Length: 40, Width: 30, Height: 10, Weight: 3000, Price: 4000}}
+	cfg.Warm.Top = 1
+	cfg.Warm.CallInterval = time.Millisecond
+
+	// Most quoted.
+	popular := pack{CEPOrigin: CEP_ORIGIN, CEPDestiny: "30140071", Length: 20, Width: 15, Height: 10, Weight: 1000, Price: 100}
+	other := popular
+	other.CEPDestiny = "70040010"
+	observeWarmPacks([]pack{popular, other})
+	popular.CEPDestiny = "30140072"
+	observeWarmPacks([]pack{popular})
+	top := topWarmPacks(cfg.Warm.Top)
+	if len(top) != 1 || top[0].CEPDestiny != "30140072" {
+		t.Errorf("top = %+v, want last CEP of most quoted prefix", top)
+	}
+	packs := warmPacks()
+	if len(packs) != 2 || packs[0].CEPDestiny != "01001000" || packs[0].Weight != 3000 || packs[1].CEPDestiny != "30140072" {
+		t.Errorf("warm packs = %+v", packs)
+	}
+
+	// All cached, nothing fetched.
+	for _, p := range packs {
+		setCorreiosCache(&p, []*freight{{Carrier: "Correios", ServiceCode: "04014", Price: 30, Deadline: 3}})
+		address := `{"cep": "` + p.CEPDestiny + `"}`
+		setViaCEPAddressCache(&p.CEPDestiny, &address)
+	}
+	if correios, viaCEP := warmCache(context.Background()); correios != 0 || viaCEP != 0 {
+		t.Errorf("warmed %d correios and %d viaCEP, want nothing", correios, viaCEP)
+	}
+
+	// Old destinations leave.
+	decayWarmCounts()
+	if len(warmCounts) != 1 {
+		t.Errorf("%d counts after decay, want 1", len(warmCounts))
+	}
+
+	// Off-peak hours across midnight.
+	cfg.Warm.StartHour, cfg.Warm.EndHour = 23, 2
+	for hour, want := range map[int]bool{22: false, 23: true, 1: true, 2: false} {
+		if got := isWarmHour(time.Date(2020, 1, 1, hour, 30, 0, 0, brLocation)); got != want {
+			t.Errorf("isWarmHour(%d) = %v, want %v", hour, got, want)
+		}
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	g := newFlightGroup("test")
+	release := make(chan struct{})
+	calls := 0
+	fn := func() (interface{}, error) {
+		calls++
+		<-release
+		return "val", nil
+	}
+	n := 5
+	type result struct {
+		val    interface{}
+		shared bool
+	}
+	results := make(chan result, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			val, _, shared := g.Do("key", fn)
+			results <- result{val, shared}
+		}()
+	}
+	// Wait callers join the call in flight.
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		coalescedCalls.mu.Lock()
+		waiting := coalescedCalls.values["test"]
+		coalescedCalls.mu.Unlock()
+		if waiting == float64(n-1) {
+			break
+		}
+	}
+	close(release)
+	shared := 0
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.val != "val" {
+			t.Errorf("val = %v, want val", r.val)
+		}
+		if r.shared {
+			shared++
+		}
+	}
+	if calls != 1 || shared != n-1 {
+		t.Errorf("calls = %d, shared = %d, want 1 call shared by %d", calls, shared, n-1)
+	}
+
+	// Not in flight anymore.
+	if _, _, shared := g.Do("key", func() (interface{}, error) { return nil, nil }); shared {
+		t.Errorf("Call done, want new call")
+	}
+}
+
+// Caller giving up doesn't cancel the shared call.
+func TestFlightGroupContext(t *testing.T) {
+	g := newFlightGroup("test-context")
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-release
+		close(finished)
+		return "val", nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err, _ := g.DoContext(ctx, "key", fn); err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+
+	// Other caller gets the result of the call in flight.
+	results := make(chan interface{}, 1)
+	go func() {
+		val, _, shared := g.DoContext(context.Background(), "key", fn)
+		if !shared {
+			val = "not shared"
+		}
+		results <- val
+	}()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		coalescedCalls.mu.Lock()
+		waiting := coalescedCalls.values["test-context"]
+		coalescedCalls.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+	}
+	close(release)
+	<-finished
+	if val := <-results; val != "val" {
+		t.Errorf("val = %v, want val from shared call", val)
+	}
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	defer func(conf config) {
+		cfg = conf
+		upstreamClients = map[string]*http.Client{}
+	}(cfg)
+	cfg.Upstreams.ViaCEP = upstreamConfig{ConnectTimeout: time.Second, Timeout: time.Second, Retries: 2, RetryBackoff: time.Millisecond}
+	upstreamClients = map[string]*http.Client{}
+
+	calls := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	// Idempotent, retried with body.
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL, strings.NewReader("pack"))
+	res, err := doUpstream(UPSTREAM_VIACEP, req, true)
+	if err != nil || res.StatusCode != 200 || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("got err %v, res %+v, %d calls, want 200 after 3 calls", err, res, atomic.LoadInt32(&calls))
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "pack" {
+		t.Errorf("body = %q, want pack", body)
+	}
+
+	// Not idempotent, not retried.
+	atomic.StoreInt32(&calls, 0)
+	req, _ = http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL, strings.NewReader("pack"))
+	if res, err = doUpstream(UPSTREAM_VIACEP, req, false); err != nil || res.StatusCode != 503 || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("got err %v, %d calls, want 503 after 1 call", err, atomic.LoadInt32(&calls))
+	}
+	res.Body.Close()
+
+	// Canceled, not retried.
+	atomic.StoreInt32(&calls, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = getUpstream(ctx, UPSTREAM_VIACEP, srv.URL+"/slow"); err == nil || atomic.LoadInt32(&calls) != 1 || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("got err %v, %d calls in %v, want canceled after 1 call", err, atomic.LoadInt32(&calls), time.Since(start))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer func(conf config) {
+		cfg = conf
+		upstreamClients = map[string]*http.Client{}
+		breakers = map[string]*circuitBreaker{}
+	}(cfg)
+	cfg.Upstreams.ViaCEP = upstreamConfig{ConnectTimeout: time.Second, Timeout: time.Second, BreakerFailures: 2, BreakerOpenTime: 50 * time.Millisecond}
+	upstreamClients = map[string]*http.Client{}
+	breakers = map[string]*circuitBreaker{}
+
+	calls := int32(0)
+	failing := int32(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	get := func() error {
+		res, err := getUpstream(context.Background(), UPSTREAM_VIACEP, srv.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	// Opened after consecutive failures.
+	for i := 0; i < 2; i++ {
+		if err := get(); err != nil {
+			t.Fatalf("got err %v, want 503", err)
+		}
+	}
+	if state := upstreamBreaker(UPSTREAM_VIACEP).currentState(); state != BREAKER_OPEN {
+		t.Fatalf("state = %s, want %s", state, BREAKER_OPEN)
+	}
+
+	// Open, not called.
+	if err := get(); err != errCircuitOpen || atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("got err %v, %d calls, want %v after 2 calls", err, atomic.LoadInt32(&calls), errCircuitOpen)
+	}
+	if h := checkUpstream(UPSTREAM_VIACEP); h.Status != HEALTH_DEGRADED || h.Breaker != BREAKER_OPEN {
+		t.Errorf("health = %+v, want %s with breaker %s", h, HEALTH_DEGRADED, BREAKER_OPEN)
+	}
+
+	// Half-open trial failed, opened again.
+	time.Sleep(60 * time.Millisecond)
+	if err := get(); err != nil || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("got err %v, %d calls, want trial call", err, atomic.LoadInt32(&calls))
+	}
+	if err := get(); err != errCircuitOpen {
+		t.Errorf("got err %v, want %v", err, errCircuitOpen)
+	}
+
+	// Half-open trial succeeded, closed.
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := get(); err != nil {
+			t.Errorf("got err %v, want 200", err)
+		}
+	}
+	if state := upstreamBreaker(UPSTREAM_VIACEP).currentState(); state != BREAKER_CLOSED || atomic.LoadInt32(&calls) != 5 {
+		t.Errorf("state = %s after %d calls, want %s after 5 calls", state, atomic.LoadInt32(&calls), BREAKER_CLOSED)
+	}
+}
+
 //*****************************************************************************
 // CEP
 //*****************************************************************************
@@ -82,8 +608,8 @@ func TestGetAddressByCEP(t *testing.T) {
 		State:    "MG",
 	}
 
-	address, err := getAddressByCEP("3-1170210")
-	if checkError(err) {
+	address, err := getAddressByCEP(context.Background(), "3-1170210")
+	if checkError(context.Background(), err) {
 		t.Error(err)
 	}
 
@@ -96,7 +622,7 @@ func TestGetAddressByCEP(t *testing.T) {
 func TestGetRegionByCEP(t *testing.T) {
 	// First time get from rest api.
 	want := "northeast"
-	result, err := getRegionByCEP(cepNortheast)
+	result, err := getRegionByCEP(context.Background(), cepNortheast)
 	if err != nil {
 		t.Errorf("Getting region from CEP. %v", err)
 	}
@@ -105,7 +631,7 @@ func TestGetRegionByCEP(t *testing.T) {
 	}
 
 	// Second time get from cache.
-	result, err = getRegionByCEP(cepNortheast)
+	result, err = getRegionByCEP(context.Background(), cepNortheast)
 	if err != nil {
 		t.Errorf("Getting region from CEP. %v", err)
 	}
@@ -153,7 +679,7 @@ func TestGetCorreiosFreightByPack(t *testing.T) {
 	}
 
 	c := make(chan *freightsOk)
-	go getCorreiosFreightByPack(c, p)
+	go getCorreiosFreightByPack(context.Background(), c, p)
 	frsOk := <-c
 
 	if !frsOk.Ok {
@@ -189,9 +715,9 @@ var fr regionFreight
 
 // Get all freight regions.
 func TestGetAllFreightRegion(t *testing.T) {
-	frS, ok := getAllFreightRegion()
-	if !ok {
-		t.Errorf("Get all freight region returned not ok.")
+	frS, err := getAllFreightRegion()
+	if err != nil {
+		t.Errorf("Get all freight region. %v", err)
 	}
 	frSLen := len(frS)
 	if frSLen == 0 {
@@ -210,9 +736,9 @@ func TestCreateFreightRegion(t *testing.T) {
 	}
 
 	// Create freight.
-	ok := createFreightRegion(&fr)
-	if !ok {
-		t.Errorf("Create freight region not returned ok.")
+	err := createFreightRegion(context.Background(), &fr, nil)
+	if err != nil {
+		t.Errorf("Create freight region. %v", err)
 	}
 
 	// Check saved data.
@@ -234,9 +760,9 @@ func TestCreateFreightRegion(t *testing.T) {
 
 // Get freight region by id.
 func TestGetFreightRegionById(t *testing.T) {
-	fr, ok := getFreightRegionById(fr.ID)
-	if !ok {
-		t.Errorf("Get freight region by id returned not ok.")
+	fr, err := getFreightRegionById(fr.ID)
+	if err != nil {
+		t.Errorf("Get freight region by id. %v", err)
 	}
 	if fr.Region == "" {
 		t.Errorf("region: %s, want not \"\".", fr.Region)
@@ -246,23 +772,23 @@ func TestGetFreightRegionById(t *testing.T) {
 // Update freight region.
 func TestUpdateFreightRegion(t *testing.T) {
 	fr.Price = 76543
-	ok := updateFreightRegion(&fr)
-	if !ok {
-		t.Error("Update freight region retuned not ok.")
+	err := updateFreightRegion(context.Background(), &fr, nil)
+	if err != nil {
+		t.Errorf("Update freight region. %v", err)
 	}
 }
 
 // Delete freight region.
 func TestDeleteFreightRegion(t *testing.T) {
-	ok := deleteFreightRegion(fr.ID)
-	if !ok {
-		t.Error("Delete freight region retuned not ok.")
+	err := deleteFreightRegion(fr.ID, nil)
+	if err != nil {
+		t.Errorf("Delete freight region. %v", err)
 	}
 }
 
 // Get freight region by region and weight.
 func TestGetFreightRegionByRegionAndWeight(t *testing.T) {
-	frs, ok := getFreightRegionByRegionAndWeight("south", 3000)
+	frs, ok := getFreightRegionByRegionAndWeight(context.Background(), "south", 3000)
 	if !ok {
 		t.Errorf("getFreightRegionByRegionAndWeight() returned not ok.")
 	}
@@ -282,7 +808,7 @@ func TestGetFreightRegionByRegionAndWeight(t *testing.T) {
 // Get freight region by CEP and wight.
 func TestGetFreightRegionByCEPAndWeight(t *testing.T) {
 	c := make(chan *freightsOk)
-	go getFreightRegionByCEPAndWeight(c, "31-170210", 3000)
+	go getFreightRegionByCEPAndWeight(context.Background(), c, "31-170210", 3000)
 	frsOk := <-c
 	if !frsOk.Ok {
 		t.Errorf("getFreightRegionByCEPAndWeight() returned not ok.")
@@ -314,13 +840,13 @@ func TestSaveMotoboyFreight(t *testing.T) {
 		Price:    12570,
 	}
 
-	err := saveMotoboyFreight(&mf)
+	err := saveMotoboyFreight(context.Background(), &mf)
 	if err != nil {
 		t.Errorf("Saving freight region. %s", err)
 		return
 	}
 
-	pmfr, ok := getMotoboyFreightByLocation("mg", "Barao de cocais")
+	pmfr, ok := getMotoboyFreightByLocation(context.Background(), "mg", "Barao de cocais")
 	if !ok {
 		t.Error("Motoboy freight returned not ok.")
 	}
@@ -351,9 +877,9 @@ func TestGetMotoboyFreightByID(t *testing.T) {
 	mf = motoboyFreight{
 		ID: validMotoboyFreightID,
 	}
-	pmf, ok := getMotoboyFreightByID(validMotoboyFreightID)
-	if !ok {
-		t.Error("Motoboy freight returned not ok.")
+	pmf, err := getMotoboyFreightByID(validMotoboyFreightID)
+	if err != nil {
+		t.Error(err)
 		return
 	}
 	if pmf.City != validMotoboyFreightCity {
@@ -368,7 +894,7 @@ func TestGetMotoboyFreightByLocation(t *testing.T) {
 	mf = motoboyFreight{
 		City: validMotoboyFreightCity,
 	}
-	pmf, ok := getMotoboyFreightByLocation("MG", validMotoboyFreightCity)
+	pmf, ok := getMotoboyFreightByLocation(context.Background(), "MG", validMotoboyFreightCity)
 	if !ok {
 		t.Error("Motoboy freight returned not ok.")
 	}
@@ -383,7 +909,7 @@ func TestGetMotoboyFreightByLocation(t *testing.T) {
 // Get motoboy freight by location.
 func TestGetMotoboyFreightByCEP(t *testing.T) {
 	c := make(chan *freightsOk)
-	go getMotoboyFreightByCEP(c, "31130210")
+	go getMotoboyFreightByCEP(context.Background(), c, "31130210")
 
 	frsOk := <-c
 	if !frsOk.Ok {
@@ -399,9 +925,9 @@ func TestGetMotoboyFreightByCEP(t *testing.T) {
 
 // Delete motoboy freight.
 func TestDelMotoboyFreight(t *testing.T) {
-	ok := deleteMotoboyFreight(validMotoboyFreightID)
-	if !ok {
-		t.Error(errors.New("Delete motoboy freight returned no ok."))
+	err := deleteMotoboyFreight(validMotoboyFreightID, nil)
+	if err != nil {
+		t.Error(err)
 	}
 }
 
@@ -409,7 +935,7 @@ func TestDelMotoboyFreight(t *testing.T) {
 // DEALER FREIGHT
 //*****************************************************************************
 var dealerFreightTemp = dealerFreight{
-	Dealer:   "allnations",
+	Dealer:   "allnations_sc",
 	Weight:   4000,
 	Deadline: 8,
 	Price:    12345,
@@ -554,7 +1080,7 @@ func TestDeleteDealerFreightAPI(t *testing.T) {
 }
 
 func TestGetDealerFreightByDealerAndWeight(t *testing.T) {
-	frs, ok := getDealerFreightByDealerAndWeight("aldo", 2000)
+	frs, ok := getDealerFreightByDealerAndWeight(context.Background(), "aldo", 2000)
 	if !ok {
 		t.Error("Returned not ok")
 		return
@@ -566,13 +1092,13 @@ func TestGetDealerFreightByDealerAndWeight(t *testing.T) {
 	// log.Printf("fr: %+v", fr)
 	// }
 
-	frs, ok = getDealerFreightByDealerAndWeight("allnations", 2000)
+	frs, ok = getDealerFreightByDealerAndWeight(context.Background(), "allnations", 2000)
 	if ok {
 		t.Error("Returned ok")
 		return
 	}
 
-	frs, ok = getDealerFreightByDealerAndWeight("allnations_rj", 5000)
+	frs, ok = getDealerFreightByDealerAndWeight(context.Background(), "allnations_rj", 5000)
 	if !ok {
 		t.Error("Returned not ok")
 		return
@@ -588,7 +1114,7 @@ func TestGetDealerFreightByDealerAndWeight(t *testing.T) {
 // Get motoboy freight by location.
 func TestGetDealerFreightByDealerLocationAndWeight(t *testing.T) {
 	c := make(chan *freightsOk)
-	go getDealerFreightByDealerLocationAndWeight(c, "allnations_rj", 5000)
+	go getDealerFreightByDealerLocationAndWeight(context.Background(), c, "allnations_rj", 5000)
 
 	frsOk := <-c
 	if !frsOk.Ok {
@@ -607,3 +1133,24 @@ func TestGetDealerFreightByDealerLocationAndWeight(t *testing.T) {
 	}
 	// log.Printf("*frsOk.Freights[0]: %+v", *frsOk.Freights[0])
 }
+
+// Roles included by other roles.
+func TestHasRole(t *testing.T) {
+	tests := []struct {
+		roles []string
+		role  string
+		want  bool
+	}{
+		{[]string{ROLE_QUOTER}, ROLE_QUOTER, true},
+		{[]string{ROLE_QUOTER}, ROLE_RATES_VIEWER, false},
+		{[]string{ROLE_RATES_ADMIN}, ROLE_RATES_VIEWER, true},
+		{[]string{ROLE_RATES_VIEWER}, ROLE_RATES_ADMIN, false},
+		{[]string{ROLE_OPS_ADMIN}, ROLE_RATES_ADMIN, false},
+		{nil, ROLE_QUOTER, false},
+	}
+	for _, test := range tests {
+		if got := hasRole(test.roles, test.role); got != test.want {
+			t.Errorf("hasRole(%v, %q) = %v, want %v", test.roles, test.role, got, test.want)
+		}
+	}
+}
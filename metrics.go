@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Histogram buckets in seconds.
+var (
+	METRICS_HTTP_BUCKETS   = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	METRICS_SQLITE_BUCKETS = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+)
+
+// Cache key families.
+const (
+	CACHE_CORREIOS          = "correios"
+	CACHE_CEP_REGION        = "cep-region"
+	CACHE_VIA_CEP_ADDRESS   = "via-cep-address"
+	CACHE_IBGE_CITIES       = "ibge-cities"
+	CACHE_QUOTE_RESERVATION = "quote-reservation"
+	CACHE_RATE_LIMIT        = "rate-limit"
+)
+
+// Route label for requests not matching any route, keep label values bounded.
+const METRICS_UNKNOWN_ROUTE = "unknown"
+
+// Metrics.
+var (
+	httpRequestsTotal    = newMetricCounter("freightsrv_http_requests_total", "HTTP requests by route, method and status.", "route", "method", "status")
+	httpRequestSecs      = newMetricHistogram("freightsrv_http_request_duration_seconds", "HTTP request latency by route and method.", METRICS_HTTP_BUCKETS, "route", "method")
+	upstreamSecs         = newMetricHistogram("freightsrv_upstream_request_duration_seconds", "Upstream call latency by service.", METRICS_HTTP_BUCKETS, "service")
+	upstreamErrors       = newMetricCounter("freightsrv_upstream_errors_total", "Upstream calls failed or answered with 5xx, by service.", "service")
+	upstreamRetries      = newMetricCounter("freightsrv_upstream_retries_total", "Upstream calls retried, by service.", "service")
+	upstreamRejected     = newMetricCounter("freightsrv_upstream_rejected_total", "Upstream calls not made because the circuit breaker is open, by service.", "service")
+	upstreamBreakerState = newMetricGauge("freightsrv_upstream_breaker_state", "Upstream circuit breaker state by service, 0 closed, 1 half-open and 2 open.", "service")
+	cacheHits            = newMetricCounter("freightsrv_cache_hits_total", "Redis cache hits by key family.", "family")
+	cacheMisses          = newMetricCounter("freightsrv_cache_misses_total", "Redis cache misses by key family.", "family")
+	cacheBucketHits      = newMetricCounter("freightsrv_cache_bucket_hits_total", "Cache hits of bucketed keys different from the exact pack key, by key family.", "family")
+	cacheStale           = newMetricCounter("freightsrv_cache_stale_total", "Stale cache values served by key family.", "family")
+	cacheWarmed          = newMetricCounter("freightsrv_cache_warmed_total", "Cache values pre-fetched at off-peak hours by key family.", "family")
+	rateLimited          = newMetricCounter("freightsrv_rate_limited_total", "Requests rejected by rate limit, by route.", "route")
+	coalescedCalls       = newMetricCounter("freightsrv_coalesced_calls_total", "Upstream calls saved by sharing an identical call in flight, by key family.", "family")
+	sqliteSecs           = newMetricHistogram("freightsrv_sqlite_query_duration_seconds", "Sqlite statement latency by operation.", METRICS_SQLITE_BUCKETS, "op")
+)
+
+// All metrics, in exposition order.
+var metrics = []metric{httpRequestsTotal, httpRequestSecs, upstreamSecs, upstreamErrors, upstreamRetries, upstreamRejected, upstreamBreakerState, cacheHits, cacheMisses, cacheBucketHits, cacheStale, cacheWarmed, coalescedCalls, rateLimited, sqliteSecs}
+
+/**************************************************************************************************
+* METRIC TYPES
+**************************************************************************************************/
+// Metric in Prometheus text format.
+type metric interface {
+	write(b *bytes.Buffer)
+}
+
+// Counter by labels.
+type metricCounter struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64 // Label values joined by \xff.
+}
+
+func newMetricCounter(name, help string, labels ...string) *metricCounter {
+	return &metricCounter{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// Increment counter.
+func (c *metricCounter) inc(labelValues ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(labelValues, "\xff")]++
+	c.mu.Unlock()
+}
+
+func (c *metricCounter) write(b *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatMetricValue(c.values[key]))
+	}
+}
+
+// Gauge by labels.
+type metricGauge struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64 // Label values joined by \xff.
+}
+
+func newMetricGauge(name, help string, labels ...string) *metricGauge {
+	return &metricGauge{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// Set gauge value.
+func (g *metricGauge) set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	g.values[strings.Join(labelValues, "\xff")] = v
+	g.mu.Unlock()
+}
+
+func (g *metricGauge) write(b *bytes.Buffer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(b, "%s%s %s\n", g.name, formatLabels(g.labels, key, "", ""), formatMetricValue(g.values[key]))
+	}
+}
+
+// Histogram by labels.
+type metricHistogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// Observations of one label set.
+type histogramValue struct {
+	counts []uint64 // By bucket, not cumulative.
+	count  uint64
+	sum    float64
+}
+
+func newMetricHistogram(name, help string, buckets []float64, labels ...string) *metricHistogram {
+	return &metricHistogram{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+}
+
+// Observe value.
+func (h *metricHistogram) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hv.counts[i]++
+			break
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// Observe time since start.
+func (h *metricHistogram) since(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *metricHistogram) write(b *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		cumulative := uint64(0)
+		for i, upper := range h.buckets {
+			cumulative += hv.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatMetricValue(upper)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatMetricValue(hv.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), hv.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Labels like {route="/freightsrv/cep",status="200"}, extra label if name not empty.
+func formatLabels(names []string, key string, extraName, extraValue string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, val := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+"="+strconv.Quote(val))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// All metrics in Prometheus text format.
+func writeMetrics(b *bytes.Buffer) {
+	for _, m := range metrics {
+		m.write(b)
+	}
+}
+
+/**************************************************************************************************
+* HTTP
+**************************************************************************************************/
+// Keep response status.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Route of request, like /freightsrv/quotes/:id.
+func metricsRoute(req *http.Request) string {
+	if router == nil {
+		return METRICS_UNKNOWN_ROUTE
+	}
+	handle, ps, _ := router.Lookup(req.Method, req.URL.Path)
+	if handle == nil {
+		return METRICS_UNKNOWN_ROUTE
+	}
+	segments := strings.Split(req.URL.Path, "/")
+	for _, p := range ps {
+		for i := range segments {
+			if segments[i] == p.Value {
+				segments[i] = ":" + p.Key
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// Observe request.
+func observeRequest(req *http.Request, status int, start time.Time) {
+	route := metricsRoute(req)
+	httpRequestsTotal.inc(route, req.Method, strconv.Itoa(status))
+	httpRequestSecs.since(start, route, req.Method)
+}
+
+/**************************************************************************************************
+* CACHE
+**************************************************************************************************/
+// Observe cache hit or miss.
+func observeCache(family string, hit bool) {
+	if hit {
+		cacheHits.inc(family)
+	} else {
+		cacheMisses.inc(family)
+	}
+}
+
+/**************************************************************************************************
+* SQLITE
+**************************************************************************************************/
+// Sqlite driver observing statements latency.
+const SQLITE_METRICS_DRIVER = "sqlite3_metrics"
+
+func init() {
+	sql.Register(SQLITE_METRICS_DRIVER, &sqliteMetricsDriver{})
+}
+
+type sqliteMetricsDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+func (d *sqliteMetricsDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteMetricsConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+// Sqlite connection, other methods from SQLiteConn.
+type sqliteMetricsConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c *sqliteMetricsConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer sqliteSecs.since(time.Now(), "exec")
+	return c.SQLiteConn.ExecContext(ctx, query, args)
+}
+
+func (c *sqliteMetricsConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer sqliteSecs.since(time.Now(), "query")
+	return c.SQLiteConn.QueryContext(ctx, query, args)
+}
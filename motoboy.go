@@ -1,21 +1,33 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
 )
 
 // Normalize city.
 func (mf *motoboyFreight) NormalizeCity() {
-	s := strings.ToLower(strings.TrimSpace(mf.City))
+	mf.CityNorm = normalizeCity(mf.City)
+}
+
+// Normalized city, "Barão de Cocais" -> "barao-de-cocais".
+func normalizeCity(city string) string {
+	s := strings.ToLower(strings.TrimSpace(city))
 	reg := regexp.MustCompile(`\s+`)
-	mf.CityNorm = normalizeString(reg.ReplaceAllString(s, `-`))
+	return normalizeString(reg.ReplaceAllString(s, `-`))
 }
 
 // Get motoboy freight by CEP.
-func getMotoboyFreightByCEP(c chan *freightsOk, cep string) {
+func getMotoboyFreightByCEP(ctx context.Context, c chan *freightsOk, cep string) {
 	result := &freightsOk{
 		Freights: []*freight{},
 	}
@@ -23,12 +35,13 @@ func getMotoboyFreightByCEP(c chan *freightsOk, cep string) {
 	result.CEPDestiny = cep
 	// log.Printf("motoboy result: %+v", result)
 
-	address, err := getAddressByCEP(cep)
-	if checkError(err) {
+	address, err := getAddressByCEP(ctx, cep)
+	if checkError(ctx, err) {
+		result.Err = err
 		c <- result
 		return
 	}
-	pmf, ok := getMotoboyFreightByLocation(address.State, address.City)
+	pmf, ok := getMotoboyFreightByLocation(ctx, address.State, address.City)
 	// log.Printf("address: %+v", address)
 	// log.Printf("pmf: %+v", *pmf)
 	if !ok {
@@ -48,28 +61,57 @@ func getMotoboyFreightByCEP(c chan *freightsOk, cep string) {
 	c <- result
 }
 
+// Motoboy freight list, filter by city.
+var motoboyFreightList = listTable{
+	name: "motoboy_freight",
+	columns: map[string]string{
+		"id":        "id",
+		"city":      "city_norm",
+		"deadline":  "deadline",
+		"price":     "price",
+		"createdAt": "created_at",
+		"updatedAt": "updated_at",
+	},
+	filters: []listFilter{
+		{param: "city", column: "city_norm", kind: FILTER_CONTAINS},
+	},
+	defaultSort: "state, city",
+	versioned:   true,
+}
+
 // Get all motoboey feights.
 func getAllMotoboyFreight() (result []motoboyFreight, err error) {
-	err = sql3DB.Select(&result, "SELECT * FROM motoboy_freight ORDER BY state, city")
+	opt, err := parseListOptions(url.Values{}, motoboyFreightList)
 	if err != nil {
-		return result, fmt.Errorf("getAllMotoboyFreight(). %s", err.Error())
+		return result, err
 	}
-	return result, nil
+	result, _, err = findMotoboyFreight(opt)
+	return result, err
+}
+
+// Find motoboy freights, total is the count without pagination.
+func findMotoboyFreight(opt listOptions) (result []motoboyFreight, total int, err error) {
+	result = []motoboyFreight{}
+	total, err = listRows(&result, motoboyFreightList, opt)
+	return result, total, err
 }
 
 // Get motoboy freight by id.
-func getMotoboyFreightByID(id int) (mf *motoboyFreight, ok bool) {
+func getMotoboyFreightByID(id int) (mf *motoboyFreight, err error) {
 	mf = &motoboyFreight{}
 	err = sql3DB.Get(mf, "SELECT * FROM motoboy_freight  WHERE id=?", id)
-	if checkError(err) {
-		return mf, false
+	if err == sql.ErrNoRows {
+		return mf, newNotFoundError(ERR_NOT_FOUND, "Motoboy freight %d not found", id)
+	}
+	if err != nil {
+		return mf, newInternalError(err)
 	}
 	// log.Printf("by id, mf: %+v", *mf)
-	return mf, true
+	return mf, nil
 }
 
 // Get motoboy freight by location.
-func getMotoboyFreightByLocation(state, city string) (mf *motoboyFreight, ok bool) {
+func getMotoboyFreightByLocation(ctx context.Context, state, city string) (mf *motoboyFreight, ok bool) {
 	// Only for Minas Gerais.
 	if strings.ToLower(state) != "mg" {
 		return mf, false
@@ -78,91 +120,189 @@ func getMotoboyFreightByLocation(state, city string) (mf *motoboyFreight, ok boo
 	mf.State = "mg"
 	mf.City = city
 	mf.NormalizeCity()
-	err = sql3DB.Get(mf, "SELECT * FROM motoboy_freight WHERE state=? AND city_norm=?", mf.State, mf.CityNorm)
+	// Rate version at quote time.
+	version, err := activeRateVersion(sql3DB, "motoboy_freight", time.Now())
+	if checkError(ctx, err) {
+		return mf, false
+	}
+	err = sql3DB.Get(mf, "SELECT * FROM motoboy_freight WHERE version_id=? AND state=? AND city_norm=?", version, mf.State, mf.CityNorm)
 	if err == sql.ErrNoRows {
 		return mf, false
 	}
-	if checkError(err) {
+	if checkError(ctx, err) {
 		return mf, false
 	}
 	// log.Printf("by state and city, mf: %+v", *mf)
 	return mf, true
 }
 
-// Update motoboy freight by id.
-func updateMotoboyFreightById(freight *motoboyFreight) bool {
-	freight.NormalizeCity()
+// Update motoboy freight by id, audited by.
+func updateMotoboyFreightById(ctx context.Context, freight *motoboyFreight, by *auditEntry) error {
+	if err := validateID(freight.ID); err != nil {
+		return err
+	}
+	if err := freight.Validate(ctx); err != nil {
+		return err
+	}
 	// log.Printf("freight: %+v\n", *freight)
 	stm := "UPDATE motoboy_freight SET city_norm=?, city=?, deadline=?, price=?  WHERE id=?"
 	// log.Printf("UPDATE motoboy_freight SET city_norm=%v, city=%v, deadline=%v, price=%v WHERE id=%v", freight.CityNorm, freight.City, freight.Deadline, freight.Price, freight.ID)
-	_, err := sql3DB.Exec(stm, freight.CityNorm, freight.City, freight.Deadline, freight.Price, freight.ID)
-	if checkError(err) {
-		return false
-	}
-	return true
+	return auditedChange(by, freight.ID, AUDIT_UPDATE, func(tx *sqlx.Tx) (int, error) {
+		version, err := editableRowVersion(tx, "motoboy_freight", freight.ID)
+		if err != nil {
+			return 0, err
+		}
+		freight.VersionID = version
+		if err := freight.checkDuplicate(tx); err != nil {
+			return 0, err
+		}
+		result, err := tx.Exec(stm, freight.CityNorm, freight.City, freight.Deadline, freight.Price, freight.ID)
+		if err != nil {
+			return 0, newDBError(err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		if rowsAffected == 0 {
+			return 0, newNotFoundError(ERR_NOT_FOUND, "Motoboy freight %d not found", freight.ID)
+		}
+		return freight.ID, nil
+	})
 }
 
-// Create motoboy freight.
-func createMotoboyFreight(freight *motoboyFreight) bool {
-	freight.NormalizeCity()
-	// log.Printf("freight: %+v\n", *freight)
-	stm := "INSERT INTO motoboy_freight(state, city, city_norm, deadline, price) VALUES(?, ?, ?, ?, ?)"
-	_, err := sql3DB.Exec(stm, "mg", freight.City, freight.CityNorm, freight.Deadline, freight.Price)
-	if checkError(err) {
-		return false
+// Create motoboy freight, audited by.
+func createMotoboyFreight(ctx context.Context, freight *motoboyFreight, by *auditEntry) error {
+	if err := freight.Validate(ctx); err != nil {
+		return err
 	}
-	return true
+	// log.Printf("freight: %+v\n", *freight)
+	stm := "INSERT INTO motoboy_freight(version_id, state, city, city_norm, deadline, price) VALUES(?, ?, ?, ?, ?, ?)"
+	return auditedChange(by, 0, AUDIT_CREATE, func(tx *sqlx.Tx) (int, error) {
+		version, err := editableRateVersion(tx, "motoboy_freight", freight.VersionID)
+		if err != nil {
+			return 0, err
+		}
+		freight.VersionID = version
+		if err := freight.checkDuplicate(tx); err != nil {
+			return 0, err
+		}
+		result, err := tx.Exec(stm, freight.VersionID, "mg", freight.City, freight.CityNorm, freight.Deadline, freight.Price)
+		if err != nil {
+			return 0, newDBError(err)
+		}
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		freight.ID = int(lastID)
+		return freight.ID, nil
+	})
 }
 
-// Delete motoboy freight.
-func deleteMotoboyFreight(id int) bool {
+// Delete motoboy freight, audited by.
+func deleteMotoboyFreight(id int, by *auditEntry) error {
 	// log.Printf("DELETE FROM motoboy_freight WHERE id=%d", id)
-	stm := "DELETE FROM motoboy_freight WHERE id=?"
-	result, err := sql3DB.Exec(stm, id)
-	if checkError(err) {
-		return false
-	}
-	rowsAffected, err := result.RowsAffected()
-	if checkError(err) {
-		return false
-	}
-	if rowsAffected == 0 {
-		return false
-	}
-	return true
+	return auditedChange(by, id, AUDIT_DELETE, func(tx *sqlx.Tx) (int, error) {
+		if _, err := editableRowVersion(tx, "motoboy_freight", id); err != nil {
+			return 0, err
+		}
+		stm := "DELETE FROM motoboy_freight WHERE id=?"
+		result, err := tx.Exec(stm, id)
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		if rowsAffected == 0 {
+			return 0, newNotFoundError(ERR_NOT_FOUND, "Motoboy freight %d not found", id)
+		}
+		return id, nil
+	})
 }
 
 // Save motoboy freight.
-func saveMotoboyFreight(mf *motoboyFreight) error {
-	mf.NormalizeCity()
-	tx := sql3DB.MustBegin()
-	// Update.
-	uStatement := "UPDATE motoboy_freight SET deadline=?, price=?, city=? WHERE state=? AND city_norm=?"
-	uResult := tx.MustExec(uStatement, mf.Deadline, mf.Price, mf.City, "mg", mf.CityNorm)
-	uRowsAffected, err := uResult.RowsAffected()
+func saveMotoboyFreight(ctx context.Context, mf *motoboyFreight) error {
+	if err := mf.Validate(ctx); err != nil {
+		return err
+	}
+	tx, err := sql3DB.Beginx()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+	version, err := editableRateVersion(tx, "motoboy_freight", mf.VersionID)
+	if err != nil {
+		return err
+	}
+	mf.VersionID = version
+	_, _, _, err = mf.upsert(tx, version)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Commiting insert/update into motoboy_freight table. %s", err)
+	}
+	return nil
+}
 
+// Insert or update motoboy freight by city in version.
+func (mf *motoboyFreight) upsert(tx *sqlx.Tx, version int) (id int, action int, before types.JSONText, err error) {
+	saved := motoboyFreight{}
+	err = tx.Get(&saved, "SELECT * FROM motoboy_freight WHERE version_id=? AND state=? AND city_norm=?", version, "mg", mf.CityNorm)
 	// Insert.
-	if uRowsAffected == 0 {
-		iStatement := "INSERT INTO motoboy_freight(state, city, city_norm, deadline, price) VALUES(?, ?, ?, ?, ?)"
-		iResult, err := tx.Exec(iStatement, "mg", mf.City, mf.CityNorm, mf.Deadline, mf.Price)
-		if err != nil {
-			return err
-		}
-		iRowsAffected, err := iResult.RowsAffected()
-		// log.Printf("iRowsAffected: %+v", iRowsAffected)
+	if err == sql.ErrNoRows {
+		iStatement := "INSERT INTO motoboy_freight(version_id, state, city, city_norm, deadline, price) VALUES(?, ?, ?, ?, ?, ?)"
+		iResult, err := tx.Exec(iStatement, version, "mg", mf.City, mf.CityNorm, mf.Deadline, mf.Price)
 		if err != nil {
-			return err
-		}
-		if iRowsAffected == 0 {
-			return fmt.Errorf("Inserting into motoboy_freight table not affected any row.")
+			return id, action, before, err
 		}
+		lastID, err := iResult.LastInsertId()
+		return int(lastID), CSV_INSERTED, before, err
 	}
-	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("Commiting insert/update into motoboy_freight table. %s", err)
+		return id, action, before, err
 	}
-	return nil
+	if saved.City == mf.City && saved.Deadline == mf.Deadline && saved.Price == mf.Price {
+		return saved.ID, CSV_UNCHANGED, before, nil
+	}
+	// Update.
+	before, err = snapshotRow(tx, "motoboy_freight", saved.ID)
+	if err != nil {
+		return id, action, before, err
+	}
+	uStatement := "UPDATE motoboy_freight SET deadline=?, price=?, city=? WHERE id=?"
+	_, err = tx.Exec(uStatement, mf.Deadline, mf.Price, mf.City, saved.ID)
+	return saved.ID, CSV_UPDATED, before, err
+}
+
+/**************************************************************************************************
+* CSV
+**************************************************************************************************/
+// Motoboy freight csv.
+var motoboyFreightCSV = csvTable{
+	name:   "motoboy_freight",
+	header: []string{"city", "deadline", "price"},
+	parse: func(record []string) (csvRow, error) {
+		fes := fieldErrors{}
+		mf := &motoboyFreight{
+			City:     record[0],
+			Deadline: parseCSVInt(&fes, "deadline", record[1]),
+			Price:    parseCSVInt(&fes, "price", record[2]),
+		}
+		return mf, fes.err()
+	},
+}
+
+// Csv record.
+func (mf *motoboyFreight) csvRecord() []string {
+	return []string{mf.City, strconv.Itoa(mf.Deadline), strconv.Itoa(mf.Price)}
+}
+
+// Unique key.
+func (mf *motoboyFreight) csvKey() string {
+	return mf.CityNorm
 }
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+// Quote clients.
+const (
+	QUOTE_ZUNKA = "zunka"
+	QUOTE_ZOOM  = "zoom"
+)
+
+// Quote budget request header and timed out providers response header.
+const (
+	QUOTE_BUDGET_HEADER    = "X-Quote-Budget"
+	QUOTE_TIMED_OUT_HEADER = "X-Quote-Timed-Out"
+)
+
+// Provider not answered in quote budget.
+var errQuoteBudget = errors.New("timed out, quote budget exceeded")
+
+// Quotes older than it are purged.
+const QUOTE_RETENTION = 180 * 24 * time.Hour
+
+// Interval between quotes purge.
+const QUOTE_PURGE_INTERVAL = time.Hour
+
+// Stored quote.
+type quote struct {
+	ID         string         `db:"id" json:"id"`
+	Client     string         `db:"client" json:"client"`
+	User       string         `db:"username" json:"user"`
+	RequestID  string         `db:"request_id" json:"requestId"`
+	CEPDestiny string         `db:"cep_destiny" json:"cepDestiny"`
+	Request    types.JSONText `db:"request_json" json:"request"`
+	Packs      types.JSONText `db:"packs_json" json:"packs"`
+	Providers  types.JSONText `db:"providers_json" json:"providers"`
+	Freights   types.JSONText `db:"freights_json" json:"freights"`
+	CreatedAt  time.Time      `db:"created_at" json:"createdAt"`
+}
+
+// What was used to quote, filled by getFreightsByProducts.
+type quoteTrace struct {
+	Packs     []pack
+	Providers []quoteProvider
+}
+
+// Zunka freights with quote details.
+type zunkaFreightsDetail struct {
+	Freights []*freight `json:"freights"`
+	TimedOut []string   `json:"timedOut"` // Providers not answered in quote budget.
+}
+
+// Provider result.
+type quoteProvider struct {
+	Provider   string     `json:"provider"` // correios, motoboy, region, correios_dealer or dealer_table.
+	CEPOrigin  string     `json:"cepOrigin"`
+	CEPDestiny string     `json:"cepDestiny"`
+	Region     string     `json:"region,omitempty"` // Destiny region, if looked up.
+	Ok         bool       `json:"ok"`
+	Error      string     `json:"error,omitempty"`
+	TimedOut   bool       `json:"timedOut,omitempty"` // Not answered in quote budget, dropped.
+	Freights   []*freight `json:"freights"`
+}
+
+// Add provider result.
+func (qt *quoteTrace) addProvider(provider string, frsOk *freightsOk) {
+	if qt == nil {
+		return
+	}
+	qp := quoteProvider{
+		Provider:   provider,
+		CEPOrigin:  frsOk.CEPOrigin,
+		CEPDestiny: frsOk.CEPDestiny,
+		Region:     frsOk.Region,
+		Ok:         frsOk.Ok,
+		Freights:   frsOk.Freights,
+	}
+	if frsOk.Err != nil {
+		qp.Error = frsOk.Err.Error()
+	}
+	qt.Providers = append(qt.Providers, qp)
+}
+
+// Add provider not answered in time.
+func (qt *quoteTrace) addTimedOut(provider string) {
+	if qt == nil {
+		return
+	}
+	qt.Providers = append(qt.Providers, quoteProvider{Provider: provider, Error: errQuoteBudget.Error(), TimedOut: true, Freights: []*freight{}})
+}
+
+// Providers not answered in time, without repeated ones.
+func (qt *quoteTrace) timedOut() []string {
+	providers := []string{}
+	seen := map[string]bool{}
+	for _, qp := range qt.Providers {
+		if qp.TimedOut && !seen[qp.Provider] {
+			seen[qp.Provider] = true
+			providers = append(providers, qp.Provider)
+		}
+	}
+	return providers
+}
+
+// Destiny region looked up by providers, empty if none did.
+func (qt *quoteTrace) region() string {
+	for _, qp := range qt.Providers {
+		if qp.Region != "" {
+			return qp.Region
+		}
+	}
+	return ""
+}
+
+// Set header with providers not answered in time, if any.
+func setTimedOutHeader(w http.ResponseWriter, trace *quoteTrace) {
+	if providers := trace.timedOut(); len(providers) > 0 {
+		w.Header().Set(QUOTE_TIMED_OUT_HEADER, strings.Join(providers, ","))
+	}
+}
+
+// Request context with quote deadline, budget from header in milliseconds up to max budget or default one.
+func quoteContext(req *http.Request) (context.Context, context.CancelFunc, error) {
+	budget := cfg.Quote.Budget
+	if val := req.Header.Get(QUOTE_BUDGET_HEADER); val != "" {
+		ms, err := strconv.Atoi(val)
+		budget = time.Duration(ms) * time.Millisecond
+		if err != nil || budget <= 0 || budget > cfg.Quote.MaxBudget {
+			return nil, nil, newBadRequestError(ERR_INVALID_HEADER, "Invalid %s: %s, must be milliseconds up to %d", QUOTE_BUDGET_HEADER, val, cfg.Quote.MaxBudget.Milliseconds())
+		}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), budget)
+	return ctx, cancel, nil
+}
+
+// New quote id, date for people and random part for uniqueness, like 20200131-3fa9c0d1e2b3a4f5.
+func newQuoteID() string {
+	return time.Now().In(brLocation).Format("20060102") + "-" + newRequestID()
+}
+
+// Save quote made by request, logs on error so the freights are still returned.
+func saveQuote(req *http.Request, client string, cepDestiny string, reqBody []byte, trace *quoteTrace, frs interface{}) (id string) {
+	q := quote{
+		ID:         newQuoteID(),
+		Client:     client,
+		User:       authUser(req),
+		RequestID:  requestID(req),
+		CEPDestiny: cepDestiny,
+		Request:    types.JSONText("null"),
+	}
+	if json.Valid(reqBody) {
+		q.Request = types.JSONText(reqBody)
+	}
+	var err error
+	if q.Packs, err = json.Marshal(trace.Packs); err == nil {
+		if q.Providers, err = json.Marshal(trace.Providers); err == nil {
+			q.Freights, err = json.Marshal(frs)
+		}
+	}
+	if err == nil {
+		stm := "INSERT INTO quote(id, client, username, request_id, cep_destiny, request_json, packs_json, providers_json, freights_json) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		_, err = sql3DB.Exec(stm, q.ID, q.Client, q.User, q.RequestID, q.CEPDestiny, string(q.Request), string(q.Packs), string(q.Providers), string(q.Freights))
+	}
+	if err != nil {
+		logError(req.Context(), "Saving quote %s. %v", q.ID, err)
+	}
+	return q.ID
+}
+
+// Get quote by id.
+func getQuoteByID(id string) (q quote, err error) {
+	err = sql3DB.Get(&q, "SELECT * FROM quote WHERE id=?", id)
+	if err == sql.ErrNoRows {
+		return q, newNotFoundError(ERR_NOT_FOUND, "Quote %s not found", id)
+	}
+	if err != nil {
+		return q, newInternalError(err)
+	}
+	return q, nil
+}
+
+// Delete quotes older than retention.
+func purgeQuotes(retention time.Duration) (int64, error) {
+	before := time.Now().Add(-retention).UTC().Format(SQLITE_TIME_FORMAT)
+	result, err := sql3DB.Exec("DELETE FROM quote WHERE created_at<?", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Purge old quotes periodically.
+func runQuotePurge() {
+	for {
+		n, err := purgeQuotes(QUOTE_RETENTION)
+		if err != nil {
+			logError(context.Background(), "Purging quotes. %v", err)
+		} else if n > 0 {
+			logInfo(context.Background(), "%d quote(s) purged", n)
+		}
+		time.Sleep(QUOTE_PURGE_INTERVAL)
+	}
+}
+
+/**************************************************************************************************
+* RESERVATION
+**************************************************************************************************/
+// Time prices are locked.
+const (
+	QUOTE_RESERVATION_DEFAULT = 30 * time.Minute
+	QUOTE_RESERVATION_MAX     = 2 * time.Hour
+)
+
+// Locked freights.
+type quoteReservation struct {
+	Freights  []*freight `json:"freights"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+}
+
+// Service chosen at checkout.
+type quoteChoice struct {
+	Carrier     string `json:"carrier"`
+	ServiceCode string `json:"serviceCode"`
+}
+
+// Guaranteed freight.
+type quoteConfirmation struct {
+	QuoteID   string    `json:"quoteId"`
+	Freight   *freight  `json:"freight"`
+	ExpiresAt time.Time `json:"expiresAt"` // Price guaranteed until.
+}
+
+// Reservation time from ?reserve=true or ?reserve=minutes, 0 for no reservation.
+func parseReserve(val string) (time.Duration, error) {
+	switch strings.ToLower(val) {
+	case "", "false", "0":
+		return 0, nil
+	case "true":
+		return QUOTE_RESERVATION_DEFAULT, nil
+	}
+	minutes, err := strconv.Atoi(val)
+	ttl := time.Duration(minutes) * time.Minute
+	if err != nil || ttl < 0 || ttl > QUOTE_RESERVATION_MAX {
+		return 0, newBadRequestError(ERR_INVALID_QUERY, "Invalid reserve: %s, must be true or minutes up to %v", val, QUOTE_RESERVATION_MAX.Minutes())
+	}
+	return ttl, nil
+}
+
+// Parse detail query, freights with quote details instead of only the freights list.
+func parseDetail(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "", "false", "0":
+		return false, nil
+	case "true", "1":
+		return true, nil
+	}
+	return false, newBadRequestError(ERR_INVALID_QUERY, "Invalid detail: %s, must be true or false", val)
+}
+
+// Lock quote freights for ttl.
+func reserveQuote(id string, frs []*freight, ttl time.Duration) (expiresAt time.Time, err error) {
+	r := quoteReservation{Freights: frs, ExpiresAt: time.Now().Add(ttl).Truncate(time.Second)}
+	if err = setQuoteReservation(id, &r); err != nil {
+		return expiresAt, err
+	}
+	return r.ExpiresAt, nil
+}
+
+// Freight of chosen service.
+func findQuoteFreight(frs []*freight, choice quoteChoice) *freight {
+	for _, fr := range frs {
+		if fr.Carrier == choice.Carrier && fr.ServiceCode == choice.ServiceCode {
+			return fr
+		}
+	}
+	return nil
+}
+
+// Confirm chosen service, reserved price or, if reservation expired, a new quote when price not changed.
+func confirmQuote(req *http.Request, id string, choice quoteChoice) (conf quoteConfirmation, err error) {
+	if choice.Carrier == "" {
+		return conf, newValidationError("carrier", ERR_REQUIRED, "Carrier required")
+	}
+	q, err := getQuoteByID(id)
+	if err != nil {
+		return conf, err
+	}
+
+	// Reserved.
+	if r, ok := getQuoteReservation(id); ok {
+		fr := findQuoteFreight(r.Freights, choice)
+		if fr == nil {
+			return conf, newValidationError("carrier", ERR_INVALID_FIELDS, "Service %s %s not in quote %s", choice.Carrier, choice.ServiceCode, id)
+		}
+		trace := quoteTrace{}
+		json.Unmarshal(q.Providers, &trace.Providers)
+		recordQuoteConfirmStat(req.Context(), q.Client, &trace, fr)
+		return quoteConfirmation{QuoteID: id, Freight: fr, ExpiresAt: r.ExpiresAt}, nil
+	}
+
+	// Not reserved or expired, quote again.
+	if q.Client != QUOTE_ZUNKA {
+		return conf, newQuoteError(ERR_QUOTE_EXPIRED, nil, "Quote %s not reserved or reservation expired", id)
+	}
+	quoted := []*freight{}
+	if err = json.Unmarshal(q.Freights, &quoted); err != nil {
+		return conf, newInternalError(err)
+	}
+	old := findQuoteFreight(quoted, choice)
+	if old == nil {
+		return conf, newValidationError("carrier", ERR_INVALID_FIELDS, "Service %s %s not in quote %s", choice.Carrier, choice.ServiceCode, id)
+	}
+	products := zunkaProducts{}
+	if err = json.Unmarshal(q.Request, &products); err != nil {
+		return conf, newInternalError(err)
+	}
+	ctx, cancel, err := quoteContext(req)
+	if err != nil {
+		return conf, err
+	}
+	defer cancel()
+	trace := quoteTrace{Packs: []pack{}, Providers: []quoteProvider{}}
+	frs, err := getFreightsByProducts(ctx, products, &trace)
+	if err != nil {
+		return conf, err
+	}
+	conf.QuoteID = saveQuote(req, QUOTE_ZUNKA, products.CepDestiny, q.Request, &trace, frs)
+	recordQuoteStats(req.Context(), QUOTE_ZUNKA, &trace, frs)
+	conf.Freight = findQuoteFreight(frs, choice)
+	if conf.Freight == nil {
+		return conf, newQuoteError(ERR_QUOTE_EXPIRED, conf, "Quote %s expired and service %s %s is not available anymore", id, choice.Carrier, choice.ServiceCode)
+	}
+	conf.ExpiresAt, err = reserveQuote(conf.QuoteID, frs, QUOTE_RESERVATION_DEFAULT)
+	if err != nil {
+		return conf, newInternalError(err)
+	}
+	if conf.Freight.Price != old.Price || conf.Freight.Deadline != old.Deadline {
+		return conf, newQuoteError(ERR_QUOTE_CHANGED, conf, "Quote %s expired and freight changed from R$ %.2f in %d days to R$ %.2f in %d days",
+			id, old.Price, old.Deadline, conf.Freight.Price, conf.Freight.Deadline)
+	}
+	recordQuoteConfirmStat(req.Context(), QUOTE_ZUNKA, &trace, conf.Freight)
+	return conf, nil
+}
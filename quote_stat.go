@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Quote stat events.
+const (
+	QUOTE_STAT_QUOTE   = "quote"   // One for each quote.
+	QUOTE_STAT_OFFER   = "offer"   // One for each freight returned.
+	QUOTE_STAT_CONFIRM = "confirm" // One for each freight confirmed at checkout.
+)
+
+// Why Correios freights were not used for Zunka to client leg.
+const (
+	FALLBACK_CORREIOS_ERROR   = "correios_error"   // Correios failed.
+	FALLBACK_CORREIOS_TIMEOUT = "correios_timeout" // Correios not answered in quote budget.
+	FALLBACK_CORREIOS_SKIPPED = "correios_skipped" // Pack out of Correios limits.
+	FALLBACK_CORREIOS_EMPTY   = "correios_empty"   // No Correios service available.
+)
+
+// Upper limit of each price band, last band has no upper limit.
+var QUOTE_STAT_PRICE_BANDS = []float64{25, 50, 100, 200, 500}
+
+// Aggregated quote stat, dimensions not grouped are empty.
+type quoteStat struct {
+	Hour        string  `db:"hour" json:"hour,omitempty"`
+	Day         string  `db:"day" json:"day,omitempty"`
+	Client      string  `db:"client" json:"client,omitempty"`
+	Region      string  `db:"region" json:"region,omitempty"`
+	Event       string  `db:"event" json:"event"`
+	Carrier     string  `db:"carrier" json:"carrier,omitempty"`
+	ServiceCode string  `db:"service_code" json:"serviceCode,omitempty"`
+	Fallback    string  `db:"fallback" json:"fallback,omitempty"`
+	PriceBand   string  `db:"price_band" json:"priceBand,omitempty"`
+	Count       int     `db:"count" json:"count"`
+	PriceAvg    float64 `db:"price_avg" json:"priceAvg"` // Prices only for offer and confirm events.
+	PriceMin    float64 `db:"price_min" json:"priceMin"`
+	PriceMax    float64 `db:"price_max" json:"priceMax"`
+}
+
+// Quote stat dimensions, query name -> column.
+var quoteStatDimensions = map[string]string{
+	"hour":        "hour",
+	"day":         "substr(hour, 1, 10)",
+	"client":      "client",
+	"region":      "region",
+	"event":       "event",
+	"carrier":     "carrier",
+	"serviceCode": "service_code",
+	"fallback":    "fallback",
+	"priceBand":   "price_band",
+}
+
+// Quote stat filters and sort, ?client=zunka&region=south&from=2020-01-01&to=2020-01-31.
+var quoteStatList = listTable{
+	name: "quote_stat",
+	columns: map[string]string{
+		"hour":        "hour",
+		"day":         "substr(hour, 1, 10)",
+		"client":      "client",
+		"region":      "region",
+		"event":       "event",
+		"carrier":     "carrier",
+		"serviceCode": "service_code",
+		"fallback":    "fallback",
+		"priceBand":   "price_band",
+		"count":       "count",
+		"priceAvg":    "price_avg",
+		"priceMin":    "price_min",
+		"priceMax":    "price_max",
+	},
+	filters: []listFilter{
+		{param: "client", column: "client", kind: FILTER_IN},
+		{param: "region", column: "region", kind: FILTER_IN},
+		{param: "event", column: "event", kind: FILTER_IN},
+		{param: "carrier", column: "lower(carrier)", kind: FILTER_IN},
+		{param: "serviceCode", column: "service_code", kind: FILTER_IN},
+		{param: "fallback", column: "fallback", kind: FILTER_IN},
+		{param: "from", column: "hour", kind: FILTER_FROM},
+		{param: "to", column: "hour", kind: FILTER_TO},
+	},
+	defaultSort: "count DESC",
+}
+
+// Default stat grouping.
+const QUOTE_STAT_DEFAULT_GROUP_BY = "region,carrier,serviceCode"
+
+// Csv header, same order as csvRecord.
+var quoteStatCSVHeader = []string{"hour", "day", "client", "region", "event", "carrier", "serviceCode", "fallback", "priceBand", "count", "priceAvg", "priceMin", "priceMax"}
+
+func (s *quoteStat) csvRecord() []string {
+	return []string{
+		s.Hour,
+		s.Day,
+		s.Client,
+		s.Region,
+		s.Event,
+		s.Carrier,
+		s.ServiceCode,
+		s.Fallback,
+		s.PriceBand,
+		strconv.Itoa(s.Count),
+		strconv.FormatFloat(s.PriceAvg, 'f', 2, 64),
+		strconv.FormatFloat(s.PriceMin, 'f', 2, 64),
+		strconv.FormatFloat(s.PriceMax, 'f', 2, 64),
+	}
+}
+
+// Price band, like 25-50 or 500+.
+func quotePriceBand(price float64) string {
+	low := 0.0
+	for _, high := range QUOTE_STAT_PRICE_BANDS {
+		if price < high {
+			return fmt.Sprintf("%g-%g", low, high)
+		}
+		low = high
+	}
+	return fmt.Sprintf("%g+", low)
+}
+
+// Why Correios was not used for Zunka to client leg, empty if it was.
+func (qt *quoteTrace) fallback() string {
+	for _, p := range qt.Providers {
+		if p.Provider != "correios" {
+			continue
+		}
+		switch {
+		case len(p.Freights) > 0:
+			return ""
+		case p.TimedOut:
+			return FALLBACK_CORREIOS_TIMEOUT
+		case p.Error != "":
+			return FALLBACK_CORREIOS_ERROR
+		case !p.Ok:
+			return FALLBACK_CORREIOS_SKIPPED
+		default:
+			return FALLBACK_CORREIOS_EMPTY
+		}
+	}
+	return ""
+}
+
+// Stats recording in background, waited before closing db.
+var quoteStatsWG sync.WaitGroup
+
+// Add one event to current hour stat.
+func addQuoteStat(e sqlx.Execer, client, region, event, fallback string, fr *freight) error {
+	s := quoteStat{
+		Hour:     time.Now().UTC().Truncate(time.Hour).Format(SQLITE_TIME_FORMAT),
+		Client:   client,
+		Region:   region,
+		Event:    event,
+		Fallback: fallback,
+	}
+	price := 0.0
+	if fr != nil {
+		s.Carrier = fr.Carrier
+		s.ServiceCode = fr.ServiceCode
+		s.PriceBand = quotePriceBand(fr.Price)
+		price = fr.Price
+	}
+	stm := "INSERT INTO quote_stat(hour, client, region, event, carrier, service_code, fallback, price_band, count, price_sum, price_min, price_max) VALUES(?, ?, ?, ?, ?, ?, ?, ?, 1, ?, ?, ?) " +
+		"ON CONFLICT(hour, client, region, event, carrier, service_code, fallback, price_band) DO UPDATE SET " +
+		"count = count + 1, price_sum = price_sum + excluded.price_sum, price_min = min(price_min, excluded.price_min), price_max = max(price_max, excluded.price_max)"
+	_, err := e.Exec(stm, s.Hour, s.Client, s.Region, s.Event, s.Carrier, s.ServiceCode, s.Fallback, s.PriceBand, price, price, price)
+	return err
+}
+
+// Record quote and freights offered in background, region from quote providers.
+// Logs on error, the freights are returned anyway.
+func recordQuoteStats(ctx context.Context, client string, trace *quoteTrace, frs []*freight) {
+	region, fallback := trace.region(), trace.fallback()
+	// Copy, freights can change after response.
+	offers := make([]freight, len(frs))
+	for i := range frs {
+		offers[i] = *frs[i]
+	}
+	quoteStatsWG.Add(1)
+	go func() {
+		defer quoteStatsWG.Done()
+		tx, err := sql3DB.Beginx()
+		if err != nil {
+			logError(ctx, "Recording quote stats. %v", err)
+			return
+		}
+		defer tx.Rollback()
+		err = addQuoteStat(tx, client, region, QUOTE_STAT_QUOTE, fallback, nil)
+		for i := 0; err == nil && i < len(offers); i++ {
+			err = addQuoteStat(tx, client, region, QUOTE_STAT_OFFER, fallback, &offers[i])
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			logError(ctx, "Recording quote stats. %v", err)
+		}
+	}()
+}
+
+// Record freight confirmed at checkout, in background.
+func recordQuoteConfirmStat(ctx context.Context, client string, trace *quoteTrace, fr *freight) {
+	region, fallback, confirmed := trace.region(), trace.fallback(), *fr
+	quoteStatsWG.Add(1)
+	go func() {
+		defer quoteStatsWG.Done()
+		if err := addQuoteStat(sql3DB, client, region, QUOTE_STAT_CONFIRM, fallback, &confirmed); err != nil {
+			logError(ctx, "Recording confirm stat. %v", err)
+		}
+	}()
+}
+
+// Find quote stats, grouped by ?groupBy=region,carrier, event is always grouped.
+func findQuoteStats(query url.Values) (stats []quoteStat, err error) {
+	opt, err := parseListOptions(query, quoteStatList)
+	if err != nil {
+		return stats, err
+	}
+	groupBy := query.Get("groupBy")
+	if groupBy == "" {
+		groupBy = QUOTE_STAT_DEFAULT_GROUP_BY
+	}
+	columns := []string{"event"}
+	groups := []string{"event"}
+	for _, name := range strings.Split(groupBy, ",") {
+		name = strings.TrimSpace(name)
+		column, ok := quoteStatDimensions[name]
+		if !ok {
+			return stats, newBadRequestError(ERR_INVALID_QUERY, "Can't group by %s", name)
+		}
+		if name == "event" {
+			continue
+		}
+		dbName := column
+		if name == "day" {
+			dbName = column + " AS day"
+		}
+		columns = append(columns, dbName)
+		groups = append(groups, column)
+	}
+
+	where := ""
+	if len(opt.where) > 0 {
+		where = " WHERE " + strings.Join(opt.where, " AND ")
+	}
+	// Groups as tie breaker.
+	orderBy := " ORDER BY " + strings.Join(append(append(opt.sort, quoteStatList.defaultSort), groups...), ", ")
+	args := opt.args
+	limit := ""
+	if opt.limit > 0 {
+		limit = " LIMIT ? OFFSET ?"
+		args = append(args, opt.limit, opt.offset)
+	} else if opt.offset > 0 {
+		limit = " LIMIT -1 OFFSET ?"
+		args = append(args, opt.offset)
+	}
+	stm := "SELECT " + strings.Join(columns, ", ") + ", SUM(count) AS count, " +
+		"CASE event WHEN 'quote' THEN 0 ELSE ROUND(SUM(price_sum) / SUM(count), 2) END AS price_avg, MIN(price_min) AS price_min, MAX(price_max) AS price_max " +
+		"FROM quote_stat" + where + " GROUP BY " + strings.Join(groups, ", ") + orderBy + limit
+	stats = []quoteStat{}
+	if err = sql3DB.Select(&stats, stm, args...); err != nil {
+		return stats, newInternalError(err)
+	}
+	return stats, nil
+}
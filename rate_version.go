@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Rate version status.
+const (
+	RATE_DRAFT     = "draft"     // Being edited, never used.
+	RATE_SCHEDULED = "scheduled" // Used from effective_from.
+	RATE_ACTIVE    = "active"    // In use.
+	RATE_ARCHIVED  = "archived"  // Replaced by a newer version, can't be changed.
+)
+
+// Interval to update status of scheduled versions, lookups use effective_from and not depend on it.
+const RATE_VERSION_CHECK_INTERVAL = time.Minute
+
+// Rate table with versions.
+type rateTable struct {
+	keys   []string // Unique by version.
+	values []string
+}
+
+// Versioned rate tables by entity (table name).
+var rateTables = map[string]rateTable{
+	"freight_region":  {keys: []string{"region", "weight", "deadline"}, values: []string{"price"}},
+	"dealer_freight":  {keys: []string{"dealer", "weight", "deadline"}, values: []string{"price"}},
+	"motoboy_freight": {keys: []string{"state", "city_norm"}, values: []string{"city", "deadline", "price"}},
+}
+
+// Rate table version.
+type rateVersion struct {
+	ID            int        `db:"id" json:"id"`
+	Entity        string     `db:"entity" json:"entity"` // Table name.
+	Status        string     `db:"status" json:"status"`
+	EffectiveFrom *time.Time `db:"effective_from" json:"effectiveFrom"` // Brazil time, null for draft.
+	Note          string     `db:"note" json:"note"`
+	CreatedAt     time.Time  `db:"created_at" json:"createdAt"`
+	UpdatedAt     time.Time  `db:"updated_at" json:"updatedAt"`
+}
+
+// Rate version change, status draft, scheduled or active (now).
+type rateVersionChange struct {
+	Status        string  `json:"status"`
+	EffectiveFrom string  `json:"effectiveFrom"` // 2006-01-02 (Brazil midnight) or RFC3339.
+	Note          *string `json:"note"`
+}
+
+// Rate version list, filter by entity and status.
+var rateVersionList = listTable{
+	name: "rate_version",
+	columns: map[string]string{
+		"id":            "id",
+		"entity":        "entity",
+		"status":        "status",
+		"effectiveFrom": "effective_from",
+		"createdAt":     "created_at",
+	},
+	filters: []listFilter{
+		{param: "entity", column: "entity", kind: FILTER_IN},
+		{param: "status", column: "status", kind: FILTER_IN},
+	},
+	defaultSort: "id DESC",
+}
+
+// Show effective from in Brazil time.
+func (v *rateVersion) inBrazilTime() {
+	if v.EffectiveFrom != nil {
+		t := v.EffectiveFrom.In(brLocation)
+		v.EffectiveFrom = &t
+	}
+}
+
+// Version in use at time, 0 if none.
+func activeRateVersion(q sqlx.Queryer, entity string, at time.Time) (id int, err error) {
+	err = sqlx.Get(q, &id, "SELECT id FROM rate_version WHERE entity=? AND status!=? AND effective_from<=? ORDER BY effective_from DESC, id DESC LIMIT 1",
+		entity, RATE_DRAFT, at.UTC().Format(SQLITE_TIME_FORMAT))
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// Version from ?version=id, active version if not defined.
+func queryRateVersion(query url.Values, entity string) (id int, err error) {
+	val := query.Get("version")
+	if val == "" {
+		id, err = activeRateVersion(sql3DB, entity, time.Now())
+		if err != nil {
+			return id, newInternalError(err)
+		}
+		return id, nil
+	}
+	id, err = strconv.Atoi(val)
+	if err != nil {
+		return id, newBadRequestError(ERR_INVALID_QUERY, "Invalid version: %s", val)
+	}
+	return id, nil
+}
+
+// Version where rows can be changed, active version if 0, in the transaction changing the rows.
+func editableRateVersion(tx *sqlx.Tx, entity string, id int) (int, error) {
+	if id == 0 {
+		active, err := activeRateVersion(tx, entity, time.Now())
+		if err != nil {
+			return id, newInternalError(err)
+		}
+		if active == 0 {
+			return id, newConflictError("No active %s rate version", entity)
+		}
+		return active, nil
+	}
+	v, err := getRateVersionTx(tx, id)
+	var aErr *apiError
+	if errors.As(err, &aErr) && aErr.Code == ERR_NOT_FOUND {
+		return id, newValidationError("versionId", ERR_INVALID_VERSION, "Rate version %d not found", id)
+	}
+	if err != nil {
+		return id, err
+	}
+	if v.Entity != entity {
+		return id, newValidationError("versionId", ERR_INVALID_VERSION, "Rate version %d is for %s, not %s", id, v.Entity, entity)
+	}
+	if v.Status == RATE_ARCHIVED {
+		return id, newConflictError("Rate version %d is archived", id)
+	}
+	return id, nil
+}
+
+// Version of row if it can be changed, 0 if row not exist, in the transaction changing the row.
+func editableRowVersion(tx *sqlx.Tx, entity string, rowID int) (int, error) {
+	var versionID int
+	err := tx.Get(&versionID, "SELECT version_id FROM "+entity+" WHERE id=?", rowID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, newInternalError(err)
+	}
+	return editableRateVersion(tx, entity, versionID)
+}
+
+// Get rate version by id.
+func getRateVersion(id int) (v rateVersion, err error) {
+	err = sql3DB.Get(&v, "SELECT * FROM rate_version WHERE id=?", id)
+	if err == sql.ErrNoRows {
+		return v, newNotFoundError(ERR_NOT_FOUND, "Rate version %d not found", id)
+	}
+	if err != nil {
+		return v, newInternalError(err)
+	}
+	v.inBrazilTime()
+	return v, nil
+}
+
+// Get rate version in transaction, with the status as of now, the scheduler may not have run yet.
+func getRateVersionTx(tx *sqlx.Tx, id int) (v rateVersion, err error) {
+	err = tx.Get(&v, "SELECT * FROM rate_version WHERE id=?", id)
+	if err == sql.ErrNoRows {
+		return v, newNotFoundError(ERR_NOT_FOUND, "Rate version %d not found", id)
+	}
+	if err != nil {
+		return v, newInternalError(err)
+	}
+	now := time.Now()
+	if (v.Status == RATE_SCHEDULED || v.Status == RATE_ACTIVE) && v.EffectiveFrom != nil && !v.EffectiveFrom.After(now) {
+		active, err := activeRateVersion(tx, v.Entity, now)
+		if err != nil {
+			return v, newInternalError(err)
+		}
+		// Effective, active until a later one is effective.
+		v.Status = RATE_ARCHIVED
+		if active == v.ID {
+			v.Status = RATE_ACTIVE
+		}
+	}
+	return v, nil
+}
+
+// Find rate versions.
+func findRateVersion(opt listOptions) (vs []rateVersion, total int, err error) {
+	if err = refreshRateVersionStatus(); err != nil {
+		return vs, total, newInternalError(err)
+	}
+	vs = []rateVersion{}
+	total, err = listRows(&vs, rateVersionList, opt)
+	for i := range vs {
+		vs[i].inBrazilTime()
+	}
+	return vs, total, err
+}
+
+// Create draft version with rows copied from copyFrom, active version if 0, audited by.
+func createRateVersion(v *rateVersion, copyFrom int, by *auditEntry) error {
+	table, ok := rateTables[v.Entity]
+	if !ok {
+		return newValidationError("entity", ERR_INVALID_FIELDS, "Unknown entity \"%s\"", v.Entity)
+	}
+	if copyFrom == 0 {
+		active, err := activeRateVersion(sql3DB, v.Entity, time.Now())
+		if err != nil {
+			return newInternalError(err)
+		}
+		copyFrom = active
+	} else {
+		from, err := getRateVersion(copyFrom)
+		if err != nil {
+			return err
+		}
+		if from.Entity != v.Entity {
+			return newValidationError("copyFrom", ERR_INVALID_VERSION, "Rate version %d is for %s, not %s", copyFrom, from.Entity, v.Entity)
+		}
+	}
+
+	var id int
+	err := auditedChange(by, 0, AUDIT_CREATE, func(tx *sqlx.Tx) (int, error) {
+		result, err := tx.Exec("INSERT INTO rate_version(entity, status, note) VALUES(?, ?, ?)", v.Entity, RATE_DRAFT, v.Note)
+		if err != nil {
+			return 0, newDBError(err)
+		}
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		columns := strings.Join(append(append([]string{}, table.keys...), table.values...), ", ")
+		stm := fmt.Sprintf("INSERT INTO %s(version_id, %s) SELECT ?, %s FROM %s WHERE version_id=?", v.Entity, columns, columns, v.Entity)
+		if _, err = tx.Exec(stm, lastID, copyFrom); err != nil {
+			return 0, newInternalError(err)
+		}
+		id = int(lastID)
+		return id, nil
+	})
+	if err != nil {
+		return err
+	}
+	*v, err = getRateVersion(id)
+	return err
+}
+
+// Schedule, activate now, go back to draft or change note, audited by.
+func updateRateVersion(id int, change rateVersionChange, by *auditEntry) (v rateVersion, err error) {
+	err = auditedChange(by, id, AUDIT_UPDATE, func(tx *sqlx.Tx) (int, error) {
+		return id, changeRateVersion(tx, id, change)
+	})
+	if err != nil {
+		return v, err
+	}
+	return getRateVersion(id)
+}
+
+// Change rate version in transaction.
+func changeRateVersion(tx *sqlx.Tx, id int, change rateVersionChange) (err error) {
+	v, err := getRateVersionTx(tx, id)
+	if err != nil {
+		return err
+	}
+	if change.Note != nil {
+		if _, err = tx.Exec("UPDATE rate_version SET note=? WHERE id=?", *change.Note, id); err != nil {
+			return newDBError(err)
+		}
+	}
+
+	if change.Status != "" {
+		if v.Status != RATE_DRAFT && v.Status != RATE_SCHEDULED {
+			return newConflictError("Rate version %d is %s, only draft and scheduled versions can change status", id, v.Status)
+		}
+		var effectiveFrom interface{}
+		status := RATE_SCHEDULED
+		switch change.Status {
+		case RATE_DRAFT:
+			status = RATE_DRAFT
+		case RATE_SCHEDULED:
+			t, _, err := parseListTime(change.EffectiveFrom)
+			if err != nil {
+				return newValidationError("effectiveFrom", ERR_INVALID_FIELDS, "Invalid effective from: \"%s\", must be like 2006-01-02 or 2006-01-02T15:04:05-03:00", change.EffectiveFrom)
+			}
+			if !t.After(time.Now()) {
+				return newValidationError("effectiveFrom", ERR_INVALID_FIELDS, "Effective from %s must be in the future, use status active to activate now", change.EffectiveFrom)
+			}
+			effectiveFrom = t.UTC().Format(SQLITE_TIME_FORMAT)
+		case RATE_ACTIVE:
+			effectiveFrom = time.Now().UTC().Format(SQLITE_TIME_FORMAT)
+		default:
+			return newValidationError("status", ERR_INVALID_FIELDS, "Invalid status \"%s\", must be %s, %s or %s", change.Status, RATE_DRAFT, RATE_SCHEDULED, RATE_ACTIVE)
+		}
+		if _, err = tx.Exec("UPDATE rate_version SET status=?, effective_from=? WHERE id=?", status, effectiveFrom, id); err != nil {
+			return newDBError(err)
+		}
+		if err = updateRateVersionStatus(tx); err != nil {
+			return newInternalError(err)
+		}
+	}
+	return nil
+}
+
+// Delete draft or scheduled version and its rows, audited by.
+func deleteRateVersion(id int, by *auditEntry) error {
+	return auditedChange(by, id, AUDIT_DELETE, func(tx *sqlx.Tx) (int, error) {
+		v, err := getRateVersionTx(tx, id)
+		if err != nil {
+			return 0, err
+		}
+		if v.Status != RATE_DRAFT && v.Status != RATE_SCHEDULED {
+			return 0, newConflictError("Rate version %d is %s, only draft and scheduled versions can be deleted", id, v.Status)
+		}
+		if _, err := tx.Exec("DELETE FROM "+v.Entity+" WHERE version_id=?", id); err != nil {
+			return 0, newInternalError(err)
+		}
+		if _, err := tx.Exec("DELETE FROM rate_version WHERE id=?", id); err != nil {
+			return 0, newInternalError(err)
+		}
+		return id, nil
+	})
+}
+
+// Latest effective version is active and the older ones archived.
+func refreshRateVersionStatus() error {
+	tx, err := sql3DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = updateRateVersionStatus(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Refresh status in transaction.
+func updateRateVersionStatus(tx *sqlx.Tx) error {
+	now := time.Now()
+	for entity := range rateTables {
+		id, err := activeRateVersion(tx, entity, now)
+		if err != nil {
+			return err
+		}
+		if id == 0 {
+			continue
+		}
+		result, err := tx.Exec("UPDATE rate_version SET status=? WHERE id=? AND status!=?", RATE_ACTIVE, id, RATE_ACTIVE)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			logInfo(context.Background(), "Rate version %d of %s activated", id, entity)
+		}
+		_, err = tx.Exec("UPDATE rate_version SET status=? WHERE entity=? AND id!=? AND status IN (?, ?) AND effective_from<=?",
+			RATE_ARCHIVED, entity, id, RATE_ACTIVE, RATE_SCHEDULED, now.UTC().Format(SQLITE_TIME_FORMAT))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keep rate versions status updated.
+func runRateVersionScheduler() {
+	for {
+		if err := refreshRateVersionStatus(); err != nil {
+			logError(context.Background(), "Updating rate versions status. %v", err)
+		}
+		time.Sleep(RATE_VERSION_CHECK_INTERVAL)
+	}
+}
+
+/**************************************************************************************************
+* DIFF
+**************************************************************************************************/
+// Differences between two versions of same rate table.
+type rateDiff struct {
+	Entity  string        `json:"entity"`
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Added   int           `json:"added"`
+	Removed int           `json:"removed"`
+	Changed int           `json:"changed"`
+	Rows    []rateDiffRow `json:"rows"`
+}
+
+// Row difference.
+type rateDiffRow struct {
+	Change string                 `json:"change"` // added, removed or changed.
+	Key    map[string]interface{} `json:"key"`
+	Before map[string]interface{} `json:"before"` // Values, null if added.
+	After  map[string]interface{} `json:"after"`  // Values, null if removed.
+}
+
+// Rate row by key.
+type rateRow struct {
+	key    map[string]interface{}
+	values map[string]interface{}
+}
+
+// Compare versions, rows by key.
+func diffRateVersions(from, to int) (diff rateDiff, err error) {
+	vFrom, err := getRateVersion(from)
+	if err != nil {
+		return diff, err
+	}
+	vTo, err := getRateVersion(to)
+	if err != nil {
+		return diff, err
+	}
+	if vFrom.Entity != vTo.Entity {
+		return diff, newBadRequestError(ERR_INVALID_VERSION, "Rate versions %d and %d are from different entities, %s and %s", from, to, vFrom.Entity, vTo.Entity)
+	}
+	diff = rateDiff{Entity: vFrom.Entity, From: from, To: to, Rows: []rateDiffRow{}}
+	fromKeys, fromRows, err := rateVersionRows(vFrom.Entity, from)
+	if err != nil {
+		return diff, newInternalError(err)
+	}
+	toKeys, toRows, err := rateVersionRows(vTo.Entity, to)
+	if err != nil {
+		return diff, newInternalError(err)
+	}
+
+	for _, key := range toKeys {
+		after := toRows[key]
+		before, ok := fromRows[key]
+		if !ok {
+			diff.Added++
+			diff.Rows = append(diff.Rows, rateDiffRow{Change: "added", Key: after.key, After: after.values})
+			continue
+		}
+		if fmt.Sprint(before.values) != fmt.Sprint(after.values) {
+			diff.Changed++
+			diff.Rows = append(diff.Rows, rateDiffRow{Change: "changed", Key: after.key, Before: before.values, After: after.values})
+		}
+	}
+	for _, key := range fromKeys {
+		if _, ok := toRows[key]; !ok {
+			diff.Removed++
+			diff.Rows = append(diff.Rows, rateDiffRow{Change: "removed", Key: fromRows[key].key, Before: fromRows[key].values})
+		}
+	}
+	return diff, nil
+}
+
+// Rows of version by key, keys sorted.
+func rateVersionRows(entity string, versionID int) (keys []string, rows map[string]rateRow, err error) {
+	table := rateTables[entity]
+	rows = map[string]rateRow{}
+	stm := fmt.Sprintf("SELECT %s, %s FROM %s WHERE version_id=? ORDER BY %s",
+		strings.Join(table.keys, ", "), strings.Join(table.values, ", "), entity, strings.Join(table.keys, ", "))
+	dbRows, err := sql3DB.Queryx(stm, versionID)
+	if err != nil {
+		return keys, rows, err
+	}
+	defer dbRows.Close()
+	for dbRows.Next() {
+		m := map[string]interface{}{}
+		if err = dbRows.MapScan(m); err != nil {
+			return keys, rows, err
+		}
+		row := rateRow{key: map[string]interface{}{}, values: map[string]interface{}{}}
+		keyVals := []string{}
+		for _, col := range table.keys {
+			row.key[col] = dbValue(m[col])
+			keyVals = append(keyVals, fmt.Sprint(row.key[col]))
+		}
+		for _, col := range table.values {
+			row.values[col] = dbValue(m[col])
+		}
+		key := strings.Join(keyVals, "|")
+		keys = append(keys, key)
+		rows[key] = row
+	}
+	return keys, rows, dbRows.Err()
+}
+
+// Text from sqlite as string.
+func dbValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
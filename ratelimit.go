@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Rate limit by route, for authenticated user or source IP, too many requests with Retry-After if exceeded.
+// Counters in cache, shared by instances and kept on restart with redis.
+func checkRateLimit(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		if !cfg.RateLimit.Enabled {
+			h(w, req, p)
+			return
+		}
+		route := metricsRoute(req)
+		client := "ip-" + clientIP(req)
+		if user := authUser(req); user != "" {
+			client = "user-" + user
+		}
+		if takeRateLimit(w, req, route, client, cfg.RateLimit.get(route)) {
+			h(w, req, p)
+		}
+	}
+}
+
+// Authentication attempts by source IP, checked before credentials, failed ones included.
+func checkAuthRateLimit(w http.ResponseWriter, req *http.Request) bool {
+	if !cfg.RateLimit.Enabled {
+		return true
+	}
+	return takeRateLimit(w, req, "auth", "ip-"+clientIP(req), cfg.RateLimit.Auth)
+}
+
+// Take token of route and client, too many requests written if limited.
+func takeRateLimit(w http.ResponseWriter, req *http.Request, route string, client string, rl rateLimit) bool {
+	wait, err := cache.TakeToken(CACHE_KEY_RATE_LIMIT+route+"-"+client, rl.Rate, rl.Burst)
+	// Not limiting if cache failing.
+	if err != nil {
+		logError(req.Context(), "Rate limiting %s %s. %v", route, client, err)
+		return true
+	}
+	if wait > 0 {
+		rateLimited.inc(route)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, req, newRateLimitError(wait))
+		return false
+	}
+	return true
+}
+
+// Source IP, the one added by proxy if trusted.
+func clientIP(req *http.Request) string {
+	if cfg.RateLimit.TrustProxy {
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			ips := strings.Split(fwd, ",")
+			return strings.TrimSpace(ips[len(ips)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
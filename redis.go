@@ -1,23 +1,32 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
+)
 
-	"github.com/go-redis/redis/v7"
+// Key prefixes by family.
+const (
+	CACHE_KEY_CORREIOS          = "freightsrv-correios-estimate-freight-" // Origin and destiny CEPs, pack.
+	CACHE_KEY_CEP_REGION        = "freightsrv-cep-region-"
+	CACHE_KEY_VIA_CEP_ADDRESS   = "freightsrv-via-cep-address-"
+	CACHE_KEY_IBGE_CITIES       = "freightsrv-ibge-cities-"
+	CACHE_KEY_QUOTE_RESERVATION = "freightsrv-quote-reservation-"
+	CACHE_KEY_RATE_LIMIT        = "freightsrv-rate-limit-" // Route and user or IP.
 )
 
 // Get.
 func redisGet(key string) string {
-	val, err := redisClient.Get(key).Result()
-	if err == redis.Nil {
+	val, err := cache.Get(key)
+	if err == errCacheMiss {
 		return ""
 		// log.Printf("Key not exist")
 	} else if err != nil {
-		checkError(err)
+		checkError(context.TODO(), err)
 		return ""
 	} else {
 		return val
@@ -27,7 +36,7 @@ func redisGet(key string) string {
 
 // Set.
 func redisSet(key string, val string, exp time.Duration) error {
-	err := redisClient.Set(key, val, exp).Err()
+	err := cache.Set(key, val, exp)
 	if err != nil {
 		return err
 	}
@@ -36,7 +45,7 @@ func redisSet(key string, val string, exp time.Duration) error {
 
 // Del.
 func redisDel(key string) error {
-	return redisClient.Del(key).Err()
+	return cache.Del(key)
 }
 
 //****************************************************************************
@@ -45,16 +54,18 @@ func redisDel(key string) error {
 // Set CEP region.
 func setCEPRegion(cep string, region string) {
 	cep = strings.ReplaceAll(cep, "-", "")
-	key := "freightsrv-cep-region-" + cep
+	key := CACHE_KEY_CEP_REGION + cep
 	// Save for one wekeend.
-	_ = redisSet(key, region, time.Hour*168)
+	_ = redisSet(key, region, cfg.Cache.CEPRegionTTL)
 }
 
 // Get CEP region.
 func getCEPRegion(cep string) string {
 	cep = strings.ReplaceAll(cep, "-", "")
-	key := "freightsrv-cep-region-" + cep
-	return redisGet(key)
+	key := CACHE_KEY_CEP_REGION + cep
+	region := redisGet(key)
+	observeCache(CACHE_CEP_REGION, region != "")
+	return region
 }
 
 //****************************************************************************
@@ -62,47 +73,136 @@ func getCEPRegion(cep string) string {
 //****************************************************************************
 // Set via cep address.
 func setViaCEPAddressCache(pCep *string, pAddressJson *string) {
-	key := "freightsrv-via-cep-address-" + strings.ReplaceAll(*pCep, "-", "")
-	_ = redisSet(key, string(*pAddressJson), time.Hour*48)
+	key := CACHE_KEY_VIA_CEP_ADDRESS + strings.ReplaceAll(*pCep, "-", "")
+	_ = redisSet(key, string(*pAddressJson), cfg.Cache.ViaCEPAddressTTL)
 }
 
 // Get via cep address.
 func getViaCEPAddressCache(pCep *string) (*string, bool) {
-	key := "freightsrv-via-cep-address-" + strings.ReplaceAll(*pCep, "-", "")
+	key := CACHE_KEY_VIA_CEP_ADDRESS + strings.ReplaceAll(*pCep, "-", "")
 	addressJson := redisGet(key)
+	observeCache(CACHE_VIA_CEP_ADDRESS, addressJson != "")
 	if addressJson == "" {
 		return nil, false
 	}
 	return &addressJson, true
 }
 
+//****************************************************************************
+//	MINAS GERAIS CITIES
+//****************************************************************************
+// Set normalized Minas Gerais cities.
+func setMGCitiesCache(cities []string) {
+	citiesJson, err := json.Marshal(cities)
+	if checkError(context.TODO(), err) {
+		return
+	}
+	// Municipalities rarely change.
+	_ = redisSet(CACHE_KEY_IBGE_CITIES+"mg", string(citiesJson), cfg.Cache.IBGECitiesTTL)
+}
+
+// Get normalized Minas Gerais cities.
+func getMGCitiesCache() (cities []string, ok bool) {
+	citiesJson := redisGet(CACHE_KEY_IBGE_CITIES + "mg")
+	observeCache(CACHE_IBGE_CITIES, citiesJson != "")
+	if citiesJson == "" {
+		return cities, false
+	}
+	err := json.Unmarshal([]byte(citiesJson), &cities)
+	if checkError(context.TODO(), err) {
+		return cities, false
+	}
+	return cities, true
+}
+
 //****************************************************************************
 //	CORREIOS FREIGHTS
 //****************************************************************************
 func makeCorreiosKey(p *pack) string {
-	return "freightsrv-correios-estimate-freight-" + strings.ReplaceAll(p.CEPOrigin, "-", "") + "-" + strings.ReplaceAll(p.CEPDestiny, "-", "") + "-" + strconv.Itoa(p.Weight) + "-" + strconv.Itoa(p.Length) + "-" + strconv.Itoa(p.Height) + "-" + strconv.Itoa(p.Width) + "-" + fmt.Sprintf("%.3f", p.Price)
+	return CACHE_KEY_CORREIOS + strings.ReplaceAll(p.CEPOrigin, "-", "") + "-" + strings.ReplaceAll(p.CEPDestiny, "-", "") + "-" + strconv.Itoa(p.Weight) + "-" + strconv.Itoa(p.Length) + "-" + strconv.Itoa(p.Height) + "-" + strconv.Itoa(p.Width) + "-" + fmt.Sprintf("%.3f", p.Price)
+}
+
+// Cached Correios freights, fresh until soft TTL and kept until hard TTL.
+type correiosCacheEntry struct {
+	Freights   []*freight `json:"freights"`
+	FreshUntil time.Time  `json:"freshUntil"`
 }
 
 // Set Correios estimate delivery.
 func setCorreiosCache(p *pack, frS []*freight) {
-	frSJson, err := json.Marshal(frS)
-	if checkError(err) {
+	entry := correiosCacheEntry{Freights: frS, FreshUntil: time.Now().Add(cfg.Cache.CorreiosTTL)}
+	entryJson, err := json.Marshal(entry)
+	if checkError(context.TODO(), err) {
 		return
 	}
-	_ = redisSet(makeCorreiosKey(p), string(frSJson), time.Hour*48)
+	_ = redisSet(makeCorreiosKey(p), string(entryJson), cfg.Cache.CorreiosStaleTTL)
+}
+
+// Get Correios estimate delivery, stale after soft TTL.
+func getCorreiosCache(p *pack) (frS []*freight, stale bool, ok bool) {
+	entry, ok := getCorreiosCacheEntry(p)
+	observeCache(CACHE_CORREIOS, ok)
+	if !ok {
+		return frS, false, false
+	}
+	stale = time.Now().After(entry.FreshUntil)
+	if stale {
+		cacheStale.inc(CACHE_CORREIOS)
+	}
+	return entry.Freights, stale, true
 }
 
-// Get Correios estimate delivery.
-func getCorreiosCache(p *pack) (frS []*freight, ok bool) {
-	frSJson := redisGet(makeCorreiosKey(p))
+// Get Correios cache entry.
+func getCorreiosCacheEntry(p *pack) (entry correiosCacheEntry, ok bool) {
+	entryJson := redisGet(makeCorreiosKey(p))
 	// No key.
-	if frSJson == "" {
-		return frS, false
+	if entryJson == "" {
+		return entry, false
+	}
+	// Saved before soft TTL, only freights, fresh until expire.
+	if strings.HasPrefix(entryJson, "[") {
+		err := json.Unmarshal([]byte(entryJson), &entry.Freights)
+		entry.FreshUntil = time.Now().Add(cfg.Cache.CorreiosTTL)
+		return entry, !checkError(context.TODO(), err)
+	}
+	err := json.Unmarshal([]byte(entryJson), &entry)
+	if checkError(context.TODO(), err) {
+		return entry, false
+	}
+	return entry, true
+}
+
+//****************************************************************************
+//	QUOTE RESERVATION
+//****************************************************************************
+// Quote reservation key.
+func makeQuoteReservationKey(id string) string {
+	return CACHE_KEY_QUOTE_RESERVATION + id
+}
+
+// Set quote reservation, expires with the reservation.
+func setQuoteReservation(id string, r *quoteReservation) error {
+	rJSON, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	// Not positive ttl never expires.
+	ttl := time.Until(r.ExpiresAt)
+	if ttl <= 0 {
+		return fmt.Errorf("Quote reservation %s already expired at %v", id, r.ExpiresAt)
+	}
+	return redisSet(makeQuoteReservationKey(id), string(rJSON), ttl)
+}
+
+// Get quote reservation.
+func getQuoteReservation(id string) (r quoteReservation, ok bool) {
+	rJSON := redisGet(makeQuoteReservationKey(id))
+	if rJSON == "" {
+		return r, false
 	}
-	// log.Printf("frSJson: %s\n", frSJson)
-	err := json.Unmarshal([]byte(frSJson), &frS)
-	if checkError(err) {
-		return frS, false
+	err := json.Unmarshal([]byte(rJSON), &r)
+	if checkError(context.TODO(), err) {
+		return r, false
 	}
-	return frS, true
+	return r, true
 }
@@ -1,20 +1,57 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
 )
 
-func getAllFreightRegion() (frS []regionFreight, ok bool) {
-	err = sql3DB.Select(&frS, "SELECT * FROM freight_region ORDER BY region, weight, deadline")
-	if checkError(err) {
-		return frS, false
+// Region freight list, filter by region and weight.
+var regionFreightList = listTable{
+	name: "freight_region",
+	columns: map[string]string{
+		"id":        "id",
+		"region":    "region",
+		"weight":    "weight",
+		"deadline":  "deadline",
+		"price":     "price",
+		"createdAt": "created_at",
+		"updatedAt": "updated_at",
+	},
+	filters: []listFilter{
+		{param: "region", column: "region", kind: FILTER_IN},
+		{param: "weightMin", column: "weight", kind: FILTER_MIN},
+		{param: "weightMax", column: "weight", kind: FILTER_MAX},
+	},
+	defaultSort: "region, weight, deadline",
+	versioned:   true,
+}
+
+func getAllFreightRegion() (frS []regionFreight, err error) {
+	opt, err := parseListOptions(url.Values{}, regionFreightList)
+	if err != nil {
+		return frS, err
 	}
-	return frS, true
+	frS, _, err = findFreightRegion(opt)
+	return frS, err
+}
+
+// Find region freights, total is the count without pagination.
+func findFreightRegion(opt listOptions) (frS []regionFreight, total int, err error) {
+	frS = []regionFreight{}
+	total, err = listRows(&frS, regionFreightList, opt)
+	return frS, total, err
 }
 
 // Get freight region by CEP and weight.
-func getFreightRegionByCEPAndWeight(c chan *freightsOk, cep string, weight int) {
+func getFreightRegionByCEPAndWeight(ctx context.Context, c chan *freightsOk, cep string, weight int) {
 	result := &freightsOk{
 		Freights: []*freight{},
 	}
@@ -27,13 +64,15 @@ func getFreightRegionByCEPAndWeight(c chan *freightsOk, cep string, weight int)
 		return
 	}
 
-	region, err := getRegionByCEP(cep)
-	if checkError(err) {
+	region, err := getRegionByCEP(ctx, cep)
+	if checkError(ctx, err) {
+		result.Err = err
 		c <- result
 		return
 	}
+	result.Region = region
 
-	frrs, ok := getFreightRegionByRegionAndWeight(region, weight)
+	frrs, ok := getFreightRegionByRegionAndWeight(ctx, region, weight)
 	// log.Printf("frrs: %+v", frrs)
 	if !ok {
 		c <- result
@@ -53,18 +92,23 @@ func getFreightRegionByCEPAndWeight(c chan *freightsOk, cep string, weight int)
 }
 
 // Get region freight by region.
-func getFreightRegionByRegionAndWeight(region string, weight int) (frs []regionFreight, ok bool) {
+func getFreightRegionByRegionAndWeight(ctx context.Context, region string, weight int) (frs []regionFreight, ok bool) {
 	// Inváid weight.
 	if weight == 0 {
 		return frs, false
 	}
+	// Rate version at quote time.
+	version, err := activeRateVersion(sql3DB, "freight_region", time.Now())
+	if checkError(ctx, err) {
+		return frs, false
+	}
 	// Select weight.
 	var weightSel int
 	// Get min weight freight for current weight.
 	// log.Printf("SELECT MIN(weight) FROM freight_region WHERE region=%s AND weight>=%d ORDER BY deadline", region, weight)
 	// err = sql3DB.Get(&weightSel, "SELECT MIN(weight) FROM freight_region WHERE region=? AND weight>=? ORDER BY deadline", region, weight)
-	err = sql3DB.Get(&weightSel, "SELECT CASE WHEN MIN(weight) IS NULL THEN 0 ELSE MIN(weight) END FROM freight_region WHERE region==? AND weight>=? ORDER BY deadline;", region, weight)
-	if checkError(err) {
+	err = sql3DB.Get(&weightSel, "SELECT CASE WHEN MIN(weight) IS NULL THEN 0 ELSE MIN(weight) END FROM freight_region WHERE version_id=? AND region==? AND weight>=? ORDER BY deadline;", version, region, weight)
+	if checkError(ctx, err) {
 		return frs, false
 	}
 	// log.Printf("weightSel: %v", weightSel)
@@ -73,8 +117,8 @@ func getFreightRegionByRegionAndWeight(region string, weight int) (frs []regionF
 		return frs, false
 	}
 
-	err = sql3DB.Select(&frs, "SELECT * FROM freight_region WHERE region=? AND weight==? ORDER BY deadline", region, weightSel)
-	if checkError(err) {
+	err = sql3DB.Select(&frs, "SELECT * FROM freight_region WHERE version_id=? AND region=? AND weight==? ORDER BY deadline", version, region, weightSel)
+	if checkError(ctx, err) {
 		return frs, false
 	}
 	// log.Printf("getFreightRegionByRegionAndWeight: %+v", frs)
@@ -82,67 +126,166 @@ func getFreightRegionByRegionAndWeight(region string, weight int) (frs []regionF
 }
 
 // Get region freight by id.
-func getFreightRegionById(id int) (fr regionFreight, ok bool) {
+func getFreightRegionById(id int) (fr regionFreight, err error) {
 	err = sql3DB.Get(&fr, "SELECT * FROM freight_region WHERE id=?", id)
-	if checkError(err) {
-		return fr, false
+	if err == sql.ErrNoRows {
+		return fr, newNotFoundError(ERR_NOT_FOUND, "Region freight %d not found", id)
+	}
+	if err != nil {
+		return fr, newInternalError(err)
 	}
-	return fr, true
+	return fr, nil
 }
 
-// Create freight region.
-func createFreightRegion(fr *regionFreight) bool {
-	stm := "INSERT INTO freight_region(region, weight, deadline, price) VALUES(?, ?, ?, ?)"
-	result, err := sql3DB.Exec(stm, fr.Region, fr.Weight, fr.Deadline, fr.Price)
-	if checkError(err) {
-		return false
-	}
-	rowsAffected, err := result.RowsAffected()
-	if checkError(err) {
-		return false
+// Create freight region, audited by.
+func createFreightRegion(ctx context.Context, fr *regionFreight, by *auditEntry) error {
+	if err := fr.Validate(ctx); err != nil {
+		return err
 	}
-	// log.Printf("iRowsAffected: %+v", iRowsAffected)
-	if rowsAffected == 0 {
-		checkError(errors.New("Inserting into freight_region table, no affected row."))
-		return false
-	}
-	return true
+	return auditedChange(by, 0, AUDIT_CREATE, func(tx *sqlx.Tx) (int, error) {
+		version, err := editableRateVersion(tx, "freight_region", fr.VersionID)
+		if err != nil {
+			return 0, err
+		}
+		fr.VersionID = version
+		if err := fr.checkDuplicate(tx); err != nil {
+			return 0, err
+		}
+		stm := "INSERT INTO freight_region(version_id, region, weight, deadline, price) VALUES(?, ?, ?, ?, ?)"
+		result, err := tx.Exec(stm, fr.VersionID, fr.Region, fr.Weight, fr.Deadline, fr.Price)
+		if err != nil {
+			return 0, newDBError(err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		// log.Printf("iRowsAffected: %+v", iRowsAffected)
+		if rowsAffected == 0 {
+			return 0, newInternalError(errors.New("Inserting into freight_region table, no affected row."))
+		}
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		fr.ID = int(lastID)
+		return fr.ID, nil
+	})
 }
 
-// Update freight region.
-func updateFreightRegion(fr *regionFreight) bool {
-	// log.Printf("UPDATE freight_region SET price=%d WHERE region=%v AND weight=%d AND deadline=%d", fr.Price, fr.Region, fr.Weight, fr.Deadline)
-	// stm := "UPDATE freight_region SET price=? WHERE region=? AND weight=? AND deadline=?"
-	stm := "UPDATE freight_region SET region=?, weight=?, deadline=?, price=? WHERE id=?"
-	result, err := sql3DB.Exec(stm, fr.Region, fr.Weight, fr.Deadline, fr.Price, fr.ID)
-	if checkError(err) {
-		return false
-	}
-	rowsAffected, err := result.RowsAffected()
-	if checkError(err) {
-		return false
+// Update freight region, audited by.
+func updateFreightRegion(ctx context.Context, fr *regionFreight, by *auditEntry) error {
+	if err := validateID(fr.ID); err != nil {
+		return err
 	}
-	if rowsAffected == 0 {
-		checkError(errors.New("Updateing freight_region table, no affected row."))
-		return false
+	if err := fr.Validate(ctx); err != nil {
+		return err
 	}
-	return true
+	// log.Printf("UPDATE freight_region SET price=%d WHERE region=%v AND weight=%d AND deadline=%d", fr.Price, fr.Region, fr.Weight, fr.Deadline)
+	// stm := "UPDATE freight_region SET price=? WHERE region=? AND weight=? AND deadline=?"
+	return auditedChange(by, fr.ID, AUDIT_UPDATE, func(tx *sqlx.Tx) (int, error) {
+		version, err := editableRowVersion(tx, "freight_region", fr.ID)
+		if err != nil {
+			return 0, err
+		}
+		fr.VersionID = version
+		if err := fr.checkDuplicate(tx); err != nil {
+			return 0, err
+		}
+		stm := "UPDATE freight_region SET region=?, weight=?, deadline=?, price=? WHERE id=?"
+		result, err := tx.Exec(stm, fr.Region, fr.Weight, fr.Deadline, fr.Price, fr.ID)
+		if err != nil {
+			return 0, newDBError(err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		if rowsAffected == 0 {
+			return 0, newNotFoundError(ERR_NOT_FOUND, "Region freight %d not found", fr.ID)
+		}
+		return fr.ID, nil
+	})
 }
 
-// Delete freight region.
-func deleteFreightRegion(id int) bool {
+// Delete freight region, audited by.
+func deleteFreightRegion(id int, by *auditEntry) error {
 	// log.Printf("DELETE FROM freight_region WHERE id=%d", id)
-	stm := "DELETE FROM freight_region WHERE id=?"
-	result, err := sql3DB.Exec(stm, id)
-	if checkError(err) {
-		return false
+	return auditedChange(by, id, AUDIT_DELETE, func(tx *sqlx.Tx) (int, error) {
+		if _, err := editableRowVersion(tx, "freight_region", id); err != nil {
+			return 0, err
+		}
+		stm := "DELETE FROM freight_region WHERE id=?"
+		result, err := tx.Exec(stm, id)
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, newInternalError(err)
+		}
+		if rowsAffected == 0 {
+			return 0, newNotFoundError(ERR_NOT_FOUND, "Region freight %d not found", id)
+		}
+		return id, nil
+	})
+}
+
+/**************************************************************************************************
+* CSV
+**************************************************************************************************/
+// Region freight csv.
+var regionFreightCSV = csvTable{
+	name:   "freight_region",
+	header: []string{"region", "weight", "deadline", "price"},
+	parse: func(record []string) (csvRow, error) {
+		fes := fieldErrors{}
+		fr := &regionFreight{
+			Region:   record[0],
+			Weight:   parseCSVInt(&fes, "weight", record[1]),
+			Deadline: parseCSVInt(&fes, "deadline", record[2]),
+			Price:    parseCSVInt(&fes, "price", record[3]),
+		}
+		return fr, fes.err()
+	},
+}
+
+// Csv record.
+func (fr *regionFreight) csvRecord() []string {
+	return []string{fr.Region, strconv.Itoa(fr.Weight), strconv.Itoa(fr.Deadline), strconv.Itoa(fr.Price)}
+}
+
+// Unique key.
+func (fr *regionFreight) csvKey() string {
+	return fmt.Sprintf("%s-%d-%d", fr.Region, fr.Weight, fr.Deadline)
+}
+
+// Insert or update price by region, weight and deadline in version.
+func (fr *regionFreight) upsert(tx *sqlx.Tx, version int) (id int, action int, before types.JSONText, err error) {
+	saved := regionFreight{}
+	err = tx.Get(&saved, "SELECT * FROM freight_region WHERE version_id=? AND region=? AND weight=? AND deadline=?", version, fr.Region, fr.Weight, fr.Deadline)
+	// Insert.
+	if err == sql.ErrNoRows {
+		result, err := tx.Exec("INSERT INTO freight_region(version_id, region, weight, deadline, price) VALUES(?, ?, ?, ?, ?)", version, fr.Region, fr.Weight, fr.Deadline, fr.Price)
+		if err != nil {
+			return id, action, before, err
+		}
+		lastID, err := result.LastInsertId()
+		return int(lastID), CSV_INSERTED, before, err
+	}
+	if err != nil {
+		return id, action, before, err
+	}
+	if saved.Price == fr.Price {
+		return saved.ID, CSV_UNCHANGED, before, nil
 	}
-	rowsAffected, err := result.RowsAffected()
-	if rowsAffected == 0 {
-		checkError(errors.New(fmt.Sprintf("No rows was affected by deleting freight id: %d from freight_region table", id)))
-		return false
+	// Update.
+	before, err = snapshotRow(tx, "freight_region", saved.ID)
+	if err != nil {
+		return id, action, before, err
 	}
-	return true
+	_, err = tx.Exec("UPDATE freight_region SET price=? WHERE id=?", fr.Price, saved.ID)
+	return saved.ID, CSV_UPDATED, before, err
 }
 
 // func saveFreightRegion(fr regionFreight) error {
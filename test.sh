@@ -1,6 +1,6 @@
 #!/usr/bin/env bash
 # clear
-[[ `systemctl status redis | awk '/Active/{print $2}'` == inactive ]] && sudo systemctl start redis
+# Redis is optional, memory cache is used if it is not running.
 # go test
 # go test -run SaveFreightRegion
 
@@ -9,7 +9,7 @@
 # Clean cache.
 if [[ $1 == "--clean-cache" ]]; then
     echo Cleaning cache...
-    KEYS=`redis-cli keys freightsrv-*`
+    KEYS=`redis-cli --scan --pattern 'freightsrv-*'`
     [[ ! -z $KEYS ]] && redis-cli del $KEYS
     exit
     # echo $KEYS
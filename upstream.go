@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Upstream services.
+const (
+	UPSTREAM_CORREIOS  = "correios"
+	UPSTREAM_VIACEP    = "viacep"
+	UPSTREAM_IBGE      = "ibge"
+	UPSTREAM_ZUNKASITE = "zunkasite"
+)
+
+// Shared client by upstream service, connections are reused.
+var (
+	upstreamClientsMu sync.Mutex
+	upstreamClients   = map[string]*http.Client{}
+)
+
+// Client tuned by upstream config.
+func upstreamClient(service string) *http.Client {
+	upstreamClientsMu.Lock()
+	defer upstreamClientsMu.Unlock()
+	client, ok := upstreamClients[service]
+	if ok {
+		return client
+	}
+	uc := cfg.Upstreams.get(service)
+	client = &http.Client{
+		Timeout: uc.Timeout,
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: uc.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   uc.ConnectTimeout,
+			ResponseHeaderTimeout: uc.Timeout,
+			MaxIdleConnsPerHost:   10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+	upstreamClients[service] = client
+	return client
+}
+
+// Do request to upstream service, observing latency and errors, idempotent requests are retried.
+// Fail fast with errCircuitOpen while the service circuit breaker is open.
+func doUpstream(service string, req *http.Request, idempotent bool) (*http.Response, error) {
+	if id := ctxRequestID(req.Context()); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	uc := cfg.Upstreams.get(service)
+	client := upstreamClient(service)
+	breaker := upstreamBreaker(service)
+	for attempt := 0; ; attempt++ {
+		if !breaker.allow() {
+			return nil, errCircuitOpen
+		}
+		try := req
+		if attempt > 0 {
+			try = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				try.Body = body
+			}
+		}
+		start := time.Now()
+		res, err := client.Do(try)
+		upstreamSecs.since(start, service)
+		callErr := err
+		if err == nil && res.StatusCode >= http.StatusInternalServerError {
+			callErr = fmt.Errorf("status %d", res.StatusCode)
+		}
+		if callErr != nil {
+			upstreamErrors.inc(service)
+		}
+		// Caller gave up, not an upstream failure.
+		if callErr != nil && req.Context().Err() != nil {
+			breaker.release()
+		} else {
+			breaker.record(callErr == nil)
+		}
+		// Done, not retryable or caller gave up.
+		if callErr == nil || !idempotent || attempt >= uc.Retries || req.Context().Err() != nil {
+			recordUpstreamCall(service, callErr)
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		logWarning(req.Context(), "Retrying %s call, attempt %d failed. %v", service, attempt+1, callErr)
+		upstreamRetries.inc(service)
+		select {
+		case <-time.After(retryBackoff(uc.RetryBackoff, attempt)):
+		case <-req.Context().Done():
+			recordUpstreamCall(service, callErr)
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// Context not canceled with the request, keeping its request id, for calls shared or cached.
+// Limited by the upstream max call time.
+func detachedUpstreamContext(ctx context.Context, service string) (context.Context, context.CancelFunc) {
+	ctx = withRequestID(context.Background(), ctxRequestID(ctx))
+	return context.WithTimeout(ctx, cfg.Upstreams.get(service).maxCallTime())
+}
+
+// Exponential backoff with jitter, so retries from many requests don't align.
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt)
+	return d/2 + time.Duration(rand.Int63n(int64(d)+1))
+}
+
+// Get from upstream service.
+func getUpstream(ctx context.Context, service string, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doUpstream(service, req, true)
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Verified credentials are kept, bcrypt is slow by design.
+const AUTH_CACHE_TTL = time.Minute
+
+// Generated password random bytes, url base64 encoded.
+const CREDENTIAL_PASSWORD_BYTES = 24
+
+// Min length of password given instead of generated.
+const CREDENTIAL_PASSWORD_MIN_LENGTH = 16
+
+var usernameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{1,63}$`)
+
+var (
+	errUnknownUser       = errors.New("unknown user")
+	errInvalidCredential = errors.New("invalid credential")
+)
+
+// Roles, routes declare the role required.
+const (
+	ROLE_QUOTER       = "quoter"       // Freight quotes.
+	ROLE_RATES_VIEWER = "rates-viewer" // Read rate tables, rate versions and quote stats.
+	ROLE_RATES_ADMIN  = "rates-admin"  // Change rate tables and rate versions.
+	ROLE_OPS_ADMIN    = "ops-admin"    // Users, cache, log level, metrics and audit.
+)
+
+var validRoles = []string{ROLE_QUOTER, ROLE_RATES_VIEWER, ROLE_RATES_ADMIN, ROLE_OPS_ADMIN}
+
+// Roles granted by other roles.
+var includedRoles = map[string][]string{
+	ROLE_RATES_ADMIN: {ROLE_RATES_VIEWER},
+}
+
+// Roles of compiled-in users, used until the user is created in db.
+// Only quoting, admin roles only for db users.
+var compiledUserRoles = map[string][]string{
+	"zunkasite":   {ROLE_QUOTER},
+	"zoombuscape": {ROLE_QUOTER},
+}
+
+// Api user.
+type apiUser struct {
+	ID          int             `db:"id" json:"id"`
+	Username    string          `db:"username" json:"username"`
+	Roles       []string        `db:"-" json:"roles"`
+	CreatedAt   time.Time       `db:"created_at" json:"createdAt"`
+	UpdatedAt   time.Time       `db:"updated_at" json:"updatedAt"`
+	Credentials []apiCredential `db:"-" json:"credentials"`
+}
+
+// User credential, hash never sent.
+type apiCredential struct {
+	ID           int        `db:"id" json:"id"`
+	UserID       int        `db:"user_id" json:"-"`
+	PasswordHash string     `db:"password_hash" json:"-"`
+	Description  string     `db:"description" json:"description"`
+	ExpiresAt    *time.Time `db:"expires_at" json:"expiresAt"` // Null for no expiration.
+	LastUsedAt   *time.Time `db:"last_used_at" json:"lastUsedAt"`
+	CreatedAt    time.Time  `db:"created_at" json:"createdAt"`
+	Password     string     `db:"-" json:"password,omitempty"` // Only in creation, generated if empty.
+}
+
+func (u *apiUser) Validate() error {
+	if !usernameRegexp.MatchString(u.Username) {
+		return newValidationError("username", ERR_INVALID_FIELDS, "Invalid username: %q, must be 2 to 64 lowercase letters, digits, '_', '.' or '-'", u.Username)
+	}
+	return validateRoles(u.Roles)
+}
+
+func validateRoles(roles []string) error {
+	for i, role := range roles {
+		if !containsRole(validRoles, role) {
+			return newValidationError("roles", ERR_INVALID_FIELDS, "Invalid role: %q, must be one of %v", role, validRoles)
+		}
+		if containsRole(roles[:i], role) {
+			return newValidationError("roles", ERR_INVALID_FIELDS, "Duplicated role: %q", role)
+		}
+	}
+	return nil
+}
+
+func (c *apiCredential) Validate() error {
+	if c.Password != "" && len(c.Password) < CREDENTIAL_PASSWORD_MIN_LENGTH {
+		return newValidationError("password", ERR_INVALID_FIELDS, "Password must have at least %d characters, or be empty to generate one", CREDENTIAL_PASSWORD_MIN_LENGTH)
+	}
+	if c.ExpiresAt != nil && !c.ExpiresAt.After(time.Now()) {
+		return newValidationError("expiresAt", ERR_INVALID_FIELDS, "Expiration must be in the future")
+	}
+	if len(c.Description) > 256 {
+		return newValidationError("description", ERR_INVALID_FIELDS, "Description must have up to 256 characters")
+	}
+	return nil
+}
+
+func (c *apiCredential) expired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+/**************************************************************************************************
+* USERS
+**************************************************************************************************/
+// All users with credentials.
+func getAllUsers() (users []apiUser, err error) {
+	users = []apiUser{}
+	if err = sql3DB.Select(&users, "SELECT * FROM api_user ORDER BY username"); err != nil {
+		return users, newInternalError(err)
+	}
+	for i := range users {
+		if users[i].Roles, err = getUserRoles(users[i].ID); err != nil {
+			return users, err
+		}
+		if users[i].Credentials, err = getUserCredentials(users[i].ID); err != nil {
+			return users, err
+		}
+	}
+	return users, nil
+}
+
+// User with credentials.
+func getUserByName(username string) (u *apiUser, err error) {
+	u = &apiUser{}
+	err = sql3DB.Get(u, "SELECT * FROM api_user WHERE username=?", username)
+	if err == sql.ErrNoRows {
+		return u, newNotFoundError(ERR_NOT_FOUND, "User %s not found", username)
+	}
+	if err != nil {
+		return u, newInternalError(err)
+	}
+	if u.Roles, err = getUserRoles(u.ID); err != nil {
+		return u, err
+	}
+	u.Credentials, err = getUserCredentials(u.ID)
+	return u, err
+}
+
+func getUserRoles(userID int) (roles []string, err error) {
+	roles = []string{}
+	if err = sql3DB.Select(&roles, "SELECT role FROM api_user_role WHERE user_id=? ORDER BY role", userID); err != nil {
+		return roles, newInternalError(err)
+	}
+	return roles, nil
+}
+
+func getUserCredentials(userID int) (creds []apiCredential, err error) {
+	creds = []apiCredential{}
+	if err = sql3DB.Select(&creds, "SELECT * FROM api_credential WHERE user_id=? ORDER BY id", userID); err != nil {
+		return creds, newInternalError(err)
+	}
+	return creds, nil
+}
+
+// Create user with roles, without credentials.
+func createUser(u *apiUser) error {
+	if u.Roles == nil {
+		u.Roles = []string{}
+	}
+	if err := u.Validate(); err != nil {
+		return err
+	}
+	tx, err := sql3DB.Beginx()
+	if err != nil {
+		return newInternalError(err)
+	}
+	defer tx.Rollback()
+	if _, err = insertUser(tx, u); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return newInternalError(err)
+	}
+	created, err := getUserByName(u.Username)
+	if err != nil {
+		return err
+	}
+	*u = *created
+	return nil
+}
+
+// Insert user with its roles in transaction.
+func insertUser(tx *sqlx.Tx, u *apiUser) (id int, err error) {
+	result, err := tx.Exec("INSERT INTO api_user(username) VALUES(?)", u.Username)
+	if err != nil {
+		return id, newDBError(err)
+	}
+	lastID, err := result.LastInsertId()
+	if err != nil {
+		return id, newInternalError(err)
+	}
+	id = int(lastID)
+	return id, insertUserRoles(tx, id, u.Roles)
+}
+
+// Replace user roles, ops-admin can't be removed from the last one.
+func updateUserRoles(username string, roles []string) (u *apiUser, err error) {
+	if err = validateRoles(roles); err != nil {
+		return u, err
+	}
+	if u, err = getUserByName(username); err != nil {
+		return u, err
+	}
+	tx, err := sql3DB.Beginx()
+	if err != nil {
+		return u, newInternalError(err)
+	}
+	defer tx.Rollback()
+	if containsRole(u.Roles, ROLE_OPS_ADMIN) && !containsRole(roles, ROLE_OPS_ADMIN) {
+		if err = checkNotLastAdmin(tx, u); err != nil {
+			return u, err
+		}
+	}
+	if _, err = tx.Exec("DELETE FROM api_user_role WHERE user_id=?", u.ID); err != nil {
+		return u, newDBError(err)
+	}
+	if err = insertUserRoles(tx, u.ID, roles); err != nil {
+		return u, err
+	}
+	if _, err = tx.Exec("UPDATE api_user SET updated_at=CURRENT_TIMESTAMP WHERE id=?", u.ID); err != nil {
+		return u, newDBError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return u, newInternalError(err)
+	}
+	clearAuthCache()
+	return getUserByName(username)
+}
+
+func insertUserRoles(tx *sqlx.Tx, userID int, roles []string) error {
+	for _, role := range roles {
+		if _, err := tx.Exec("INSERT INTO api_user_role(user_id, role) VALUES(?, ?)", userID, role); err != nil {
+			return newDBError(err)
+		}
+	}
+	return nil
+}
+
+// Delete user, roles and credentials, last ops-admin can't be deleted.
+func deleteUser(username string) (u *apiUser, err error) {
+	if u, err = getUserByName(username); err != nil {
+		return u, err
+	}
+	tx, err := sql3DB.Beginx()
+	if err != nil {
+		return u, newInternalError(err)
+	}
+	defer tx.Rollback()
+	if containsRole(u.Roles, ROLE_OPS_ADMIN) {
+		if err = checkNotLastAdmin(tx, u); err != nil {
+			return u, err
+		}
+	}
+	if _, err = tx.Exec("DELETE FROM api_credential WHERE user_id=?", u.ID); err != nil {
+		return u, newDBError(err)
+	}
+	if _, err = tx.Exec("DELETE FROM api_user_role WHERE user_id=?", u.ID); err != nil {
+		return u, newDBError(err)
+	}
+	if _, err = tx.Exec("DELETE FROM api_user WHERE id=?", u.ID); err != nil {
+		return u, newDBError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return u, newInternalError(err)
+	}
+	clearAuthCache()
+	return u, nil
+}
+
+// Keep someone able to manage users, in the transaction changing u roles.
+func checkNotLastAdmin(tx *sqlx.Tx, u *apiUser) error {
+	var admins int
+	if err := tx.Get(&admins, "SELECT COUNT(*) FROM api_user_role WHERE role=? AND user_id!=?", ROLE_OPS_ADMIN, u.ID); err != nil {
+		return newInternalError(err)
+	}
+	if admins == 0 {
+		return newConflictError("User %s is the last %s", u.Username, ROLE_OPS_ADMIN)
+	}
+	return nil
+}
+
+/**************************************************************************************************
+* ROLES
+**************************************************************************************************/
+// If roles has role, directly or included by other role.
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role || containsRole(includedRoles[r], role) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+/**************************************************************************************************
+* CREDENTIALS
+**************************************************************************************************/
+// Create user credential, password is generated if empty and returned only here.
+func createCredential(username string, c *apiCredential) error {
+	u, err := getUserByName(username)
+	if err != nil {
+		return err
+	}
+	if err = c.Validate(); err != nil {
+		return err
+	}
+	tx, err := sql3DB.Beginx()
+	if err != nil {
+		return newInternalError(err)
+	}
+	defer tx.Rollback()
+	if err = insertCredential(tx, u.ID, c); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return newInternalError(err)
+	}
+	return nil
+}
+
+// Insert credential in transaction, random password if not set, only the hash is saved.
+func insertCredential(tx *sqlx.Tx, userID int, c *apiCredential) (err error) {
+	if c.Password == "" {
+		if c.Password, err = newPassword(); err != nil {
+			return newInternalError(err)
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return newInternalError(err)
+	}
+	var expiresAt interface{}
+	if c.ExpiresAt != nil {
+		expiresAt = c.ExpiresAt.UTC().Format(SQLITE_TIME_FORMAT)
+	}
+	result, err := tx.Exec("INSERT INTO api_credential(user_id, password_hash, description, expires_at) VALUES(?, ?, ?, ?)", userID, string(hash), c.Description, expiresAt)
+	if err != nil {
+		return newDBError(err)
+	}
+	lastID, err := result.LastInsertId()
+	if err != nil {
+		return newInternalError(err)
+	}
+	password := c.Password
+	if err = tx.Get(c, "SELECT * FROM api_credential WHERE id=?", lastID); err != nil {
+		return newInternalError(err)
+	}
+	c.Password = password
+	return nil
+}
+
+// Revoke user credential.
+func deleteCredential(username string, id int) (c *apiCredential, err error) {
+	u, err := getUserByName(username)
+	if err != nil {
+		return c, err
+	}
+	for i := range u.Credentials {
+		if u.Credentials[i].ID == id {
+			c = &u.Credentials[i]
+		}
+	}
+	if c == nil {
+		return c, newNotFoundError(ERR_NOT_FOUND, "Credential %d of user %s not found", id, username)
+	}
+	if _, err = sql3DB.Exec("DELETE FROM api_credential WHERE id=?", id); err != nil {
+		return c, newDBError(err)
+	}
+	clearAuthCache()
+	return c, nil
+}
+
+// Random password, url safe.
+func newPassword() (string, error) {
+	b := make([]byte, CREDENTIAL_PASSWORD_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/**************************************************************************************************
+* AUTHENTICATION
+**************************************************************************************************/
+// Verified credential.
+type authCacheEntry struct {
+	roles     []string
+	expiresAt time.Time
+}
+
+var (
+	authCacheMu sync.Mutex
+	authCache   = map[string]authCacheEntry{} // By hash of username and password.
+)
+
+// Forget verified credentials, after users or credentials change.
+func clearAuthCache() {
+	authCacheMu.Lock()
+	authCache = map[string]authCacheEntry{}
+	authCacheMu.Unlock()
+}
+
+// Check password against user credentials not expired, user roles if valid, errUnknownUser if user not exist.
+// Last used time is updated when verified, not for cached verifications.
+func verifyCredential(ctx context.Context, username string, password string) (roles []string, err error) {
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+	authCacheMu.Lock()
+	entry, ok := authCache[key]
+	authCacheMu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.roles, nil
+	}
+
+	u := apiUser{}
+	err = sql3DB.Get(&u, "SELECT * FROM api_user WHERE username=?", username)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	creds, err := getUserCredentials(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range creds {
+		if c.expired(now) || bcrypt.CompareHashAndPassword([]byte(c.PasswordHash), []byte(password)) != nil {
+			continue
+		}
+		if _, err = sql3DB.Exec("UPDATE api_credential SET last_used_at=? WHERE id=?", now.UTC().Format(SQLITE_TIME_FORMAT), c.ID); err != nil {
+			logError(ctx, "Updating credential %d last used time. %v", c.ID, err)
+		}
+		if u.Roles, err = getUserRoles(u.ID); err != nil {
+			return nil, err
+		}
+		entry = authCacheEntry{roles: u.Roles, expiresAt: now.Add(AUTH_CACHE_TTL)}
+		if c.ExpiresAt != nil && c.ExpiresAt.Before(entry.expiresAt) {
+			entry.expiresAt = *c.ExpiresAt
+		}
+		authCacheMu.Lock()
+		authCache[key] = entry
+		authCacheMu.Unlock()
+		return u.Roles, nil
+	}
+	return nil, errInvalidCredential
+}
+
+// User roles if credentials are valid, compiled-in ones for users not created yet.
+func checkCredentials(ctx context.Context, username string, password string) (roles []string, ok bool) {
+	roles, err := verifyCredential(ctx, username, password)
+	if err == errUnknownUser {
+		if checkUserPass(username, password) {
+			return compiledUserRoles[username], true
+		}
+		return nil, false
+	}
+	if err != nil && err != errInvalidCredential {
+		logError(ctx, "Verifying credential of %s. %v", username, err)
+	}
+	return roles, err == nil
+}
+
+// Create ops-admin user with a generated credential, to manage the other users.
+func bootstrapAdmin(username string) (password string, err error) {
+	u := apiUser{Username: username, Roles: []string{ROLE_OPS_ADMIN}}
+	if err = u.Validate(); err != nil {
+		return "", err
+	}
+	c := apiCredential{Description: "Bootstrap"}
+	if err = c.Validate(); err != nil {
+		return "", err
+	}
+	// User and credential together, the flag can be run again if it fails.
+	tx, err := sql3DB.Beginx()
+	if err != nil {
+		return "", newInternalError(err)
+	}
+	defer tx.Rollback()
+	id, err := insertUser(tx, &u)
+	if err != nil {
+		return "", err
+	}
+	if err = insertCredential(tx, id, &c); err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", newInternalError(err)
+	}
+	return c.Password, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Regions used by freight_region table.
+var freightRegions = []string{"north", "northeast", "midwest", "southeast", "south"}
+
+// Invalid fields found by validation.
+type fieldErrors []fieldError
+
+// Add invalid field.
+func (fes *fieldErrors) add(field string, code string, format string, a ...interface{}) {
+	*fes = append(*fes, fieldError{Field: field, Code: code, Message: fmt.Sprintf(format, a...)})
+}
+
+// Validation error, nil if no invalid field.
+func (fes fieldErrors) err() error {
+	if len(fes) == 0 {
+		return nil
+	}
+	aErr := newValidationError("", ERR_INVALID_FIELDS, "Invalid fields")
+	aErr.Errors = fes
+	return aErr
+}
+
+// Weight, deadline and price common to all freight tables.
+func (fes *fieldErrors) addTier(weight int, deadline int, price int, minPrice int) {
+	if weight < 100 {
+		fes.add("weight", ERR_INVALID_WEIGHT, "Weight of %v grams, must be at least 100 grams", weight)
+	}
+	fes.addDeadlineAndPrice(deadline, price, minPrice)
+}
+
+// Deadline and price.
+func (fes *fieldErrors) addDeadlineAndPrice(deadline int, price int, minPrice int) {
+	if deadline <= 0 {
+		fes.add("deadline", ERR_INVALID_DEADLINE, "Deadline of %v days, must be more than 0", deadline)
+	}
+	if price < minPrice {
+		fes.add("price", ERR_INVALID_PRICE, "Price of %v, must be at least %v", price, minPrice)
+	}
+}
+
+/**************************************************************************************************
+* REGION FREIGHT
+**************************************************************************************************/
+// Validate region freight.
+func (fr *regionFreight) Validate(ctx context.Context) error {
+	fes := fieldErrors{}
+	fr.Region = strings.ToLower(strings.TrimSpace(fr.Region))
+	valid := false
+	for _, region := range freightRegions {
+		if fr.Region == region {
+			valid = true
+		}
+	}
+	if !valid {
+		fes.add("region", ERR_INVALID_REGION, "Unknown region \"%s\", must be one of %s", fr.Region, strings.Join(freightRegions, ", "))
+	}
+	fes.addTier(fr.Weight, fr.Deadline, fr.Price, 1)
+	return fes.err()
+}
+
+// Region freight with same region, weight and deadline.
+func (fr *regionFreight) checkDuplicate(q sqlx.Queryer) error {
+	var id int
+	err := sqlx.Get(q, &id, "SELECT id FROM freight_region WHERE version_id=? AND region=? AND weight=? AND deadline=? AND id!=?", fr.VersionID, fr.Region, fr.Weight, fr.Deadline, fr.ID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return newInternalError(err)
+	}
+	return newConflictError("Region freight %d already have region %s, weight %d and deadline %d", id, fr.Region, fr.Weight, fr.Deadline)
+}
+
+/**************************************************************************************************
+* DEALER FREIGHT
+**************************************************************************************************/
+// Validate dealer freight.
+func (fr *dealerFreight) Validate(ctx context.Context) error {
+	fes := fieldErrors{}
+	fr.Dealer = strings.ToLower(strings.TrimSpace(fr.Dealer))
+	if getCEPByDealerLocation(fr.Dealer) == "" {
+		fes.add("dealer", ERR_INVALID_DEALER, "Unknown dealer location \"%s\"", fr.Dealer)
+	}
+	// Dealer may ship for free.
+	fes.addTier(fr.Weight, fr.Deadline, fr.Price, 0)
+	return fes.err()
+}
+
+// Dealer freight with same dealer, weight and deadline.
+func (fr *dealerFreight) checkDuplicate(q sqlx.Queryer) error {
+	var id int
+	err := sqlx.Get(q, &id, "SELECT id FROM dealer_freight WHERE version_id=? AND dealer=? AND weight=? AND deadline=? AND id!=?", fr.VersionID, fr.Dealer, fr.Weight, fr.Deadline, fr.ID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return newInternalError(err)
+	}
+	return newConflictError("Dealer freight %d already have dealer %s, weight %d and deadline %d", id, fr.Dealer, fr.Weight, fr.Deadline)
+}
+
+/**************************************************************************************************
+* MOTOBOY FREIGHT
+**************************************************************************************************/
+// Validate motoboy freight.
+func (mf *motoboyFreight) Validate(ctx context.Context) error {
+	fes := fieldErrors{}
+	mf.City = strings.TrimSpace(mf.City)
+	mf.NormalizeCity()
+	if mf.City == "" {
+		fes.add("city", ERR_REQUIRED, "City required")
+	} else {
+		ok, err := isMGCity(ctx, mf.City)
+		// Not block changes when IBGE is out, unique and check constraints still apply.
+		if err != nil {
+			logWarning(ctx, "Could not check if %s is a Minas Gerais city. %v", mf.City, err)
+		} else if !ok {
+			fes.add("city", ERR_INVALID_CITY, "%s is not a Minas Gerais city", mf.City)
+		}
+	}
+	fes.addDeadlineAndPrice(mf.Deadline, mf.Price, 1)
+	return fes.err()
+}
+
+// Motoboy freight for the same city.
+func (mf *motoboyFreight) checkDuplicate(q sqlx.Queryer) error {
+	var id int
+	err := sqlx.Get(q, &id, "SELECT id FROM motoboy_freight WHERE version_id=? AND state=? AND city_norm=? AND id!=?", mf.VersionID, "mg", mf.CityNorm, mf.ID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return newInternalError(err)
+	}
+	return newConflictError("Motoboy freight %d already have city %s", id, mf.City)
+}
+
+// Id required to update.
+func validateID(id int) error {
+	if id <= 0 {
+		return newValidationError("id", ERR_REQUIRED, "Id required")
+	}
+	return nil
+}
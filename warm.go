@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval between checks for off-peak hours.
+const WARM_CHECK_INTERVAL = 10 * time.Minute
+
+// Max quoted destinations and packs counted, new ones are ignored above it.
+const WARM_MAX_KEYS = 10000
+
+// Quoted destination and pack.
+type warmKey struct {
+	CEPOrigin string
+	CEPPrefix string // Destination.
+	Length    int
+	Width     int
+	Height    int
+	Weight    int
+	Price     float64
+}
+
+// Times quoted, with last destination CEP, used to warm.
+type warmCount struct {
+	cepDestiny string
+	count      int
+}
+
+var (
+	warmMu     sync.Mutex
+	warmCounts = map[warmKey]*warmCount{}
+)
+
+// Count packs quoted.
+func observeWarmPacks(packs []pack) {
+	warmMu.Lock()
+	defer warmMu.Unlock()
+	for _, p := range packs {
+		if len(p.CEPDestiny) < 5 {
+			continue
+		}
+		key := warmKey{p.CEPOrigin, p.CEPDestiny[:5], p.Length, p.Width, p.Height, p.Weight, p.Price}
+		wc, ok := warmCounts[key]
+		if !ok {
+			if len(warmCounts) >= WARM_MAX_KEYS {
+				continue
+			}
+			wc = &warmCount{}
+			warmCounts[key] = wc
+		}
+		wc.cepDestiny = p.CEPDestiny
+		wc.count++
+	}
+}
+
+// Most quoted packs.
+func topWarmPacks(n int) []pack {
+	warmMu.Lock()
+	defer warmMu.Unlock()
+	keys := make([]warmKey, 0, len(warmCounts))
+	for key := range warmCounts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return warmCounts[keys[i]].count > warmCounts[keys[j]].count
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	packs := []pack{}
+	for _, key := range keys {
+		packs = append(packs, pack{
+			CEPOrigin:  key.CEPOrigin,
+			CEPDestiny: warmCounts[key].cepDestiny,
+			Length:     key.Length,
+			Width:      key.Width,
+			Height:     key.Height,
+			Weight:     key.Weight,
+			Price:      key.Price,
+		})
+	}
+	return packs
+}
+
+// Halve counts after warming, so old destinations leave the top.
+func decayWarmCounts() {
+	warmMu.Lock()
+	defer warmMu.Unlock()
+	for key, wc := range warmCounts {
+		wc.count /= 2
+		if wc.count == 0 {
+			delete(warmCounts, key)
+		}
+	}
+}
+
+// Configured products to configured CEPs and most quoted packs, without repeated ones.
+func warmPacks() []pack {
+	packs := []pack{}
+	for _, cep := range cfg.Warm.CEPs {
+		for _, wp := range cfg.Warm.Packs {
+			packs = append(packs, pack{
+				CEPOrigin:  CEP_ORIGIN,
+				CEPDestiny: strings.ReplaceAll(cep, "-", ""),
+				Length:     wp.Length,
+				Width:      wp.Width,
+				Height:     wp.Height,
+				Weight:     wp.Weight,
+				Price:      wp.Price,
+			})
+		}
+	}
+	packs = append(packs, topWarmPacks(cfg.Warm.Top)...)
+	seen := map[string]bool{}
+	unique := []pack{}
+	for _, p := range packs {
+		if err := p.ValidateCorreios(); err != nil {
+			continue
+		}
+		p = p.correiosBucket()
+		key := makeCorreiosKey(&p)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, p)
+		}
+	}
+	return unique
+}
+
+// Fetch Correios freights and ViaCEP addresses not in cache or stale, one upstream call by interval.
+func warmCache(ctx context.Context) (correios int, viaCEP int) {
+	limiter := time.NewTicker(cfg.Warm.CallInterval)
+	defer limiter.Stop()
+	wait := func() bool {
+		select {
+		case <-limiter.C:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	ceps := map[string]bool{}
+	for _, p := range warmPacks() {
+		ceps[p.CEPDestiny] = true
+		if _, stale, ok := getCorreiosCache(&p); ok && !stale {
+			continue
+		}
+		if !wait() {
+			return
+		}
+		p := p
+		if _, err, _ := correiosFlight.Do(makeCorreiosKey(&p), func() (interface{}, error) {
+			return fetchCorreiosFreights(ctx, &p)
+		}); err == nil {
+			correios++
+			cacheWarmed.inc(CACHE_CORREIOS)
+		}
+	}
+	for cep := range ceps {
+		if _, ok := getViaCEPAddressCache(&cep); ok {
+			continue
+		}
+		if !wait() {
+			return
+		}
+		if _, err := getAddressByCEP(ctx, cep); err == nil {
+			viaCEP++
+			cacheWarmed.inc(CACHE_VIA_CEP_ADDRESS)
+		}
+	}
+	return correios, viaCEP
+}
+
+// Off-peak, Brazil time.
+func isWarmHour(t time.Time) bool {
+	hour := t.In(brLocation).Hour()
+	if cfg.Warm.StartHour <= cfg.Warm.EndHour {
+		return hour >= cfg.Warm.StartHour && hour < cfg.Warm.EndHour
+	}
+	// Across midnight.
+	return hour >= cfg.Warm.StartHour || hour < cfg.Warm.EndHour
+}
+
+// Warm cache once a day at off-peak hours.
+func runCacheWarming() {
+	lastDay := ""
+	for {
+		now := time.Now()
+		day := now.In(brLocation).Format("2006-01-02")
+		if isWarmHour(now) && day != lastDay {
+			lastDay = day
+			start := time.Now()
+			correios, viaCEP := warmCache(context.Background())
+			decayWarmCounts()
+			logInfo(context.Background(), "Cache warmed, %d Correios freight(s) and %d ViaCEP address(es) in %.0fs", correios, viaCEP, time.Since(start).Seconds())
+		}
+		time.Sleep(WARM_CHECK_INTERVAL)
+	}
+}